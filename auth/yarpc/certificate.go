@@ -0,0 +1,83 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpcauth
+
+import (
+	"context"
+	"crypto/x509"
+
+	"go.pitz.tech/lib/auth"
+	"go.pitz.tech/lib/yarpc"
+)
+
+// CertificateMapper converts a verified client certificate into user information. Returning false leaves the stream
+// unauthenticated.
+type CertificateMapper func(cert *x509.Certificate) (auth.UserInfo, bool)
+
+// Certificate returns an auth.HandlerFunc that authenticates streams using the verified certificate presented by the
+// client during the TLS handshake. This allows mutual TLS, such as a livetls configuration that requires client
+// certificates, to act as authentication. When the mapper is nil, UserInfoFromCertificate is used. Streams without a
+// verified client certificate are left unauthenticated.
+func Certificate(mapper CertificateMapper) auth.HandlerFunc {
+	if mapper == nil {
+		mapper = UserInfoFromCertificate
+	}
+
+	return func(ctx context.Context) (context.Context, error) {
+		peer, ok := yarpc.Peer(ctx)
+		if !ok {
+			return ctx, nil
+		}
+
+		cert := peer.Certificate()
+		if cert == nil {
+			return ctx, nil
+		}
+
+		userInfo, ok := mapper(cert)
+		if !ok {
+			return ctx, nil
+		}
+
+		return auth.ToContext(ctx, userInfo), nil
+	}
+}
+
+// UserInfoFromCertificate identifies the user using the SPIFFE ID of the certificate, falling back to its common name.
+// The common name is used as the profile, the first email address as the email, and the organizational units as
+// groups. Email addresses are considered verified as they were vouched for by the certificate authority.
+func UserInfoFromCertificate(cert *x509.Certificate) (auth.UserInfo, bool) {
+	userInfo := auth.UserInfo{
+		Subject: cert.Subject.CommonName,
+		Profile: cert.Subject.CommonName,
+		Groups:  append([]string{}, cert.Subject.OrganizationalUnit...),
+	}
+
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			userInfo.Subject = uri.String()
+
+			break
+		}
+	}
+
+	if len(cert.EmailAddresses) > 0 {
+		userInfo.Email = cert.EmailAddresses[0]
+		userInfo.EmailVerified = true
+	}
+
+	return userInfo, userInfo.Subject != ""
+}
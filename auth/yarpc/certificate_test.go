@@ -0,0 +1,96 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpcauth_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/auth"
+	yarpcauth "go.pitz.tech/lib/auth/yarpc"
+	"go.pitz.tech/lib/yarpc"
+)
+
+func withCertificate(cert *x509.Certificate) context.Context {
+	return yarpc.PeerToContext(context.Background(), &yarpc.PeerInfo{
+		TLS: &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		},
+	})
+}
+
+func TestCertificate(t *testing.T) {
+	t.Parallel()
+
+	spiffeID, err := url.Parse("spiffe://example.org/ns/default/sa/client")
+	require.NoError(t, err)
+
+	handler := yarpcauth.Certificate(nil)
+
+	ctx, err := handler(withCertificate(&x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "client",
+			OrganizationalUnit: []string{"ops"},
+		},
+		URIs:           []*url.URL{spiffeID},
+		EmailAddresses: []string{"client@example.org"},
+	}))
+	require.NoError(t, err)
+
+	userInfo := auth.Extract(ctx)
+	require.NotNil(t, userInfo)
+	require.Equal(t, "spiffe://example.org/ns/default/sa/client", userInfo.Subject)
+	require.Equal(t, "client", userInfo.Profile)
+	require.Equal(t, "client@example.org", userInfo.Email)
+	require.True(t, userInfo.EmailVerified)
+	require.Equal(t, []string{"ops"}, userInfo.Groups)
+
+	// the common name identifies certificates without a SPIFFE ID
+	ctx, err = handler(withCertificate(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "client"},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "client", auth.Extract(ctx).Subject)
+
+	// peers without a verified certificate are left unauthenticated
+	for _, ctx := range []context.Context{
+		context.Background(),
+		yarpc.PeerToContext(context.Background(), &yarpc.PeerInfo{}),
+		withCertificate(&x509.Certificate{}),
+	} {
+		ctx, err = handler(ctx)
+		require.NoError(t, err)
+		require.Nil(t, auth.Extract(ctx))
+	}
+
+	_, err = auth.Composite(handler, auth.Required())(context.Background())
+	require.ErrorIs(t, err, auth.ErrUnauthorized)
+
+	// custom mappers control how certificates are converted
+	handler = yarpcauth.Certificate(func(cert *x509.Certificate) (auth.UserInfo, bool) {
+		return auth.UserInfo{Subject: "mapped:" + cert.Subject.CommonName}, true
+	})
+
+	ctx, err = handler(withCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "client"}}))
+	require.NoError(t, err)
+	require.Equal(t, "mapped:client", auth.Extract(ctx).Subject)
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpcauth
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// WithTokenSource configures a client connection to authenticate every stream it opens using the token returned by the
+// provided source (such as basicauth.ClientConfig).
+func WithTokenSource(source oauth2.TokenSource) yarpc.Option {
+	return yarpc.WithClientInterceptors(ClientInterceptor(source))
+}
+
+// ClientInterceptor returns a yarpc.ClientInterceptor that attaches the token returned by the provided source to the
+// authorization header of every stream. No header is set when the source returns a nil token.
+func ClientInterceptor(source oauth2.TokenSource) yarpc.ClientInterceptor {
+	return func(ctx context.Context, method string, next yarpc.OpenStreamFunc) (yarpc.Stream, error) {
+		token, err := source.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if token != nil {
+			header := yarpc.ExtractOutgoingHeader(ctx)
+			header.Set("authorization", token.Type()+" "+token.AccessToken)
+
+			ctx = yarpc.OutgoingHeaderToContext(ctx, header)
+		}
+
+		return next(ctx, method)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpcauth
+
+import (
+	"errors"
+
+	"go.pitz.tech/lib/auth"
+	"go.pitz.tech/lib/yarpc"
+)
+
+// Handler returns a yarpc middleware handler that invokes the provided auth handlers using the headers sent when the
+// stream was opened. Streams that fail with auth.ErrUnauthorized are rejected with an unauthenticated status.
+func Handler(delegate yarpc.Handler, handlers ...auth.HandlerFunc) yarpc.HandlerFunc {
+	handler := auth.Composite(handlers...)
+
+	return func(stream yarpc.Stream) error {
+		ctx, err := handler(stream.Context())
+
+		switch {
+		case errors.Is(err, auth.ErrUnauthorized):
+			return &yarpc.Error{
+				Code:    yarpc.CodeUnauthenticated,
+				Message: err.Error(),
+			}
+		case err != nil:
+			return err
+		default:
+			return delegate.ServeYARPC(yarpc.StreamWithContext(ctx, stream))
+		}
+	}
+}
+
+// Interceptor returns a yarpc.ServerInterceptor that invokes the provided auth handlers before every handler on the
+// server.
+func Interceptor(handlers ...auth.HandlerFunc) yarpc.ServerInterceptor {
+	return func(method string, stream yarpc.Stream, next yarpc.Handler) error {
+		return Handler(next, handlers...).ServeYARPC(stream)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpcauth_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/auth"
+	basicauth "go.pitz.tech/lib/auth/basic"
+	yarpcauth "go.pitz.tech/lib/auth/yarpc"
+	"go.pitz.tech/lib/yarpc"
+)
+
+type message struct {
+	Subject string
+	Groups  []string
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+
+	authHandler, err := basicauth.Handler(context.Background(), basicauth.Config{
+		PasswordFile: filepath.Join("..", "basic", "testdata", "basic.csv"),
+	})
+	require.NoError(t, err)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle("whoami", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		user := auth.Extract(stream.Context())
+		require.NotNil(t, user)
+
+		return stream.WriteMsg(&message{
+			Subject: user.Subject,
+			Groups:  user.Groups,
+		})
+	}))
+
+	address := filepath.Join(t.TempDir(), "yarpc.sock")
+
+	listener, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	svr := &yarpc.Server{Handler: mux}
+	defer svr.Shutdown()
+
+	go func() {
+		_ = svr.Serve(
+			&yarpc.NetListenerAdapter{Listener: listener},
+			yarpc.WithServerInterceptors(yarpcauth.Interceptor(authHandler, auth.Required())),
+		)
+	}()
+
+	ctx := context.Background()
+
+	{
+		conn := yarpc.DialContext(ctx, "unix", address)
+
+		stream, err := conn.OpenStream(ctx, "whoami")
+		require.NoError(t, err)
+
+		err = stream.ReadMsg(&message{})
+		require.ErrorIs(t, err, &yarpc.Error{Code: yarpc.CodeUnauthenticated})
+		require.NoError(t, stream.Close())
+	}
+
+	{
+		conn := yarpc.DialContext(ctx, "unix", address, yarpcauth.WithTokenSource(basicauth.ClientConfig{
+			UsernamePassword: basicauth.UsernamePassword{
+				Username: "username",
+				Password: "password",
+			},
+		}))
+
+		stream, err := conn.OpenStream(ctx, "whoami")
+		require.NoError(t, err)
+
+		msg := &message{}
+		require.NoError(t, stream.ReadMsg(msg))
+		require.Equal(t, "userID", msg.Subject)
+		require.Equal(t, []string{"group1", "group2"}, msg.Groups)
+		require.NoError(t, stream.Close())
+	}
+}
@@ -28,6 +28,7 @@ import (
 var (
 	// JSON defines a common structure for handling JSON encoding.
 	JSON = &Encoding{
+		Name: "json",
 		Encoder: func(w io.Writer) Encoder {
 			return json.NewEncoder(w)
 		},
@@ -38,6 +39,7 @@ var (
 
 	// MsgPack defines a common structure for handling MsgPack encoding.
 	MsgPack = &Encoding{
+		Name: "msgpack",
 		Encoder: func(w io.Writer) Encoder {
 			return msgpack.NewEncoder(w)
 		},
@@ -48,6 +50,7 @@ var (
 
 	// TOML defines a common structure for handling TOML encoding.
 	TOML = &Encoding{
+		Name: "toml",
 		Encoder: func(w io.Writer) Encoder {
 			return toml.NewEncoder(w)
 		},
@@ -58,6 +61,7 @@ var (
 
 	// YAML defines a common structure for handling YAML encoding.
 	YAML = &Encoding{
+		Name: "yaml",
 		Encoder: func(w io.Writer) Encoder {
 			return yaml.NewEncoder(w)
 		},
@@ -68,6 +72,7 @@ var (
 
 	// XML defines a common structure for handling XML encoding.
 	XML = &Encoding{
+		Name: "xml",
 		Encoder: func(w io.Writer) Encoder {
 			return xml.NewEncoder(w)
 		},
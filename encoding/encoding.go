@@ -31,6 +31,8 @@ type Encoder interface {
 
 // Encoding defines the encoding of a file.
 type Encoding struct {
+	// Name identifies the encoding, such as when negotiating which encoding to use with a remote process.
+	Name string
 	// Encoder produces a new marshaledEncoder that can write messages to the provided io.Writer.
 	Encoder func(w io.Writer) Encoder
 	// Decoder produces a new decoder that can read messages from the provided io.Reader.
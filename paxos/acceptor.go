@@ -102,7 +102,7 @@ func (a *acceptor) Accept(ctx context.Context, proposal *Proposal) (*Proposal, e
 	return proposal, nil
 }
 
-func (a *acceptor) Observe(call *ObserveServerStream) error {
+func (a *acceptor) Observe(call *yarpc.ServerStream[*Request, *Proposal]) error {
 	var lastAcceptID uint64
 
 	a.mu.Lock()
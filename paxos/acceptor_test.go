@@ -22,6 +22,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"go.pitz.tech/lib/paxos"
+	"go.pitz.tech/lib/yarpc"
 )
 
 // nolint:funlen // idc about length for tests
@@ -108,7 +109,7 @@ func TestAcceptor(t *testing.T) {
 		observeStream.Incoming <- &paxos.Request{}
 
 		go func() {
-			err := acceptor.Observe(&paxos.ObserveServerStream{Stream: observeStream})
+			err := acceptor.Observe(&yarpc.ServerStream[*paxos.Request, *paxos.Proposal]{Stream: observeStream})
 			require.NoError(t, err)
 		}()
 
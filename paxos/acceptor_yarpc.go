@@ -0,0 +1,72 @@
+// Code generated by yarpc-gen. DO NOT EDIT.
+
+package paxos
+
+import (
+	"context"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// RegisterAcceptorServer registers the provided AcceptorServer implementation with the yarpc.ServeMux to handle
+// requests.
+func RegisterAcceptorServer(svr *yarpc.ServeMux, impl AcceptorServer) {
+	svr.Handle("/paxos.acceptor/Prepare", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		req := new(Request)
+		if err := stream.ReadMsg(req); err != nil {
+			return err
+		}
+
+		resp, err := impl.Prepare(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(resp)
+	}))
+
+	svr.Handle("/paxos.acceptor/Accept", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		req := new(Proposal)
+		if err := stream.ReadMsg(req); err != nil {
+			return err
+		}
+
+		resp, err := impl.Accept(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(resp)
+	}))
+}
+
+// NewAcceptorClient wraps the provided yarpc.ClientConn with an implementation of the AcceptorClient.
+func NewAcceptorClient(cc *yarpc.ClientConn) AcceptorClient {
+	return &acceptorClient{
+		cc: cc,
+	}
+}
+
+type acceptorClient struct {
+	cc *yarpc.ClientConn
+}
+
+func (c *acceptorClient) Prepare(ctx context.Context, req *Request) (*Promise, error) {
+	resp := new(Promise)
+	if err := c.cc.Invoke(ctx, "/paxos.acceptor/Prepare", req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (c *acceptorClient) Accept(ctx context.Context, req *Proposal) (*Proposal, error) {
+	resp := new(Proposal)
+	if err := c.cc.Invoke(ctx, "/paxos.acceptor/Accept", req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+var _ AcceptorClient = &acceptorClient{}
@@ -24,6 +24,7 @@ import (
 	"go.pitz.tech/lib/logger"
 
 	"go.pitz.tech/lib/paxos"
+	"go.pitz.tech/lib/yarpc"
 )
 
 // nolint:funlen // idc about length for tests
@@ -133,7 +134,7 @@ func testLog(ctx context.Context, t *testing.T, root paxos.Log) {
 		observeStream.Incoming <- &paxos.Request{}
 
 		go func() {
-			err := acceptor.Observe(&paxos.ObserveServerStream{Stream: observeStream})
+			err := acceptor.Observe(&yarpc.ServerStream[*paxos.Request, *paxos.Proposal]{Stream: observeStream})
 			require.NoError(t, err)
 		}()
 
@@ -22,6 +22,7 @@ import (
 	"github.com/cenkalti/backoff/v4"
 
 	"go.pitz.tech/lib/cluster"
+	"go.pitz.tech/lib/yarpc"
 )
 
 // Observer watches the Acceptors to learn about what values have been accepted.
@@ -33,7 +34,7 @@ type Observer struct {
 // nolint:cyclop
 func (o *Observer) observe(ctx context.Context, member string, lastAccepted *Proposal, votes chan *Vote) {
 	var client ObserverClient
-	var observations *ObserveClientStream
+	var observations *yarpc.ClientStream[*Request, *Proposal]
 
 	var err error
 	err = backoff.Retry(func() error {
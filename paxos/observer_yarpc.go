@@ -0,0 +1,45 @@
+// Code generated by yarpc-gen. DO NOT EDIT.
+
+package paxos
+
+import (
+	"context"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// RegisterObserverServer registers the provided ObserverServer implementation with the yarpc.ServeMux to handle
+// requests.
+func RegisterObserverServer(svr *yarpc.ServeMux, impl ObserverServer) {
+	svr.Handle("/paxos.Observer/Observe", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return impl.Observe(&yarpc.ServerStream[*Request, *Proposal]{Stream: stream})
+	}))
+}
+
+// NewObserverClient wraps the provided yarpc.ClientConn with an implementation of the ObserverClient.
+func NewObserverClient(cc *yarpc.ClientConn) ObserverClient {
+	return &observerClient{
+		cc: cc,
+	}
+}
+
+type observerClient struct {
+	cc *yarpc.ClientConn
+}
+
+func (c *observerClient) Observe(ctx context.Context, req *Request) (*yarpc.ClientStream[*Request, *Proposal], error) {
+	stream, err := c.cc.OpenStream(ctx, "/paxos.Observer/Observe")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stream.WriteMsg(req); err != nil {
+		_ = stream.Close()
+
+		return nil, err
+	}
+
+	return &yarpc.ClientStream[*Request, *Proposal]{Stream: stream}, nil
+}
+
+var _ ObserverClient = &observerClient{}
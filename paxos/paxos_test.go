@@ -56,10 +56,10 @@ func TestPaxos(t *testing.T) {
 			AcceptedLog: root.WithPrefix("accepted/"),
 			RecordedLog: root.WithPrefix("recorded/"),
 			AcceptorDialer: func(ctx context.Context, member string) (paxos.AcceptorClient, error) {
-				return paxos.NewYarpcAcceptorClient(yarpc.DialContext(ctx, network, member)), nil
+				return paxos.NewAcceptorClient(yarpc.DialContext(ctx, network, member)), nil
 			},
 			ObserverDialer: func(ctx context.Context, member string) (paxos.ObserverClient, error) {
-				return paxos.NewYarpcObserverClient(yarpc.DialContext(ctx, network, member)), nil
+				return paxos.NewObserverClient(yarpc.DialContext(ctx, network, member)), nil
 			},
 		})
 	}
@@ -93,8 +93,8 @@ func TestPaxos(t *testing.T) {
 		svr := &yarpc.Server{
 			Handler: mux,
 		}
-		paxos.RegisterYarpcAcceptorServer(mux, pax)
-		paxos.RegisterYarpcObserverServer(mux, pax)
+		paxos.RegisterAcceptorServer(mux, pax)
+		paxos.RegisterObserverServer(mux, pax)
 
 		svrContext := yarpc.WithContext(ctx)
 
@@ -24,6 +24,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"go.pitz.tech/lib/paxos"
+	"go.pitz.tech/lib/yarpc"
 )
 
 // this is quite similar to the yarpc client. would be good to generalize the yarpc.ClientConn definition too...
@@ -53,13 +54,13 @@ func (m *mockAcceptor) Accept(ctx context.Context, proposal *paxos.Proposal) (*p
 	return proposal, m.mockStream.ReadMsg(proposal)
 }
 
-func (m *mockAcceptor) Observe(ctx context.Context, request *paxos.Request) (*paxos.ObserveClientStream, error) {
+func (m *mockAcceptor) Observe(ctx context.Context, request *paxos.Request) (*yarpc.ClientStream[*paxos.Request, *paxos.Proposal], error) {
 	err := m.mockStream.WriteMsg(request)
 	if err != nil {
 		return nil, err
 	}
 
-	return &paxos.ObserveClientStream{Stream: m.mockStream}, nil
+	return &yarpc.ClientStream[*paxos.Request, *paxos.Proposal]{Stream: m.mockStream}, nil
 }
 
 var _ paxos.AcceptorClient = &mockAcceptor{}
@@ -30,6 +30,7 @@ type Stream interface {
 	ReadMsg(i interface{}) error
 	SetWriteDeadline(deadline time.Time) error
 	WriteMsg(i interface{}) error
+	CloseSend() error
 	Close() error
 }
 
@@ -73,6 +74,10 @@ func (m *MockStream) WriteMsg(i interface{}) error {
 	return nil
 }
 
+func (m *MockStream) CloseSend() error {
+	return nil
+}
+
 func (m *MockStream) Close() error {
 	return nil
 }
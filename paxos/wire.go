@@ -17,6 +17,8 @@ package paxos
 
 import (
 	"context"
+
+	"go.pitz.tech/lib/yarpc"
 )
 
 // Bytes contains a value to be accepted via paxos.
@@ -44,29 +46,8 @@ type Promise struct {
 	Accepted *Proposal `json:"accepted,omitempty"`
 }
 
-type ObserveServerStream struct {
-	Stream
-}
-
-func (s *ObserveServerStream) Recv() (*Request, error) {
-	msg := &Request{}
-
-	return msg, s.ReadMsg(msg)
-}
-
-func (s *ObserveServerStream) Send(msg *Proposal) error {
-	return s.WriteMsg(msg)
-}
-
-type ObserveClientStream struct {
-	Stream
-}
-
-func (s *ObserveClientStream) Recv() (*Proposal, error) {
-	msg := &Proposal{}
-
-	return msg, s.ReadMsg(msg)
-}
+//go:generate go run go.pitz.tech/lib/yarpc/cmd/yarpc-gen --type AcceptorServer --service paxos.acceptor
+//go:generate go run go.pitz.tech/lib/yarpc/cmd/yarpc-gen --type ObserverServer --service paxos.Observer
 
 type AcceptorServer interface {
 	Prepare(ctx context.Context, request *Request) (*Promise, error)
@@ -87,9 +68,9 @@ type ProposerClient interface {
 }
 
 type ObserverServer interface {
-	Observe(call *ObserveServerStream) error
+	Observe(call *yarpc.ServerStream[*Request, *Proposal]) error
 }
 
 type ObserverClient interface {
-	Observe(ctx context.Context, request *Request) (*ObserveClientStream, error)
+	Observe(ctx context.Context, request *Request) (*yarpc.ClientStream[*Request, *Proposal], error)
 }
@@ -23,85 +23,19 @@ import (
 
 // RegisterYarpcAcceptorServer registers the provided AcceptorServer implementation with the yarpc.Server to handle
 // requests.
+//
+// Deprecated: use RegisterAcceptorServer.
 func RegisterYarpcAcceptorServer(svr *yarpc.ServeMux, impl AcceptorServer) {
-	svr.Handle("/paxos.acceptor/Prepare", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
-		req := &Request{}
-		err := stream.ReadMsg(req)
-		if err != nil {
-			return err
-		}
-
-		promise, err := impl.Prepare(stream.Context(), req)
-		if err != nil {
-			return err
-		}
-
-		return stream.WriteMsg(promise)
-	}))
-
-	svr.Handle("/paxos.acceptor/Accept", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
-		req := &Proposal{}
-		err := stream.ReadMsg(req)
-		if err != nil {
-			return err
-		}
-
-		proposal, err := impl.Accept(stream.Context(), req)
-		if err != nil {
-			return err
-		}
-
-		return stream.WriteMsg(proposal)
-	}))
+	RegisterAcceptorServer(svr, impl)
 }
 
 // NewYarpcAcceptorClient wraps the provided yarpc.ClientConn with an AcceptorClient implementation.
+//
+// Deprecated: use NewAcceptorClient.
 func NewYarpcAcceptorClient(cc *yarpc.ClientConn) AcceptorClient {
-	return &yarpcAcceptorClient{
-		cc: cc,
-	}
-}
-
-type yarpcAcceptorClient struct {
-	cc *yarpc.ClientConn
-}
-
-func (c *yarpcAcceptorClient) Prepare(ctx context.Context, request *Request) (*Promise, error) {
-	stream, err := c.cc.OpenStream(ctx, "/paxos.acceptor/Prepare")
-	if err != nil {
-		return nil, err
-	}
-	defer stream.Close()
-
-	err = stream.WriteMsg(request)
-	if err != nil {
-		return nil, err
-	}
-
-	promise := &Promise{}
-
-	return promise, stream.ReadMsg(promise)
-}
-
-func (c *yarpcAcceptorClient) Accept(ctx context.Context, proposal *Proposal) (*Proposal, error) {
-	stream, err := c.cc.OpenStream(ctx, "/paxos.acceptor/Accept")
-	if err != nil {
-		return nil, err
-	}
-	defer stream.Close()
-
-	err = stream.WriteMsg(proposal)
-	if err != nil {
-		return nil, err
-	}
-
-	proposal = &Proposal{}
-
-	return proposal, stream.ReadMsg(proposal)
+	return NewAcceptorClient(cc)
 }
 
-var _ AcceptorClient = &yarpcAcceptorClient{}
-
 // RegisterYarpcProposerServer registers the provided ProposerServer implementation with the yarpc.Server to handle
 // requests. Typically, proposers aren't embedded as a server and are instead run as client side code.
 func RegisterYarpcProposerServer(svr *yarpc.ServeMux, impl ProposerServer) {
@@ -162,37 +96,15 @@ var _ ProposerClient = &yarpcProposerClient{}
 // RegisterYarpcObserverServer registers the provided ObserverServer implementation with the yarpc.Server to handle
 // requests. Acceptors should implement the observer server, otherwise other members of the cluster cannot determine
 // what records have been accepted.
+//
+// Deprecated: use RegisterObserverServer.
 func RegisterYarpcObserverServer(svr *yarpc.ServeMux, impl ObserverServer) {
-	svr.Handle("/paxos.Observer/Observe", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
-		return impl.Observe(&ObserveServerStream{stream})
-	}))
+	RegisterObserverServer(svr, impl)
 }
 
 // NewYarpcObserverClient wraps the provided yarpc.ClientConn with an ObserverClient implementation.
+//
+// Deprecated: use NewObserverClient.
 func NewYarpcObserverClient(cc *yarpc.ClientConn) ObserverClient {
-	return &yarpcObserverClient{
-		cc: cc,
-	}
-}
-
-type yarpcObserverClient struct {
-	cc *yarpc.ClientConn
-}
-
-func (c *yarpcObserverClient) Observe(ctx context.Context, request *Request) (*ObserveClientStream, error) {
-	stream, err := c.cc.OpenStream(ctx, "/paxos.Observer/Observe")
-	if err != nil {
-		return nil, err
-	}
-
-	err = stream.WriteMsg(request)
-	if err != nil {
-		return nil, err
-	}
-
-	return &ObserveClientStream{
-		Stream: stream,
-	}, nil
+	return NewObserverClient(cc)
 }
-
-var _ ObserverClient = &yarpcObserverClient{}
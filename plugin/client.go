@@ -31,9 +31,14 @@ import (
 	"go.pitz.tech/lib/yarpc"
 )
 
-// DialContext returns a ClientConn whose dialer forks a process for the specified binary.
+// ErrPluginExited is returned when the forked plugin process exits. The plugin is started again the next time the
+// connection is dialed.
+var ErrPluginExited = errors.New("plugin exited")
+
+// DialContext returns a ClientConn whose dialer forks a process for the specified binary. Streams fail as unavailable
+// when the plugin cannot be started, rather than waiting for it.
 func DialContext(ctx context.Context, binary string, args ...string) *yarpc.ClientConn {
-	clientConn := yarpc.NewClientConn(ctx)
+	clientConn := yarpc.NewClientConn(ctx).WithOptions(yarpc.WithFailFast())
 	clientConn.Dialer = &dialer{
 		Binary: binary,
 		Args:   args,
@@ -64,6 +69,7 @@ func (d *dialer) DialContext(ctx context.Context) (io.ReadWriteCloser, error) {
 		stdin:  stdin,
 		stdout: stdout,
 		cmd:    cmd,
+		exited: make(chan struct{}),
 		err:    make(chan error, 1),
 	}
 
@@ -73,6 +79,7 @@ func (d *dialer) DialContext(ctx context.Context) (io.ReadWriteCloser, error) {
 
 	go func() {
 		_ = cmd.Wait()
+		close(rwc.exited)
 	}()
 
 	go func() {
@@ -86,7 +93,7 @@ func (d *dialer) DialContext(ctx context.Context) (io.ReadWriteCloser, error) {
 				err = ctx.Err()
 			case <-ticker.C:
 				if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
-					err = errors.New("plugin exited")
+					err = ErrPluginExited
 				}
 				ticker.Reset(time.Second)
 			}
@@ -116,7 +123,9 @@ type clientRWC struct {
 	stdout io.ReadCloser
 
 	cmd *exec.Cmd
-	err chan error
+	// exited is closed once the process has exited, as the process can only be waited on once
+	exited chan struct{}
+	err    chan error
 }
 
 func (c *clientRWC) readError() error {
@@ -155,8 +164,8 @@ func (c *clientRWC) Write(p []byte) (n int, err error) {
 func (c *clientRWC) Close() (err error) {
 	_ = c.stdin.Close()
 
-	if c.cmd != nil {
-		_ = c.cmd.Wait()
+	if c.exited != nil {
+		<-c.exited
 	}
 
 	_ = c.stdout.Close()
@@ -17,7 +17,6 @@ package plugin_test
 
 import (
 	"context"
-	"io"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -26,6 +25,7 @@ import (
 	"go.pitz.tech/lib/lifecycle"
 	"go.pitz.tech/lib/logger"
 	"go.pitz.tech/lib/plugin"
+	"go.pitz.tech/lib/yarpc"
 )
 
 //go:generate go install ./examples/myago-plugin-echo
@@ -74,22 +74,8 @@ func TestFailureClient(t *testing.T) {
 
 	clientConn := plugin.DialContext(ctx, "myago-plugin-failure")
 
-	// this is a bit of a schrödinger's cat situation so we conditionally check the error at each step
-	// I suspect the write path is less-likely to be blocked by the error since yamux uses an async approach
-
-	stream, err := clientConn.OpenStream(ctx, "/echo")
-	require.NoError(t, err)
-
-	err = stream.WriteMsg(message{
-		Text: "hello world",
-	})
-	require.NoError(t, err)
-
-	msg := &message{}
-	err = stream.ReadMsg(msg)
-	require.Error(t, err)
-
-	// yamux returns an EOF when the stream is closed
-	// this doesn't seem to be something we can easily work around.
-	require.Equal(t, io.EOF, err)
+	// the plugin exits before it can accept the connection preamble, so the stream is never opened
+	_, err := clientConn.OpenStream(ctx, "/echo")
+	require.ErrorIs(t, err, &yarpc.Error{Code: yarpc.CodeUnavailable})
+	require.ErrorContains(t, err, plugin.ErrPluginExited.Error())
 }
@@ -0,0 +1,223 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package faultfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// ErrInjected is returned by writes that trigger a fault that does not provide its own error.
+var ErrInjected = errors.New("faultfs: injected fault")
+
+// Fault describes a failure injected into the writes made to matching files.
+type Fault struct {
+	// Pattern is matched against the name of the file being written using filepath.Match.
+	Pattern string
+	// After is the number of bytes written to matching files before the fault is triggered. The write that crosses
+	// this limit is cut short, leaving only the bytes up to the limit in the file.
+	After int64
+	// Err is returned by the write that triggers the fault, and by all writes and syncs to matching files that follow
+	// it. Defaults to ErrInjected.
+	Err error
+	// Zero fills the rest of the write that triggers the fault with zeros instead of leaving it out, as happens when
+	// the size of a file reaches the disk before its contents do.
+	Zero bool
+}
+
+type fault struct {
+	Fault
+
+	written   int64
+	triggered bool
+}
+
+// New wraps the provided file system with one that injects faults into writes.
+func New(fs afero.Fs) *FS {
+	return &FS{
+		Fs: fs,
+	}
+}
+
+// FS is an afero.Fs that injects faults into the writes made to the files it opens. Files opened before a fault is
+// injected are affected by it as well.
+type FS struct {
+	afero.Fs
+
+	mu     sync.Mutex
+	faults []*fault
+}
+
+// Inject adds a fault to the file system.
+func (fs *FS) Inject(f Fault) {
+	if f.Err == nil {
+		f.Err = ErrInjected
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.faults = append(fs.faults, &fault{Fault: f})
+}
+
+// Reset removes all faults from the file system, allowing writes to go through again.
+func (fs *FS) Reset() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.faults = nil
+}
+
+// allow returns how many of the size bytes being written to the named file should reach the underlying file, whether
+// the bytes that don't should be replaced with zeros, and the error to return once they have been written.
+func (fs *FS) allow(name string, size int) (int, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	allowed := size
+	zero := false
+
+	var err error
+
+	for _, f := range fs.faults {
+		if ok, _ := filepath.Match(f.Pattern, name); !ok {
+			continue
+		}
+
+		if f.triggered {
+			return 0, false, f.Err
+		}
+
+		if remaining := f.After - f.written; int64(allowed) > remaining {
+			allowed = int(remaining)
+			zero = f.Zero
+			err = f.Err
+		}
+	}
+
+	for _, f := range fs.faults {
+		if ok, _ := filepath.Match(f.Pattern, name); ok {
+			f.written += int64(allowed)
+			f.triggered = f.triggered || (err != nil && f.written >= f.After)
+		}
+	}
+
+	return allowed, zero, err
+}
+
+// cut returns the bytes of p to write to the named file, the number of them that were meant to be written, and the
+// error to return once they have been.
+func (fs *FS) cut(name string, p []byte) ([]byte, int, error) {
+	allowed, zero, err := fs.allow(name, len(p))
+	if !zero {
+		return p[:allowed], allowed, err
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p[:allowed])
+
+	return data, allowed, err
+}
+
+// failed returns the error of any fault triggered for the named file.
+func (fs *FS) failed(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, f := range fs.faults {
+		if ok, _ := filepath.Match(f.Pattern, name); ok && f.triggered {
+			return f.Err
+		}
+	}
+
+	return nil
+}
+
+func (fs *FS) Create(name string) (afero.File, error) {
+	file, err := fs.Fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{File: file, fs: fs}, nil
+}
+
+func (fs *FS) Open(name string) (afero.File, error) {
+	file, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{File: file, fs: fs}, nil
+}
+
+func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{File: file, fs: fs}, nil
+}
+
+var _ afero.Fs = &FS{}
+
+// File is an afero.File whose writes are subject to the faults injected into the file system that opened it.
+type File struct {
+	afero.File
+
+	fs *FS
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	data, allowed, err := f.fs.cut(f.Name(), p)
+
+	n, writeErr := f.File.Write(data)
+	if writeErr != nil {
+		return n, writeErr
+	}
+
+	return allowed, err
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	data, allowed, err := f.fs.cut(f.Name(), p)
+
+	n, writeErr := f.File.WriteAt(data, off)
+	if writeErr != nil {
+		return n, writeErr
+	}
+
+	return allowed, err
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *File) Sync() error {
+	if err := f.fs.failed(f.Name()); err != nil {
+		return err
+	}
+
+	return f.File.Sync()
+}
+
+var _ afero.File = &File{}
@@ -0,0 +1,91 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package faultfs_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/vfs/faultfs"
+)
+
+func TestFS(t *testing.T) {
+	t.Parallel()
+
+	afs := afero.NewMemMapFs()
+	fs := faultfs.New(afs)
+
+	failed := errors.New("disk on fire")
+	fs.Inject(faultfs.Fault{Pattern: "*.log", After: 8, Err: failed})
+
+	file, err := fs.Create("test.log")
+	require.NoError(t, err)
+
+	n, err := file.Write([]byte("hello "))
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+
+	// the write crossing the limit is cut short
+	n, err = file.Write([]byte("world"))
+	require.ErrorIs(t, err, failed)
+	require.Equal(t, 2, n)
+
+	// and everything after it fails
+	n, err = file.Write([]byte("!"))
+	require.ErrorIs(t, err, failed)
+	require.Equal(t, 0, n)
+	require.ErrorIs(t, file.Sync(), failed)
+	require.NoError(t, file.Close())
+
+	data, err := afero.ReadFile(afs, "test.log")
+	require.NoError(t, err)
+	require.Equal(t, "hello wo", string(data))
+
+	// files not matching the fault are left alone
+	require.NoError(t, afero.WriteFile(fs, "test.txt", []byte("hello world"), 0644))
+
+	// resetting the file system lets writes through again
+	fs.Reset()
+	require.NoError(t, afero.WriteFile(fs, "test.log", []byte("hello world"), 0644))
+
+	data, err = afero.ReadFile(afs, "test.log")
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+}
+
+func TestFSZero(t *testing.T) {
+	t.Parallel()
+
+	afs := afero.NewMemMapFs()
+	fs := faultfs.New(afs)
+	fs.Inject(faultfs.Fault{Pattern: "*.log", After: 8, Zero: true})
+
+	file, err := fs.Create("test.log")
+	require.NoError(t, err)
+
+	// the write crossing the limit is filled in with zeros
+	n, err := file.Write([]byte("hello world"))
+	require.ErrorIs(t, err, faultfs.ErrInjected)
+	require.Equal(t, 8, n)
+	require.NoError(t, file.Close())
+
+	data, err := afero.ReadFile(afs, "test.log")
+	require.NoError(t, err)
+	require.Equal(t, "hello wo\x00\x00\x00", string(data))
+}
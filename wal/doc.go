@@ -19,6 +19,16 @@
 //	[length - varint][record content][checksum]
 //
 // Unlike the reference implementation, the record length is written as a varint to help conserve space. The checksum is
-// a simple CRC32 checksum. Reference:
+// a CRC32 checksum of both the length and the record content. Reference:
 // https://github.com/indeedeng/lsmtree/blob/master/recordlog/src/main/java/com/indeed/lsmtree/recordlog/BasicRecordFile.java
+//
+// The log is stored in a directory as a sequence of segment files, named using a zero-padded index so they sort in the
+// order they were written (00000000000000000000.wal, 00000000000000000001.wal, ...). Once the active segment grows
+// past the configured size, the writer moves on to a new one. Records are identified by a Position, made up of the
+// index of their segment and their offset within it. Segments older than a given position can be removed using
+// TruncateBefore to reclaim space once a snapshot covers them.
+//
+// On startup, the log should be opened using Open, which scans it for damage left behind by a crash. A record that was
+// only partially written to the end of the log is discarded, while corruption anywhere else is reported as
+// ErrCorrupted.
 package wal
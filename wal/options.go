@@ -0,0 +1,71 @@
+// Copyright (C) 2022 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package wal
+
+import (
+	"time"
+)
+
+// DefaultSegmentSize is the size, in bytes, segments are allowed to grow to before the log moves on to a new one.
+const DefaultSegmentSize = 64 << 20
+
+// DefaultMaxBatchSize is the number of records a group commit waits for before syncing them to disk.
+const DefaultMaxBatchSize = 128
+
+// DefaultMaxBatchLatency is how long a group commit waits for a batch to fill up before syncing it to disk anyway.
+const DefaultMaxBatchLatency = time.Millisecond
+
+// Option configures how the log is written.
+type Option func(opt *options)
+
+type options struct {
+	segmentSize int64
+
+	groupCommit     bool
+	maxBatchSize    int
+	maxBatchLatency time.Duration
+}
+
+// WithSegmentSize sets the size, in bytes, segments are allowed to grow to before the log moves on to a new one.
+// Records are never split across segments, so a segment containing a single record may exceed this size. Defaults to
+// DefaultSegmentSize.
+func WithSegmentSize(size int64) Option {
+	return func(opt *options) {
+		if size > 0 {
+			opt.segmentSize = size
+		}
+	}
+}
+
+// WithGroupCommit enables group commit. Instead of returning once a record is buffered, Write blocks until a background
+// fsync has made it durable. Concurrent writers share a single fsync, which is issued once maxBatchSize records are
+// waiting or maxBatchLatency has passed since the first of them was written, whichever comes first. Non-positive values
+// fall back to DefaultMaxBatchSize and DefaultMaxBatchLatency.
+func WithGroupCommit(maxBatchSize int, maxBatchLatency time.Duration) Option {
+	return func(opt *options) {
+		opt.groupCommit = true
+		opt.maxBatchSize = DefaultMaxBatchSize
+		opt.maxBatchLatency = DefaultMaxBatchLatency
+
+		if maxBatchSize > 0 {
+			opt.maxBatchSize = maxBatchSize
+		}
+
+		if maxBatchLatency > 0 {
+			opt.maxBatchLatency = maxBatchLatency
+		}
+	}
+}
@@ -17,88 +17,175 @@ package wal
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
+	"os"
 
 	"github.com/spf13/afero"
 
 	"go.pitz.tech/lib/vfs"
 )
 
-// OpenReader opens a new read-only handle to the target file.
-func OpenReader(ctx context.Context, filepath string) (*Reader, error) {
+// OpenReader opens a new read-only handle to the log stored in the target directory, starting from the oldest record
+// that has not been truncated.
+func OpenReader(ctx context.Context, dir string) (*Reader, error) {
 	afs := vfs.Extract(ctx)
 
-	handle, err := afs.Open(filepath)
+	indexes, err := segments(afs, dir)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Reader{handle, bufio.NewReader(handle), 0}, nil
+	r := &Reader{
+		fs:  afs,
+		dir: dir,
+	}
+
+	if len(indexes) > 0 {
+		r.position.Segment = indexes[0]
+	}
+
+	return r, nil
 }
 
-// Reader implements the logic for reading information from the write-ahead log. The underlying file is wrapped with a
-// buffered reader to help improve performance.
+// Reader implements the logic for reading information from the write-ahead log. Once the end of a segment is reached,
+// the reader moves on to the next one. The underlying file is wrapped with a buffered reader to help improve
+// performance.
 type Reader struct {
+	fs       afero.Fs
+	dir      string
 	handle   afero.File
 	buffer   *bufio.Reader
-	position uint64
+	position Position
 }
 
-// Position returns the current position of the reader.
-func (r *Reader) Position() uint64 {
+// Position returns the position of the next record to be read.
+func (r *Reader) Position() Position {
 	return r.position
 }
 
-func (r *Reader) Read(p []byte) (n int, err error) {
-	data, err := r.buffer.Peek(10)
-	if err != nil {
-		return 0, err
+// Read reads the next record into p. io.EOF is returned once every record written so far has been read. As more
+// records are written, subsequent calls continue where the last one left off.
+func (r *Reader) Read(p []byte) (int, error) {
+	for {
+		record, err := r.next()
+
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			next, exists, statErr := r.nextSegment()
+			if statErr != nil {
+				return 0, statErr
+			}
+
+			switch {
+			case !exists && errors.Is(err, io.ErrUnexpectedEOF):
+				// the record is still being written, so pick it up again on the next read
+				if err = r.SeekTo(r.position); err != nil {
+					return 0, err
+				}
+
+				return 0, io.EOF
+			case !exists:
+				return 0, io.EOF
+			case errors.Is(err, io.ErrUnexpectedEOF):
+				return 0, fmt.Errorf("%w: incomplete record at %s", ErrCorrupted, r.position)
+			}
+
+			if err = r.SeekTo(Position{Segment: next}); err != nil {
+				return 0, err
+			}
+
+			continue
+		case err != nil:
+			return 0, err
+		}
+
+		return copy(p, record), nil
 	}
+}
 
-	buffer := bytes.NewReader(data)
-	length, err := binary.ReadUvarint(buffer)
-	if err != nil {
-		return 0, err
+// next reads the next record from the current segment. io.EOF is returned at the end of the segment, and
+// io.ErrUnexpectedEOF when the segment ends partway through a record.
+func (r *Reader) next() ([]byte, error) {
+	if r.handle == nil {
+		err := r.SeekTo(r.position)
+		if errors.Is(err, os.ErrNotExist) {
+			// nothing has been written to the log yet
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
 	}
 
-	n = len(data) - buffer.Len()
-	data = make([]byte, uint64(n)+length+4)
+	record, size, err := readRecord(r.buffer)
 
-	_, err = r.buffer.Read(data)
-	if err != nil {
-		return 0, err
+	switch {
+	case errors.Is(err, ErrCorrupted):
+		return nil, fmt.Errorf("%w at %s", ErrCorrupted, r.position)
+	case err != nil:
+		return nil, err
 	}
-	r.position += uint64(n) + length + 4
 
-	record := data[n : uint64(n)+length]
-	checksum := binary.BigEndian.Uint32(data[uint64(n)+length:])
+	r.position.Offset += uint64(size)
 
-	if crc32.ChecksumIEEE(record) != checksum {
-		return 0, fmt.Errorf("corrupted block")
+	return record, nil
+}
+
+// nextSegment returns the index of the segment following the current one, and whether it has been written yet.
+func (r *Reader) nextSegment() (uint64, bool, error) {
+	next := r.position.Segment + 1
+
+	_, err := r.fs.Stat(segmentPath(r.dir, next))
+	if errors.Is(err, os.ErrNotExist) {
+		return next, false, nil
+	} else if err != nil {
+		return next, false, err
 	}
 
-	return copy(p, record), nil
+	return next, true, nil
 }
 
-func (r *Reader) Seek(offset int64, whence int) (int64, error) {
-	pos, err := r.handle.Seek(offset, whence)
-	if err != nil {
-		return pos, err
+// SeekTo moves the reader to the provided position, which should be the position of a record previously returned by
+// Position. ErrTruncated is returned when the segment has been removed from the log.
+func (r *Reader) SeekTo(position Position) error {
+	if r.handle == nil || r.position.Segment != position.Segment {
+		handle, err := r.fs.Open(segmentPath(r.dir, position.Segment))
+		if errors.Is(err, os.ErrNotExist) {
+			if indexes, _ := segments(r.fs, r.dir); len(indexes) > 0 && indexes[0] > position.Segment {
+				return ErrTruncated
+			}
+
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if r.handle != nil {
+			_ = r.handle.Close()
+		}
+
+		r.handle = handle
+		r.buffer = bufio.NewReader(handle)
+	}
+
+	if _, err := r.handle.Seek(int64(position.Offset), io.SeekStart); err != nil {
+		return err
 	}
 
 	r.buffer.Reset(r.handle)
-	r.position = uint64(pos)
+	r.position = position
 
-	return pos, nil
+	return nil
 }
 
 func (r *Reader) Close() error {
+	if r.handle == nil {
+		return nil
+	}
+
 	return r.handle.Close()
 }
 
-var _ io.ReadSeekCloser = &Reader{}
+var _ io.ReadCloser = &Reader{}
@@ -0,0 +1,93 @@
+// Copyright (C) 2022 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// ErrCorrupted is returned when a record in the log fails its checksum or cannot be decoded.
+var ErrCorrupted = errors.New("wal: corrupted record")
+
+// encodeRecord encodes the record using the on-disk format of the log. The checksum covers the length as well as the
+// content, otherwise a run of zeros would decode as empty records with valid checksums.
+func encodeRecord(p []byte) []byte {
+	length := len(p)
+
+	buffer := make([]byte, binary.MaxVarintLen64+length+4)
+	n := binary.PutUvarint(buffer, uint64(length))
+	copy(buffer[n:], p)
+
+	checksum := crc32.ChecksumIEEE(buffer[:n+length])
+	binary.BigEndian.PutUint32(buffer[n+length:], checksum)
+
+	return buffer[:n+length+4]
+}
+
+// readRecord reads the next record from the buffer, along with the number of bytes it takes up in the log. io.EOF is
+// returned when there are no more records, and io.ErrUnexpectedEOF when the log ends partway through a record.
+// ErrCorrupted is returned when the record fails its checksum, in which case its size is still reported, or when its
+// length cannot be decoded.
+func readRecord(buffer *bufio.Reader) ([]byte, int64, error) {
+	header, err := buffer.Peek(binary.MaxVarintLen64)
+	if len(header) == 0 {
+		return nil, 0, err
+	}
+
+	length, n := binary.Uvarint(header)
+
+	switch {
+	case n == 0 && errors.Is(err, io.EOF):
+		return nil, 0, io.ErrUnexpectedEOF
+	case n == 0:
+		return nil, 0, err
+	case n < 0, length > math.MaxInt64-binary.MaxVarintLen64-4:
+		return nil, 0, ErrCorrupted
+	}
+
+	// the header is only valid until the buffer is read from again
+	checksum := crc32.ChecksumIEEE(header[:n])
+
+	_, _ = buffer.Discard(n)
+
+	// read the record incrementally rather than trusting the length up front, since a torn write can leave behind an
+	// arbitrarily large one
+	data := bytes.NewBuffer(nil)
+
+	if _, err = io.CopyN(data, buffer, int64(length)+4); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, 0, err
+	}
+
+	size := int64(n) + int64(length) + 4
+	record := data.Bytes()[:length]
+	checksum = crc32.Update(checksum, crc32.IEEETable, record)
+
+	if binary.BigEndian.Uint32(data.Bytes()[length:]) != checksum {
+		return nil, size, ErrCorrupted
+	}
+
+	return record, size, nil
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2022 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package wal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+	"go.uber.org/zap"
+
+	"go.pitz.tech/lib/logger"
+	"go.pitz.tech/lib/vfs"
+)
+
+// Recovery reports what Open found when scanning the log, and any repairs it made.
+type Recovery struct {
+	// Segments is the number of segments that were scanned.
+	Segments int `json:"segments"`
+	// Records is the number of intact records found in the log.
+	Records uint64 `json:"records"`
+	// End is the position following the last intact record. When the log is corrupted, this is the position of the
+	// corrupted record.
+	End Position `json:"end"`
+	// Truncated is the number of bytes removed from the end of the log to discard a torn record. It's zero when the
+	// log ended cleanly.
+	Truncated int64 `json:"truncated"`
+}
+
+// Open scans the log stored in the target directory before opening it for writing. A record left partially written
+// at the end of the log, as happens when the process crashes during a write, is torn and safe to discard, so the log
+// is truncated to the last intact record. Any other damage is corruption of records that were previously written and
+// cannot be repaired automatically, so ErrCorrupted is returned along with the position of the corrupted record. This
+// should be preferred over OpenWriter when starting up.
+func Open(ctx context.Context, dir string, opts ...Option) (*Writer, *Recovery, error) {
+	afs := vfs.Extract(ctx)
+
+	recovery, err := recoverLog(afs, dir)
+	if err != nil {
+		return nil, recovery, err
+	}
+
+	if recovery.Truncated > 0 {
+		logger.Extract(ctx).Warn("truncated torn record from the end of the write-ahead log",
+			zap.String("dir", dir),
+			zap.Stringer("position", recovery.End),
+			zap.Int64("bytes", recovery.Truncated),
+		)
+	}
+
+	writer, err := OpenWriter(ctx, dir, opts...)
+	if err != nil {
+		return nil, recovery, err
+	}
+
+	return writer, recovery, nil
+}
+
+// recoverLog scans the segments of the log, repairing a torn record at the end of it.
+func recoverLog(afs afero.Fs, dir string) (*Recovery, error) {
+	recovery := &Recovery{}
+
+	indexes, err := segments(afs, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return recovery, nil
+	} else if err != nil {
+		return recovery, err
+	}
+
+	for i, index := range indexes {
+		recovery.Segments++
+		recovery.End = Position{Segment: index}
+
+		size, torn, err := scanSegment(afs, segmentPath(dir, index), recovery)
+
+		switch {
+		case err != nil:
+			return recovery, err
+		case !torn:
+			continue
+		case i < len(indexes)-1:
+			// segments are synced before the writer moves on from them, so only the last one can be torn
+			return recovery, fmt.Errorf("%w: incomplete record at %s", ErrCorrupted, recovery.End)
+		}
+
+		if err = truncateSegment(afs, segmentPath(dir, index), int64(recovery.End.Offset)); err != nil {
+			return recovery, err
+		}
+
+		if err = syncDir(afs, dir); err != nil {
+			return recovery, err
+		}
+
+		recovery.Truncated = size - int64(recovery.End.Offset)
+	}
+
+	return recovery, nil
+}
+
+// scanSegment reads through the records in the segment, advancing the recovery as it goes. It reports the size of the
+// segment, and whether it ends with a torn record.
+func scanSegment(afs afero.Fs, path string, recovery *Recovery) (int64, bool, error) {
+	handle, err := afs.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer handle.Close()
+
+	info, err := handle.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	size := info.Size()
+	buffer := bufio.NewReader(handle)
+
+	for {
+		_, n, err := readRecord(buffer)
+
+		switch {
+		case errors.Is(err, io.EOF):
+			return size, false, nil
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return size, true, nil
+		case errors.Is(err, ErrCorrupted) && n > 0 && int64(recovery.End.Offset)+n == size:
+			// the final record was written out in full, but not all of it reached the disk
+			return size, true, nil
+		case errors.Is(err, ErrCorrupted):
+			// the size of the segment reached the disk, but the records written to the end of it did not
+			if zeros, zerr := zeroed(handle, int64(recovery.End.Offset), size); zerr != nil || zeros {
+				return size, zeros, zerr
+			}
+
+			return size, false, fmt.Errorf("%w at %s", ErrCorrupted, recovery.End)
+		case err != nil:
+			return size, false, err
+		}
+
+		recovery.Records++
+		recovery.End.Offset += uint64(n)
+	}
+}
+
+// zeroed reports whether the segment contains nothing but zeros from the offset to the end of it.
+func zeroed(handle afero.File, offset, size int64) (bool, error) {
+	buffer := bufio.NewReader(io.NewSectionReader(handle, offset, size-offset))
+
+	for {
+		b, err := buffer.ReadByte()
+
+		switch {
+		case errors.Is(err, io.EOF):
+			return true, nil
+		case err != nil:
+			return false, err
+		case b != 0:
+			return false, nil
+		}
+	}
+}
+
+// truncateSegment truncates the segment to the provided size, syncing the change to disk.
+func truncateSegment(afs afero.Fs, path string, size int64) error {
+	//nolint:nosnakecase
+	handle, err := afs.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = handle.Truncate(size); err != nil {
+		_ = handle.Close()
+
+		return err
+	}
+
+	if err = handle.Sync(); err != nil {
+		_ = handle.Close()
+
+		return err
+	}
+
+	return handle.Close()
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2022 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// segmentExt is the extension given to the segment files of the log.
+const segmentExt = ".wal"
+
+// ErrTruncated is returned when seeking to a position in a segment that has been removed from the log.
+var ErrTruncated = errors.New("wal: position has been truncated")
+
+// Position identifies a record in the log using the index of the segment it's stored in and its offset within that
+// segment.
+type Position struct {
+	Segment uint64 `json:"segment"`
+	Offset  uint64 `json:"offset"`
+}
+
+// Before reports whether the position comes before the other position in the log.
+func (p Position) Before(other Position) bool {
+	return p.Segment < other.Segment || (p.Segment == other.Segment && p.Offset < other.Offset)
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Segment, p.Offset)
+}
+
+// segmentPath returns the path of the segment file with the provided index. Indexes are zero-padded so the segments
+// sort in the order they were written.
+func segmentPath(dir string, index uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", index, segmentExt))
+}
+
+// segments returns the indexes of the segment files found in dir, in the order they were written.
+func segments(afs afero.Fs, dir string) ([]uint64, error) {
+	infos, err := afero.ReadDir(afs, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make([]uint64, 0, len(infos))
+
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		index, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+
+	return indexes, nil
+}
+
+// syncDir fsyncs the directory, making the segments created or removed in it durable. Syncing a file only covers its
+// contents, not the entry linking it into the directory.
+func syncDir(afs afero.Fs, dir string) error {
+	handle, err := afs.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	if err = handle.Sync(); err != nil {
+		_ = handle.Close()
+
+		return err
+	}
+
+	return handle.Close()
+}
@@ -17,11 +17,21 @@ package wal_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/vfs"
+	"go.pitz.tech/lib/vfs/faultfs"
 	"go.pitz.tech/lib/wal"
 )
 
@@ -39,7 +49,7 @@ func TestWAL(t *testing.T) {
 	require.NoError(t, err)
 	defer reader.Close()
 
-	require.Equal(t, uint64(0), reader.Position())
+	require.Equal(t, wal.Position{}, reader.Position())
 
 	_, err = writer.Write([]byte("hello world"))
 	require.NoError(t, err)
@@ -54,10 +64,657 @@ func TestWAL(t *testing.T) {
 
 		require.Equal(t, "hello world", string(read[:n]))
 
-		require.Equal(t, uint64(0x10), reader.Position())
+		require.Equal(t, wal.Position{Offset: 0x10}, reader.Position())
+
+		err = reader.SeekTo(wal.Position{})
+		require.NoError(t, err)
+		require.Equal(t, wal.Position{}, reader.Position())
+	}
+}
+
+// readAll reads the records remaining in the log.
+func readAll(t *testing.T, reader *wal.Reader) []string {
+	t.Helper()
+
+	var records []string
+
+	read := make([]byte, 100)
+
+	for {
+		n, err := reader.Read(read)
+		if err == io.EOF {
+			return records
+		}
+
+		require.NoError(t, err)
+		records = append(records, string(read[:n]))
+	}
+}
+
+func TestSegments(t *testing.T) {
+	t.Parallel()
+
+	afs := afero.NewMemMapFs()
+	ctx := vfs.ToContext(context.Background(), afs)
+
+	// each record takes up 10 bytes, so segments hold 3 records
+	writer, err := wal.OpenWriter(ctx, "log", wal.WithSegmentSize(30))
+	require.NoError(t, err)
+
+	reader, err := wal.OpenReader(ctx, "log")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	var expected []string
+
+	for i := 0; i < 7; i++ {
+		record := fmt.Sprintf("rec%02d", i)
+		expected = append(expected, record)
+
+		_, err = writer.Write([]byte(record))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Flush())
+	require.Equal(t, wal.Position{Segment: 2, Offset: 10}, writer.Position())
+
+	names, err := afero.Glob(afs, filepath.Join("log", "*.wal"))
+	require.NoError(t, err)
+	require.Len(t, names, 3)
+
+	// the reader moves across segments, and picks up records as they are written
+	require.Equal(t, expected, readAll(t, reader))
+	require.Equal(t, wal.Position{Segment: 2, Offset: 10}, reader.Position())
+
+	_, err = writer.Write([]byte("rec07"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	require.Equal(t, []string{"rec07"}, readAll(t, reader))
+
+	// reopening the log continues appending to the last segment
+	writer, err = wal.OpenWriter(ctx, "log", wal.WithSegmentSize(30))
+	require.NoError(t, err)
+	defer writer.Close()
+
+	require.Equal(t, wal.Position{Segment: 2, Offset: 20}, writer.Position())
+
+	_, err = writer.Write([]byte("rec08"))
+	require.NoError(t, err)
+
+	_, err = writer.Write([]byte("rec09"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Flush())
+
+	require.Equal(t, []string{"rec08", "rec09"}, readAll(t, reader))
+	require.Equal(t, wal.Position{Segment: 3, Offset: 10}, reader.Position())
+}
+
+func TestTruncateBefore(t *testing.T) {
+	t.Parallel()
+
+	afs := afero.NewMemMapFs()
+	ctx := vfs.ToContext(context.Background(), afs)
+
+	writer, err := wal.OpenWriter(ctx, "log", wal.WithSegmentSize(30))
+	require.NoError(t, err)
+	defer writer.Close()
+
+	for i := 0; i < 9; i++ {
+		_, err = writer.Write([]byte(fmt.Sprintf("rec%02d", i)))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, writer.Flush())
+
+	// segments are removed whole, keeping the earlier records in the segment containing the position
+	require.NoError(t, writer.TruncateBefore(wal.Position{Segment: 1, Offset: 20}))
+
+	reader, err := wal.OpenReader(ctx, "log")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	require.Equal(t, []string{"rec03", "rec04", "rec05", "rec06", "rec07", "rec08"}, readAll(t, reader))
+	require.ErrorIs(t, reader.SeekTo(wal.Position{Segment: 0}), wal.ErrTruncated)
+
+	// the active segment is never removed
+	require.NoError(t, writer.TruncateBefore(wal.Position{Segment: 10}))
+
+	reader, err = wal.OpenReader(ctx, "log")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	require.Equal(t, []string{"rec06", "rec07", "rec08"}, readAll(t, reader))
+}
+
+func TestPartialRecord(t *testing.T) {
+	t.Parallel()
+
+	afs := afero.NewMemMapFs()
+	ctx := vfs.ToContext(context.Background(), afs)
+
+	writer, err := wal.OpenWriter(ctx, "log")
+	require.NoError(t, err)
+
+	_, err = writer.Write([]byte("a"))
+	require.NoError(t, err)
+
+	_, err = writer.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	// simulate the second record being partway through a write
+	segment := filepath.Join("log", fmt.Sprintf("%020d.wal", 0))
+
+	data, err := afero.ReadFile(afs, segment)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(afs, segment, data[:len(data)-5], 0644))
+
+	reader, err := wal.OpenReader(ctx, "log")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	require.Equal(t, []string{"a"}, readAll(t, reader))
+	require.Equal(t, wal.Position{Offset: 6}, reader.Position())
+
+	// once the rest of the record is written, it can be read
+	require.NoError(t, afero.WriteFile(afs, segment, data, 0644))
+	require.Equal(t, []string{"hello world"}, readAll(t, reader))
+}
+
+// syncFs counts the number of times files and directories are synced to disk, optionally failing the syncs of files.
+type syncFs struct {
+	afero.Fs
 
-		pos, err := reader.Seek(0, io.SeekStart)
+	syncs    int32
+	dirSyncs int32
+	err      error
+	// failOn limits the failure to the sync with the provided number, counting from 1
+	failOn int32
+}
+
+func (fs *syncFs) Open(name string) (afero.File, error) {
+	file, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncFile{File: file, fs: fs}, nil
+}
+
+func (fs *syncFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncFile{File: file, fs: fs}, nil
+}
+
+type syncFile struct {
+	afero.File
+
+	fs *syncFs
+}
+
+func (f *syncFile) Sync() error {
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		atomic.AddInt32(&f.fs.dirSyncs, 1)
+
+		return f.File.Sync()
+	}
+
+	n := atomic.AddInt32(&f.fs.syncs, 1)
+
+	if f.fs.err != nil && (f.fs.failOn == 0 || f.fs.failOn == n) {
+		return f.fs.err
+	}
+
+	return f.File.Sync()
+}
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+
+	afs := &syncFs{Fs: afero.NewMemMapFs()}
+	ctx := vfs.ToContext(context.Background(), afs)
+
+	writer, err := wal.OpenWriter(ctx, "log", wal.WithSegmentSize(30))
+	require.NoError(t, err)
+	defer writer.Close()
+
+	_, err = writer.Write([]byte("rec00"))
+	require.NoError(t, err)
+	require.Equal(t, int32(0), atomic.LoadInt32(&afs.syncs))
+
+	require.NoError(t, writer.Sync())
+	require.Equal(t, int32(1), atomic.LoadInt32(&afs.syncs))
+
+	// nothing new to sync
+	require.NoError(t, writer.Sync())
+	require.Equal(t, int32(1), atomic.LoadInt32(&afs.syncs))
+
+	// segments are synced before moving on to the next one
+	for i := 1; i < 4; i++ {
+		_, err = writer.Write([]byte(fmt.Sprintf("rec%02d", i)))
 		require.NoError(t, err)
-		require.Equal(t, int64(0), pos)
 	}
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&afs.syncs))
+}
+
+func TestSyncDir(t *testing.T) {
+	t.Parallel()
+
+	afs := &syncFs{Fs: afero.NewMemMapFs()}
+	ctx := vfs.ToContext(context.Background(), afs)
+
+	writer, err := wal.OpenWriter(ctx, "log", wal.WithSegmentSize(30))
+	require.NoError(t, err)
+
+	// the directory is synced whenever a segment is created
+	require.Equal(t, int32(1), atomic.LoadInt32(&afs.dirSyncs))
+
+	for i := 0; i < 4; i++ {
+		_, err = writer.Write([]byte(fmt.Sprintf("rec%02d", i)))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&afs.dirSyncs))
+
+	// and whenever segments are removed from it
+	require.NoError(t, writer.TruncateBefore(wal.Position{Segment: 0}))
+	require.Equal(t, int32(2), atomic.LoadInt32(&afs.dirSyncs))
+
+	require.NoError(t, writer.TruncateBefore(wal.Position{Segment: 1}))
+	require.Equal(t, int32(3), atomic.LoadInt32(&afs.dirSyncs))
+
+	require.NoError(t, writer.Close())
+
+	// and once recovery has truncated a torn record
+	segment := filepath.Join("log", fmt.Sprintf("%020d.wal", 1))
+
+	data, err := afero.ReadFile(afs, segment)
+	require.NoError(t, err)
+	require.NoError(t, afero.WriteFile(afs, segment, data[:len(data)-5], 0644))
+
+	writer, recovery, err := wal.Open(ctx, "log", wal.WithSegmentSize(30))
+	require.NoError(t, err)
+	defer writer.Close()
+
+	require.Equal(t, int64(5), recovery.Truncated)
+	require.Equal(t, int32(5), atomic.LoadInt32(&afs.dirSyncs))
+}
+
+func TestGroupCommit(t *testing.T) {
+	t.Parallel()
+
+	write := func(t *testing.T, writer *wal.Writer, count int) {
+		t.Helper()
+
+		group := &sync.WaitGroup{}
+		errs := make(chan error, count)
+
+		for i := 0; i < count; i++ {
+			group.Add(1)
+
+			go func(i int) {
+				defer group.Done()
+
+				_, err := writer.Write([]byte(fmt.Sprintf("rec%02d", i)))
+				errs <- err
+			}(i)
+		}
+
+		group.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("batch size", func(t *testing.T) {
+		t.Parallel()
+
+		afs := &syncFs{Fs: afero.NewMemMapFs()}
+		ctx := vfs.ToContext(context.Background(), afs)
+
+		writer, err := wal.OpenWriter(ctx, "log", wal.WithGroupCommit(10, time.Hour))
+		require.NoError(t, err)
+		defer writer.Close()
+
+		write(t, writer, 10)
+		require.Equal(t, int32(1), atomic.LoadInt32(&afs.syncs))
+
+		reader, err := wal.OpenReader(ctx, "log")
+		require.NoError(t, err)
+		defer reader.Close()
+
+		require.Len(t, readAll(t, reader), 10)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		t.Parallel()
+
+		afs := &syncFs{Fs: afero.NewMemMapFs()}
+		ctx := vfs.ToContext(context.Background(), afs)
+
+		writer, err := wal.OpenWriter(ctx, "log", wal.WithGroupCommit(100, 10*time.Millisecond))
+		require.NoError(t, err)
+		defer writer.Close()
+
+		start := time.Now()
+		write(t, writer, 1)
+		require.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+		require.Equal(t, int32(1), atomic.LoadInt32(&afs.syncs))
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		t.Parallel()
+
+		afs := &syncFs{Fs: afero.NewMemMapFs()}
+		ctx := vfs.ToContext(context.Background(), afs)
+
+		writer, err := wal.OpenWriter(ctx, "log", wal.WithGroupCommit(8, 5*time.Millisecond))
+		require.NoError(t, err)
+		defer writer.Close()
+
+		write(t, writer, 50)
+		require.Less(t, atomic.LoadInt32(&afs.syncs), int32(50))
+
+		reader, err := wal.OpenReader(ctx, "log")
+		require.NoError(t, err)
+		defer reader.Close()
+
+		require.Len(t, readAll(t, reader), 50)
+	})
+
+	t.Run("failed sync", func(t *testing.T) {
+		t.Parallel()
+
+		failed := errors.New("disk on fire")
+
+		afs := &syncFs{Fs: afero.NewMemMapFs(), err: failed}
+		ctx := vfs.ToContext(context.Background(), afs)
+
+		writer, err := wal.OpenWriter(ctx, "log", wal.WithGroupCommit(1, time.Hour))
+		require.NoError(t, err)
+		defer writer.Close()
+
+		// once a sync fails, the writer refuses further records
+		for i := 0; i < 2; i++ {
+			_, err = writer.Write([]byte("hello world"))
+			require.ErrorIs(t, err, failed)
+		}
+
+		require.ErrorIs(t, writer.Sync(), failed)
+	})
+
+	t.Run("failed rotation", func(t *testing.T) {
+		t.Parallel()
+
+		failed := errors.New("disk on fire")
+
+		// each of the three records in the first segment is synced, then the sync before moving on fails
+		afs := &syncFs{Fs: afero.NewMemMapFs(), err: failed, failOn: 4}
+		ctx := vfs.ToContext(context.Background(), afs)
+
+		writer, err := wal.OpenWriter(ctx, "log", wal.WithSegmentSize(30), wal.WithGroupCommit(1, time.Hour))
+		require.NoError(t, err)
+		defer writer.Close()
+
+		for i := 0; i < 3; i++ {
+			_, err = writer.Write([]byte(fmt.Sprintf("rec%02d", i)))
+			require.NoError(t, err)
+		}
+
+		_, err = writer.Write([]byte("rec03"))
+		require.ErrorIs(t, err, failed)
+
+		// later syncs succeeding does not make the writer usable again
+		_, err = writer.Write([]byte("rec04"))
+		require.ErrorIs(t, err, failed)
+		require.ErrorIs(t, writer.Sync(), failed)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := vfs.ToContext(context.Background(), afero.NewMemMapFs())
+
+		writer, err := wal.OpenWriter(ctx, "log", wal.WithGroupCommit(100, time.Hour))
+		require.NoError(t, err)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := writer.Write([]byte("hello world"))
+			done <- err
+		}()
+
+		// closing the writer commits the batch it was waiting on
+		require.Eventually(t, func() bool {
+			return writer.Position().Offset > 0
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, writer.Close())
+		require.NoError(t, <-done)
+
+		_, err = writer.Write([]byte("hello world"))
+		require.ErrorIs(t, err, os.ErrClosed)
+	})
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+
+	segment := func(index int) string {
+		return filepath.Join("log", fmt.Sprintf("%020d.wal", index))
+	}
+
+	// writeRecords writes count 10 byte records to the log, segmented every 3 records.
+	writeRecords := func(t *testing.T, ctx context.Context, count int) {
+		t.Helper()
+
+		writer, err := wal.OpenWriter(ctx, "log", wal.WithSegmentSize(30))
+		require.NoError(t, err)
+
+		for i := 0; i < count; i++ {
+			_, err = writer.Write([]byte(fmt.Sprintf("rec%02d", i)))
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, writer.Close())
+	}
+
+	// corrupt flips the byte at the offset in the segment.
+	corrupt := func(t *testing.T, afs afero.Fs, name string, offset int) {
+		t.Helper()
+
+		data, err := afero.ReadFile(afs, name)
+		require.NoError(t, err)
+
+		data[offset] ^= 0xff
+		require.NoError(t, afero.WriteFile(afs, name, data, 0644))
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := vfs.ToContext(context.Background(), afero.NewMemMapFs())
+
+		writer, recovery, err := wal.Open(ctx, "log")
+		require.NoError(t, err)
+		defer writer.Close()
+
+		require.Equal(t, &wal.Recovery{}, recovery)
+	})
+
+	t.Run("clean", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := vfs.ToContext(context.Background(), afero.NewMemMapFs())
+		writeRecords(t, ctx, 5)
+
+		writer, recovery, err := wal.Open(ctx, "log", wal.WithSegmentSize(30))
+		require.NoError(t, err)
+		defer writer.Close()
+
+		require.Equal(t, &wal.Recovery{
+			Segments: 2,
+			Records:  5,
+			End:      wal.Position{Segment: 1, Offset: 20},
+		}, recovery)
+	})
+
+	t.Run("torn write", func(t *testing.T) {
+		t.Parallel()
+
+		afs := afero.NewMemMapFs()
+		ctx := vfs.ToContext(context.Background(), afs)
+
+		faulty := faultfs.New(afs)
+		faulty.Inject(faultfs.Fault{Pattern: filepath.Join("log", "*.wal"), After: 25})
+
+		writer, err := wal.OpenWriter(vfs.ToContext(ctx, faulty), "log")
+		require.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			_, err = writer.Write([]byte(fmt.Sprintf("rec%02d", i)))
+			require.NoError(t, err)
+		}
+
+		// the process crashes partway through writing the last record
+		require.ErrorIs(t, writer.Sync(), faultfs.ErrInjected)
+		_ = writer.Close()
+
+		writer, recovery, err := wal.Open(ctx, "log")
+		require.NoError(t, err)
+		defer writer.Close()
+
+		require.Equal(t, &wal.Recovery{
+			Segments:  1,
+			Records:   2,
+			End:       wal.Position{Offset: 20},
+			Truncated: 5,
+		}, recovery)
+
+		// writes pick up where the intact records left off
+		_, err = writer.Write([]byte("rec03"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Sync())
+
+		reader, err := wal.OpenReader(ctx, "log")
+		require.NoError(t, err)
+		defer reader.Close()
+
+		require.Equal(t, []string{"rec00", "rec01", "rec03"}, readAll(t, reader))
+	})
+
+	t.Run("zeroed tail", func(t *testing.T) {
+		t.Parallel()
+
+		afs := afero.NewMemMapFs()
+		ctx := vfs.ToContext(context.Background(), afs)
+
+		faulty := faultfs.New(afs)
+		faulty.Inject(faultfs.Fault{Pattern: filepath.Join("log", "*.wal"), After: 20, Zero: true})
+
+		writer, err := wal.OpenWriter(vfs.ToContext(ctx, faulty), "log")
+		require.NoError(t, err)
+
+		for i := 0; i < 3; i++ {
+			_, err = writer.Write([]byte(fmt.Sprintf("rec%02d", i)))
+			require.NoError(t, err)
+		}
+
+		// the size of the segment reaches the disk, but the last record does not
+		require.ErrorIs(t, writer.Sync(), faultfs.ErrInjected)
+		_ = writer.Close()
+
+		// the zeros are not mistaken for empty records
+		writer, recovery, err := wal.Open(ctx, "log")
+		require.NoError(t, err)
+		defer writer.Close()
+
+		require.Equal(t, &wal.Recovery{
+			Segments:  1,
+			Records:   2,
+			End:       wal.Position{Offset: 20},
+			Truncated: 10,
+		}, recovery)
+
+		reader, err := wal.OpenReader(ctx, "log")
+		require.NoError(t, err)
+		defer reader.Close()
+
+		require.Equal(t, []string{"rec00", "rec01"}, readAll(t, reader))
+	})
+
+	t.Run("torn checksum", func(t *testing.T) {
+		t.Parallel()
+
+		afs := afero.NewMemMapFs()
+		ctx := vfs.ToContext(context.Background(), afs)
+		writeRecords(t, ctx, 5)
+
+		// the last record was written out in full, but not all of it reached the disk
+		corrupt(t, afs, segment(1), 15)
+
+		writer, recovery, err := wal.Open(ctx, "log", wal.WithSegmentSize(30))
+		require.NoError(t, err)
+		defer writer.Close()
+
+		require.Equal(t, &wal.Recovery{
+			Segments:  2,
+			Records:   4,
+			End:       wal.Position{Segment: 1, Offset: 10},
+			Truncated: 10,
+		}, recovery)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		t.Parallel()
+
+		afs := afero.NewMemMapFs()
+		ctx := vfs.ToContext(context.Background(), afs)
+		writeRecords(t, ctx, 5)
+
+		corrupt(t, afs, segment(1), 5)
+
+		_, recovery, err := wal.Open(ctx, "log", wal.WithSegmentSize(30))
+		require.ErrorIs(t, err, wal.ErrCorrupted)
+		require.Equal(t, wal.Position{Segment: 1}, recovery.End)
+
+		// the log is left as it was, so readers run into the same corruption
+		reader, err := wal.OpenReader(ctx, "log")
+		require.NoError(t, err)
+		defer reader.Close()
+
+		read := make([]byte, 100)
+		for i := 0; i < 3; i++ {
+			_, err = reader.Read(read)
+			require.NoError(t, err)
+		}
+
+		_, err = reader.Read(read)
+		require.ErrorIs(t, err, wal.ErrCorrupted)
+	})
+
+	t.Run("incomplete segment", func(t *testing.T) {
+		t.Parallel()
+
+		afs := afero.NewMemMapFs()
+		ctx := vfs.ToContext(context.Background(), afs)
+		writeRecords(t, ctx, 5)
+
+		data, err := afero.ReadFile(afs, segment(0))
+		require.NoError(t, err)
+		require.NoError(t, afero.WriteFile(afs, segment(0), data[:25], 0644))
+
+		// only the last segment can be torn, since the others were synced before moving on from them
+		_, recovery, err := wal.Open(ctx, "log", wal.WithSegmentSize(30))
+		require.ErrorIs(t, err, wal.ErrCorrupted)
+		require.Equal(t, wal.Position{Offset: 20}, recovery.End)
+	})
 }
@@ -18,63 +18,358 @@ package wal
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
-	"hash/crc32"
 	"io"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/spf13/afero"
 
 	"go.pitz.tech/lib/vfs"
 )
 
-// OpenWriter opens a new append-only handle that writes data to the target file.
-func OpenWriter(ctx context.Context, filepath string) (*Writer, error) {
+// OpenWriter opens the log stored in the target directory for writing, creating it if it does not exist. Records are
+// appended to the last segment in the directory.
+func OpenWriter(ctx context.Context, dir string, opts ...Option) (*Writer, error) {
+	o := options{
+		segmentSize: DefaultSegmentSize,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	afs := vfs.Extract(ctx)
 
-	//nolint:nosnakecase
-	handle, err := afs.OpenFile(filepath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err := afs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	indexes, err := segments(afs, dir)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Writer{handle, bufio.NewWriter(handle)}, nil
+	w := &Writer{
+		fs:      afs,
+		dir:     dir,
+		options: o,
+	}
+
+	w.committed = sync.NewCond(&w.mu)
+
+	index := uint64(0)
+	if len(indexes) > 0 {
+		index = indexes[len(indexes)-1]
+	}
+
+	if err = w.openSegment(index); err != nil {
+		return nil, err
+	}
+
+	if o.groupCommit {
+		w.pending = make(chan struct{}, 1)
+		w.full = make(chan struct{}, 1)
+		w.done = make(chan struct{})
+		w.stopped = make(chan struct{})
+
+		go w.commitLoop()
+	}
+
+	return w, nil
 }
 
-// Writer implements the logic for writing information to the write-ahead log. The underlying file is wrapped with a
-// buffered writer to help improve durability of writes.
+// Writer implements the logic for writing information to the write-ahead log. Records are appended to the active
+// segment until it reaches the configured size, at which point the writer moves on to a new segment. The underlying
+// file is wrapped with a buffered writer to help improve durability of writes. Records are only durable once they have
+// been synced to disk, either by calling Sync or by enabling group commit.
 type Writer struct {
-	handle afero.File
-	buffer *bufio.Writer
+	fs      afero.Fs
+	dir     string
+	options options
+
+	mu      sync.Mutex
+	segment uint64
+	offset  uint64
+	handle  afero.File
+	buffer  *bufio.Writer
+	closed  bool
+	err     error
+
+	// written and synced count the records written to the log and the records known to be durable. When group commit
+	// is enabled, writers wait on committed until synced covers their record.
+	written   uint64
+	synced    uint64
+	batch     int
+	committed *sync.Cond
+
+	pending chan struct{}
+	full    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	stop    sync.Once
+}
+
+// openSegment opens the segment with the provided index for appending, creating it if it does not exist. The
+// directory is synced so that a created segment can't go missing after a crash, along with the records synced to it.
+func (w *Writer) openSegment(index uint64) error {
+	//nolint:nosnakecase
+	handle, err := w.fs.OpenFile(segmentPath(w.dir, index), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = syncDir(w.fs, w.dir); err != nil {
+		_ = handle.Close()
+
+		return err
+	}
+
+	info, err := handle.Stat()
+	if err != nil {
+		_ = handle.Close()
+
+		return err
+	}
+
+	w.segment = index
+	w.offset = uint64(info.Size())
+	w.handle = handle
+	w.buffer = bufio.NewWriter(handle)
+
+	return nil
+}
+
+// rotate syncs and closes the active segment and starts writing to the next one.
+func (w *Writer) rotate() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+
+	if err := w.handle.Close(); err != nil {
+		return err
+	}
+
+	return w.openSegment(w.segment + 1)
+}
+
+// Position returns the position the next record will be written at.
+func (w *Writer) Position() Position {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return Position{Segment: w.segment, Offset: w.offset}
 }
 
 func (w *Writer) Write(p []byte) (int, error) {
 	length := len(p)
-	checksum := crc32.ChecksumIEEE(p)
+	buffer := encodeRecord(p)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	buffer := make([]byte, 10+length+4)
-	n := binary.PutUvarint(buffer, uint64(length))
-	copy(buffer[n:], p)
-	binary.BigEndian.PutUint32(buffer[n+length:], checksum)
+	switch {
+	case w.closed:
+		return 0, os.ErrClosed
+	case w.err != nil:
+		return 0, w.err
+	}
+
+	if w.offset > 0 && w.offset+uint64(len(buffer)) > uint64(w.options.segmentSize) {
+		if err := w.rotate(); err != nil {
+			return 0, w.fail(err)
+		}
+	}
 
-	_, err := w.buffer.Write(buffer[:n+length+4])
+	_, err := w.buffer.Write(buffer)
 	if err != nil {
-		return 0, err
+		return 0, w.fail(err)
+	}
+
+	w.offset += uint64(len(buffer))
+	w.written++
+
+	if !w.options.groupCommit {
+		return length, nil
+	}
+
+	seq := w.written
+
+	w.batch++
+	if w.batch == 1 {
+		notify(w.pending)
+	}
+
+	if w.batch >= w.options.maxBatchSize {
+		notify(w.full)
+	}
+
+	for w.synced < seq && w.err == nil {
+		w.committed.Wait()
+	}
+
+	if w.synced < seq {
+		return 0, w.err
 	}
 
 	return length, nil
 }
 
+// notify signals the commit loop without blocking. Signals that arrive while one is already waiting are dropped.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// commitLoop syncs batches of records to disk on behalf of the writers waiting for them. A batch is synced once it
+// reaches the max batch size or the max batch latency has passed since its first record was written.
+func (w *Writer) commitLoop() {
+	defer close(w.stopped)
+
+	timer := time.NewTimer(w.options.maxBatchLatency)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.pending:
+		}
+
+		timer.Reset(w.options.maxBatchLatency)
+
+		select {
+		case <-w.done:
+			timer.Stop()
+
+			return
+		case <-w.full:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+
+		w.mu.Lock()
+		_ = w.commit()
+		w.mu.Unlock()
+	}
+}
+
+// fail keeps the error, returning it to all subsequent writes, and wakes the writers waiting on a commit. Retrying
+// would let records that failed to reach the disk be reported as durable once a later sync succeeds.
+func (w *Writer) fail(err error) error {
+	w.err = err
+	w.committed.Broadcast()
+
+	return err
+}
+
+// commit syncs every record written so far and wakes the writers waiting on them. Once a sync fails, it's unknown
+// which records made it to disk, so the error is kept and returned to all subsequent writes.
+func (w *Writer) commit() error {
+	if w.err != nil || w.synced == w.written {
+		return w.err
+	}
+
+	if err := w.sync(); err != nil {
+		w.err = err
+	} else {
+		w.synced = w.written
+	}
+
+	w.batch = 0
+	w.committed.Broadcast()
+
+	return w.err
+}
+
+// sync flushes the buffered records and fsyncs the active segment.
+func (w *Writer) sync() error {
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+
+	return w.handle.Sync()
+}
+
+// TruncateBefore removes the segments containing only records that come before the provided position, reclaiming
+// their space once a snapshot covers them. Segments are removed whole, so records earlier in the segment containing
+// the position are kept. The active segment is never removed.
+func (w *Writer) TruncateBefore(position Position) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	indexes, err := segments(w.fs, w.dir)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+
+	for _, index := range indexes {
+		if index >= position.Segment || index >= w.segment {
+			break
+		}
+
+		if err := w.fs.Remove(segmentPath(w.dir, index)); err != nil {
+			return err
+		}
+
+		removed = true
+	}
+
+	if !removed {
+		return nil
+	}
+
+	// otherwise, removed segments can reappear after a crash
+	return syncDir(w.fs, w.dir)
+}
+
 func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	return w.buffer.Flush()
 }
 
+// Sync flushes the buffered records and fsyncs them to disk. Once Sync returns, every record previously written is
+// durable.
 func (w *Writer) Sync() error {
-	return w.buffer.Flush()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+
+	return w.commit()
 }
 
 func (w *Writer) Close() error {
-	w.Flush()
+	if w.done != nil {
+		w.stop.Do(func() {
+			close(w.done)
+			<-w.stopped
+		})
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+
+	w.closed = true
+
+	// release any writers waiting on a batch that never filled up
+	_ = w.commit()
 
 	return w.handle.Close()
 }
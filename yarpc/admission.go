@@ -0,0 +1,147 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"go.pitz.tech/lib/auth"
+)
+
+// DefaultPoolSize is the number of handlers a server runs at once unless configured otherwise.
+const DefaultPoolSize = 3000
+
+// maxIdleBuckets is the number of token buckets a rate limit keeps before forgetting the ones that have refilled.
+const maxIdleBuckets = 1024
+
+// RateLimit configures a token bucket that admits Rate streams per second on average, in bursts of up to Burst streams.
+type RateLimit struct {
+	// Rate is the number of streams admitted per second once the bucket has been drained.
+	Rate float64 `json:"rate"`
+	// Burst is the number of streams that can be admitted at once. Defaults to 1.
+	Burst int `json:"burst"`
+}
+
+// rateLimit tracks the token buckets for a RateLimit. Streams are limited globally when no methods are configured, or
+// per method otherwise. When limited by subject, every authenticated subject is given their own buckets.
+type rateLimit struct {
+	limit   RateLimit
+	methods map[string]bool
+	subject bool
+
+	mu      sync.Mutex
+	buckets map[string]*rate.Limiter
+}
+
+func newRateLimit(limit RateLimit, subject bool, methods []string) *rateLimit {
+	if limit.Burst <= 0 {
+		limit.Burst = 1
+	}
+
+	r := &rateLimit{
+		limit:   limit,
+		methods: make(map[string]bool, len(methods)),
+		subject: subject,
+		buckets: make(map[string]*rate.Limiter),
+	}
+
+	for _, method := range methods {
+		r.methods[method] = true
+	}
+
+	return r
+}
+
+// reserve takes a token for the stream from the bucket it's limited by, returning nil when the limit does not apply to
+// it. Unauthenticated streams share a single bucket when limited by subject.
+func (r *rateLimit) reserve(now time.Time, method string, userInfo *auth.UserInfo) *rate.Reservation {
+	key := ""
+
+	if len(r.methods) > 0 {
+		if !r.methods[method] {
+			return nil
+		}
+
+		key = method
+	}
+
+	if r.subject && userInfo != nil {
+		key += "\x00" + userInfo.Subject
+	}
+
+	return r.bucket(key).ReserveN(now, 1)
+}
+
+func (r *rateLimit) bucket(key string) *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bucket, ok := r.buckets[key]
+	if ok {
+		return bucket
+	}
+
+	// buckets that have refilled behave the same as new ones, so they can be dropped to bound memory
+	if len(r.buckets) >= maxIdleBuckets {
+		for k, b := range r.buckets {
+			if b.Tokens() >= float64(b.Burst()) {
+				delete(r.buckets, k)
+			}
+		}
+	}
+
+	bucket = rate.NewLimiter(rate.Limit(r.limit.Rate), r.limit.Burst)
+	r.buckets[key] = bucket
+
+	return bucket
+}
+
+// admission applies the rate limits configured on a server. It runs as the innermost server interceptor so limits by
+// subject can use the user information attached by authentication interceptors.
+type admission struct {
+	rateLimits []*rateLimit
+}
+
+// intercept admits the stream when every limit has a token for it. Tokens are only taken once all of them do, so a
+// stream rejected by one limit does not count against the others.
+func (a *admission) intercept(method string, stream Stream, next Handler) error {
+	userInfo := auth.Extract(stream.Context())
+	now := time.Now()
+
+	reservations := make([]*rate.Reservation, 0, len(a.rateLimits))
+
+	for _, limit := range a.rateLimits {
+		reservation := limit.reserve(now, method, userInfo)
+		if reservation == nil {
+			continue
+		}
+
+		reservations = append(reservations, reservation)
+
+		if !reservation.OK() || reservation.DelayFrom(now) > 0 {
+			for _, reservation := range reservations {
+				reservation.CancelAt(now)
+			}
+
+			return Errorf(CodeResourceExhausted, "rate limit exceeded for %s", method)
+		}
+	}
+
+	return next.ServeYARPC(stream)
+}
@@ -0,0 +1,328 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/auth"
+	"go.pitz.tech/lib/headers"
+	"go.pitz.tech/lib/yarpc"
+)
+
+// admissionServer serves an echo method and a method that blocks until released, returning the listener it's
+// served on.
+func admissionServer(t *testing.T, release chan struct{}, opts ...yarpc.Option) *yarpc.MemoryListener {
+	t.Helper()
+
+	mux := &yarpc.ServeMux{}
+
+	echo := yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		msg := ""
+		if err := stream.ReadMsg(&msg); err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(msg)
+	})
+
+	mux.Handle("/test/Echo", echo)
+	mux.Handle("/test/Other", echo)
+	mux.Handle("/test/Block", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		if err := stream.WriteMsg("started"); err != nil {
+			return err
+		}
+
+		select {
+		case <-release:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+
+		return stream.WriteMsg("released")
+	}))
+
+	listener := yarpc.NewMemoryListener()
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(listener, opts...)
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	return listener
+}
+
+func invoke(ctx context.Context, cc *yarpc.ClientConn, method string) error {
+	resp := ""
+
+	return cc.Invoke(ctx, method, "hello", &resp)
+}
+
+// block opens a stream on the blocking method once its handler is running, returning a channel that receives the
+// result once it's released.
+func block(ctx context.Context, t *testing.T, cc *yarpc.ClientConn) chan error {
+	t.Helper()
+
+	stream, err := cc.OpenStream(ctx, "/test/Block")
+	require.NoError(t, err)
+
+	resp := ""
+	require.NoError(t, stream.ReadMsg(&resp))
+
+	return released(stream, 1)
+}
+
+// queue opens a stream on the blocking method without waiting for its handler to run, returning a channel that
+// receives the result once it's released.
+func queue(ctx context.Context, t *testing.T, cc *yarpc.ClientConn) chan error {
+	t.Helper()
+
+	stream, err := cc.OpenStream(ctx, "/test/Block")
+	require.NoError(t, err)
+
+	return released(stream, 2)
+}
+
+// released reads the remaining messages from a stream on the blocking method, sending the first error to the channel.
+func released(stream yarpc.Stream, remaining int) chan error {
+	result := make(chan error, 1)
+
+	go func() {
+		defer stream.Close()
+
+		resp := ""
+
+		for i := 0; i < remaining; i++ {
+			if err := stream.ReadMsg(&resp); err != nil {
+				result <- err
+
+				return
+			}
+		}
+
+		result <- nil
+	}()
+
+	return result
+}
+
+func requireResourceExhausted(t *testing.T, err error) {
+	t.Helper()
+
+	require.ErrorIs(t, err, &yarpc.Error{Code: yarpc.CodeResourceExhausted})
+}
+
+// requireEventuallyAdmitted waits for calls to be admitted, as the server finishes with a stream shortly after the
+// client has received its response.
+func requireEventuallyAdmitted(ctx context.Context, t *testing.T, cc *yarpc.ClientConn) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return invoke(ctx, cc, "/test/Echo") == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	// the buckets refill too slowly to matter for the test
+	limit := yarpc.RateLimit{Rate: 0.001, Burst: 2}
+
+	t.Run("global", func(t *testing.T) {
+		t.Parallel()
+
+		cc := yarpc.DialMemory(ctx, admissionServer(t, nil, yarpc.WithRateLimit(limit)))
+
+		require.NoError(t, invoke(ctx, cc, "/test/Echo"))
+		require.NoError(t, invoke(ctx, cc, "/test/Other"))
+		requireResourceExhausted(t, invoke(ctx, cc, "/test/Echo"))
+		requireResourceExhausted(t, invoke(ctx, cc, "/test/Other"))
+	})
+
+	t.Run("per method", func(t *testing.T) {
+		t.Parallel()
+
+		cc := yarpc.DialMemory(ctx, admissionServer(t, nil, yarpc.WithRateLimit(limit, "/test/Echo")))
+
+		require.NoError(t, invoke(ctx, cc, "/test/Echo"))
+		require.NoError(t, invoke(ctx, cc, "/test/Echo"))
+		requireResourceExhausted(t, invoke(ctx, cc, "/test/Echo"))
+
+		for i := 0; i < 5; i++ {
+			require.NoError(t, invoke(ctx, cc, "/test/Other"))
+		}
+	})
+
+	t.Run("multiple limits", func(t *testing.T) {
+		t.Parallel()
+
+		cc := yarpc.DialMemory(ctx, admissionServer(t, nil,
+			yarpc.WithRateLimit(limit),
+			yarpc.WithRateLimit(yarpc.RateLimit{Rate: 0.001, Burst: 1}, "/test/Echo"),
+		))
+
+		require.NoError(t, invoke(ctx, cc, "/test/Echo"))
+
+		// streams rejected by one limit do not count against the others
+		for i := 0; i < 5; i++ {
+			requireResourceExhausted(t, invoke(ctx, cc, "/test/Echo"))
+		}
+
+		require.NoError(t, invoke(ctx, cc, "/test/Other"))
+		requireResourceExhausted(t, invoke(ctx, cc, "/test/Other"))
+	})
+
+	t.Run("per subject", func(t *testing.T) {
+		t.Parallel()
+
+		authenticate := func(method string, stream yarpc.Stream, next yarpc.Handler) error {
+			ctx := stream.Context()
+
+			if subject := headers.Extract(ctx).Get("subject"); subject != "" {
+				ctx = auth.ToContext(ctx, auth.UserInfo{Subject: subject})
+			}
+
+			return next.ServeYARPC(yarpc.StreamWithContext(ctx, stream))
+		}
+
+		cc := yarpc.DialMemory(ctx, admissionServer(t, nil,
+			yarpc.WithServerInterceptors(authenticate),
+			yarpc.WithSubjectRateLimit(limit),
+		))
+
+		as := func(subject string) context.Context {
+			header := headers.New()
+			header.Set("subject", subject)
+
+			return yarpc.OutgoingHeaderToContext(ctx, header)
+		}
+
+		require.NoError(t, invoke(as("alice"), cc, "/test/Echo"))
+		require.NoError(t, invoke(as("alice"), cc, "/test/Other"))
+		requireResourceExhausted(t, invoke(as("alice"), cc, "/test/Echo"))
+
+		require.NoError(t, invoke(as("bob"), cc, "/test/Echo"))
+
+		// unauthenticated streams share a limit
+		require.NoError(t, invoke(ctx, cc, "/test/Echo"))
+		require.NoError(t, invoke(ctx, cc, "/test/Echo"))
+		requireResourceExhausted(t, invoke(ctx, cc, "/test/Echo"))
+	})
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	release := make(chan struct{})
+	listener := admissionServer(t, release, yarpc.WithMaxConcurrentStreams(1))
+
+	cc := yarpc.DialMemory(ctx, listener)
+	blocked := block(ctx, t, cc)
+
+	// the session is at its limit, but other sessions are not affected
+	requireResourceExhausted(t, invoke(ctx, cc, "/test/Echo"))
+	require.NoError(t, invoke(ctx, yarpc.DialMemory(ctx, listener), "/test/Echo"))
+
+	close(release)
+	require.NoError(t, <-blocked)
+	requireEventuallyAdmitted(ctx, t, cc)
+}
+
+func TestPoolSize(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	t.Run("without queue", func(t *testing.T) {
+		t.Parallel()
+
+		release := make(chan struct{})
+		cc := yarpc.DialMemory(ctx, admissionServer(t, release, yarpc.WithPoolSize(1)))
+
+		blocked := block(ctx, t, cc)
+		requireResourceExhausted(t, invoke(ctx, cc, "/test/Echo"))
+
+		close(release)
+		require.NoError(t, <-blocked)
+		requireEventuallyAdmitted(ctx, t, cc)
+	})
+
+	t.Run("with queue", func(t *testing.T) {
+		t.Parallel()
+
+		release := make(chan struct{})
+		cc := yarpc.DialMemory(ctx, admissionServer(t, release, yarpc.WithPoolSize(1), yarpc.WithQueueSize(1)))
+
+		blocked := block(ctx, t, cc)
+
+		// only one of the streams fits in the queue, so the other is rejected
+		results := make(chan error, 2)
+
+		for i := 0; i < 2; i++ {
+			queued := queue(ctx, t, cc)
+
+			go func() {
+				results <- <-queued
+			}()
+		}
+
+		requireResourceExhausted(t, <-results)
+
+		// the queued stream is handled once the pool frees up
+		close(release)
+		require.NoError(t, <-blocked)
+		require.NoError(t, <-results)
+	})
+}
+
+func TestAdmissionBeforePool(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	release := make(chan struct{})
+	cc := yarpc.DialMemory(ctx, admissionServer(t, release,
+		yarpc.WithPoolSize(1),
+		yarpc.WithRateLimit(yarpc.RateLimit{Rate: 0.001, Burst: 1}, "/test/Echo"),
+	))
+
+	require.NoError(t, invoke(ctx, cc, "/test/Echo"))
+	blocked := block(ctx, t, cc)
+
+	// the stream is rejected by its rate limit before it needs the busy handler
+	err := invoke(ctx, cc, "/test/Echo")
+	requireResourceExhausted(t, err)
+	require.ErrorContains(t, err, "rate limit exceeded")
+
+	close(release)
+	require.NoError(t, <-blocked)
+}
@@ -0,0 +1,383 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/hashicorp/yamux"
+
+	"go.pitz.tech/lib/cluster"
+)
+
+// DialMembership initializes a client connection that balances streams across the active members of the cluster.
+// A session is kept open to every member that can be reached, and members are added and removed as the membership
+// changes. The Strategy used to pick a member for each stream can be configured using WithStrategy, and defaults to
+// RoundRobin. The state of the connection is Ready while any of the members can be reached.
+func DialMembership(ctx context.Context, network string, membership *cluster.Membership, opts ...Option) *ClientConn {
+	c := NewClientConn(ctx).WithOptions(opts...)
+	if c.options.strategy == nil {
+		c.options.strategy = RoundRobin()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	c.balancer = &balancer{
+		network:      network,
+		options:      c.options,
+		connectivity: &c.connectivity,
+		cancel:       cancel,
+		endpoints:    make(map[string]*endpoint),
+		changed:      make(chan struct{}),
+	}
+
+	go c.balancer.watch(ctx, membership)
+
+	return c
+}
+
+// DialTargets initializes a client connection that balances streams across a static list of targets.
+func DialTargets(ctx context.Context, network string, targets []string, opts ...Option) *ClientConn {
+	membership := &cluster.Membership{}
+	membership.Add(targets)
+
+	return DialMembership(ctx, network, membership, opts...)
+}
+
+// balancer maintains a session to each endpoint in the cluster and picks which one to open streams against.
+type balancer struct {
+	network      string
+	options      options
+	connectivity *connectivity
+	cancel       context.CancelFunc
+
+	mu        sync.Mutex
+	endpoints map[string]*endpoint
+	// changed is closed and replaced whenever an endpoint becomes ready or unavailable.
+	changed chan struct{}
+}
+
+type endpoint struct {
+	address     string
+	cancel      context.CancelFunc
+	session     *yamux.Session
+	state       ConnectivityState
+	outstanding int64
+	// reconnect is signalled when the session should be replaced without closing it
+	reconnect chan struct{}
+}
+
+// watch keeps the set of endpoints in sync with the membership until the context is done.
+func (b *balancer) watch(ctx context.Context, membership *cluster.Membership) {
+	changes, cancel := membership.Watch()
+
+	defer func() {
+		// the membership holds its lock while broadcasting, so keep draining changes until the watch is removed
+		done := make(chan struct{})
+
+		go func() {
+			cancel()
+			close(done)
+		}()
+
+		for {
+			select {
+			case <-changes:
+			case <-done:
+				b.remove(b.addresses())
+
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// the connection is shut down along with the context it was dialed with
+			b.connectivity.set(Shutdown)
+
+			return
+		case change := <-changes:
+			b.add(ctx, change.Active)
+			b.remove(change.Left)
+			b.remove(change.Removed)
+		}
+	}
+}
+
+func (b *balancer) addresses() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	addresses := make([]string, 0, len(b.endpoints))
+	for address := range b.endpoints {
+		addresses = append(addresses, address)
+	}
+
+	return addresses
+}
+
+func (b *balancer) add(ctx context.Context, addresses []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, address := range addresses {
+		if _, ok := b.endpoints[address]; ok {
+			continue
+		}
+
+		endpointContext, cancel := context.WithCancel(ctx)
+
+		e := &endpoint{
+			address:   address,
+			cancel:    cancel,
+			reconnect: make(chan struct{}, 1),
+		}
+
+		b.endpoints[address] = e
+
+		go b.connect(endpointContext, e)
+	}
+}
+
+func (b *balancer) remove(addresses []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	removed := false
+
+	for _, address := range addresses {
+		e, ok := b.endpoints[address]
+		if !ok {
+			continue
+		}
+
+		e.cancel()
+		delete(b.endpoints, address)
+
+		removed = true
+	}
+
+	if removed {
+		b.notify()
+	}
+}
+
+// notify wakes any streams waiting for an endpoint to become ready, and updates the state of the connection. It must be
+// called while holding the lock.
+func (b *balancer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	b.connectivity.set(b.state())
+}
+
+// state summarizes the state of the endpoints. The connection is ready while any endpoint is ready, and only reports a
+// failure once every endpoint has failed. It must be called while holding the lock.
+func (b *balancer) state() ConnectivityState {
+	counts := make(map[ConnectivityState]int)
+	for _, e := range b.endpoints {
+		counts[e.state]++
+	}
+
+	for _, state := range []ConnectivityState{Ready, Connecting, TransientFailure} {
+		if counts[state] > 0 {
+			return state
+		}
+	}
+
+	return Idle
+}
+
+// setState updates the state of the endpoint.
+func (b *balancer) setState(e *endpoint, state ConnectivityState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.state = state
+	b.notify()
+}
+
+// setSession replaces the session of the endpoint. A nil session marks the endpoint as failed.
+func (b *balancer) setSession(e *endpoint, session *yamux.Session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.session = session
+	e.state = Ready
+
+	if session == nil {
+		e.state = TransientFailure
+	}
+
+	b.notify()
+}
+
+// close stops maintaining sessions to the endpoints, closing the sessions that are open.
+func (b *balancer) close() {
+	b.cancel()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// wake any streams waiting for an endpoint so they see the connection has been shut down
+	b.notify()
+}
+
+// discard stops new streams from being opened on the session, and has the endpoint that owns it open a new session.
+func (b *balancer) discard(session *yamux.Session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, e := range b.endpoints {
+		if e.session != session {
+			continue
+		}
+
+		e.session = nil
+		e.state = Connecting
+		b.notify()
+
+		select {
+		case e.reconnect <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// connect maintains a session to the endpoint until the context is cancelled. Failed connections are retried using an
+// exponential backoff.
+func (b *balancer) connect(ctx context.Context, e *endpoint) {
+	dialer := newNetDialer(b.network, e.address, b.options.tls)
+
+	yamuxcfg := b.options.yamuxConfig(ctx)
+
+	backoffConfig := backoff.NewExponentialBackOff()
+	backoffConfig.MaxElapsedTime = 0
+
+	for {
+		b.setState(e, Connecting)
+
+		session, err := dialSession(ctx, dialer, b.options, yamuxcfg)
+		if err != nil {
+			b.setState(e, TransientFailure)
+
+			timer := time.NewTimer(backoffConfig.NextBackOff())
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+
+				return
+			case <-timer.C:
+				continue
+			}
+		}
+
+		backoffConfig.Reset()
+		b.setSession(e, session)
+
+		select {
+		case <-ctx.Done():
+			_ = session.Close()
+
+			return
+		case <-session.CloseChan():
+			// yamux closes the session once a keepalive goes unanswered
+			b.setSession(e, nil)
+		case <-e.reconnect:
+		}
+	}
+}
+
+// ready returns the endpoints that currently have an open session. It must be called while holding the lock.
+func (b *balancer) ready() []Endpoint {
+	ready := make([]Endpoint, 0, len(b.endpoints))
+
+	for address, e := range b.endpoints {
+		if e.session == nil || e.session.IsClosed() {
+			continue
+		}
+
+		ready = append(ready, Endpoint{
+			Address:     address,
+			Outstanding: atomic.LoadInt64(&e.outstanding),
+		})
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].Address < ready[j].Address
+	})
+
+	return ready
+}
+
+// pick chooses the endpoint a stream for the method is opened against, waiting for an endpoint to become ready when
+// none can be used. With fail fast enabled, an unavailable error is returned instead while every endpoint is failing.
+// The returned function must be called once the stream is done.
+func (b *balancer) pick(ctx context.Context, method string) (*yamux.Session, func(), error) {
+	for {
+		state, _ := b.connectivity.get()
+		if state == Shutdown {
+			return nil, nil, ErrClientConnClosed
+		}
+
+		b.mu.Lock()
+		ready := b.ready()
+		changed := b.changed
+		b.mu.Unlock()
+
+		if address, ok := b.options.strategy.Pick(ctx, method, ready); ok {
+			if session, done := b.acquire(address); session != nil {
+				return session, done, nil
+			}
+		}
+
+		if b.options.failFast && state == TransientFailure {
+			return nil, nil, Errorf(CodeUnavailable, "failed to connect to any endpoint")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// acquire returns the session for the endpoint and counts a new outstanding stream against it. A nil session is
+// returned when the endpoint is no longer ready.
+func (b *balancer) acquire(address string) (*yamux.Session, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.endpoints[address]
+	if !ok || e.session == nil || e.session.IsClosed() {
+		return nil, nil
+	}
+
+	atomic.AddInt64(&e.outstanding, 1)
+
+	return e.session, func() {
+		atomic.AddInt64(&e.outstanding, -1)
+	}
+}
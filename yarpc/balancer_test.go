@@ -0,0 +1,224 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/cluster"
+	"go.pitz.tech/lib/leaderless"
+	"go.pitz.tech/lib/yarpc"
+)
+
+// startIdentityServers starts servers that reply to every stream with their own address.
+func startIdentityServers(t *testing.T, count int) (network string, addresses []string) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		mux := &yarpc.ServeMux{}
+
+		var address string
+
+		network, address = startServer(t, mux)
+		addresses = append(addresses, address)
+
+		mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+			return stream.WriteMsg(address)
+		}))
+	}
+
+	return network, addresses
+}
+
+func identify(ctx context.Context, t *testing.T, cc *yarpc.ClientConn) string {
+	t.Helper()
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	defer stream.Close()
+
+	address := ""
+	require.NoError(t, stream.ReadMsg(&address))
+
+	return address
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network, addresses := startIdentityServers(t, 3)
+	cc := yarpc.DialTargets(ctx, network, addresses)
+
+	// wait for every endpoint to become ready before counting
+	require.Eventually(t, func() bool {
+		seen := make(map[string]bool)
+		for i := 0; i < len(addresses); i++ {
+			seen[identify(ctx, t, cc)] = true
+		}
+
+		return len(seen) == len(addresses)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3*len(addresses); i++ {
+		counts[identify(ctx, t, cc)]++
+	}
+
+	for _, address := range addresses {
+		require.Equal(t, 3, counts[address])
+	}
+}
+
+func TestBalancerMembershipChanges(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network, addresses := startIdentityServers(t, 2)
+
+	membership := &cluster.Membership{}
+	membership.Add(addresses[:1])
+
+	cc := yarpc.DialMembership(ctx, network, membership)
+	require.Equal(t, addresses[0], identify(ctx, t, cc))
+
+	membership.Add(addresses[1:])
+	membership.Remove(addresses[:1])
+
+	require.Eventually(t, func() bool {
+		return identify(ctx, t, cc) == addresses[1]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, addresses[1], identify(ctx, t, cc))
+	}
+}
+
+func TestBalancerWaitsForEndpoints(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	cc := yarpc.DialTargets(ctx, "unix", nil)
+
+	_, err := cc.OpenStream(ctx, method)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestBalancerFailFast(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+	cc := yarpc.DialTargets(ctx, "unix", []string{address}, yarpc.WithFailFast())
+
+	// streams fail once every endpoint is failing, rather than waiting for one to recover
+	_, err := cc.OpenStream(ctx, method)
+	require.ErrorIs(t, err, &yarpc.Error{Code: yarpc.CodeUnavailable})
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	t.Parallel()
+
+	strategy := yarpc.LeastOutstanding()
+	endpoints := []yarpc.Endpoint{
+		{Address: "a", Outstanding: 2},
+		{Address: "b", Outstanding: 0},
+		{Address: "c", Outstanding: 1},
+	}
+
+	for i := 0; i < 5; i++ {
+		address, ok := strategy.Pick(context.Background(), method, endpoints)
+		require.True(t, ok)
+		require.Equal(t, "b", address)
+	}
+
+	// ties are spread across endpoints
+	endpoints[0].Outstanding = 0
+	picked := make(map[string]bool)
+
+	for i := 0; i < 6; i++ {
+		address, _ := strategy.Pick(context.Background(), method, endpoints)
+		picked[address] = true
+	}
+
+	require.Equal(t, map[string]bool{"a": true, "b": true}, picked)
+
+	_, ok := strategy.Pick(context.Background(), method, nil)
+	require.False(t, ok)
+}
+
+func TestConsistentHash(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network, addresses := startIdentityServers(t, 3)
+
+	membership := &cluster.Membership{}
+	membership.Add(addresses)
+
+	director := leaderless.New()
+	go func() { _ = director.Start(ctx, membership) }()
+
+	require.Eventually(t, func() bool {
+		_, ok := director.GetLeader("key")
+
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	leader, _ := director.GetLeader("key")
+
+	cc := yarpc.DialMembership(ctx, network, membership, yarpc.WithStrategy(yarpc.ConsistentHash(director)))
+	keyContext := yarpc.HashKeyToContext(ctx, "key")
+
+	// until the owner of the key is ready, streams are sent to other replicas
+	require.Eventually(t, func() bool {
+		return identify(keyContext, t, cc) == leader
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, leader, identify(keyContext, t, cc))
+	}
+
+	// when the owner of a key is unavailable, the next replica on the ring is used
+	replicas, _ := director.GetReplicas("key", len(addresses))
+	endpoints := make([]yarpc.Endpoint, 0, len(addresses))
+
+	for _, address := range addresses {
+		if address != leader {
+			endpoints = append(endpoints, yarpc.Endpoint{Address: address})
+		}
+	}
+
+	address, ok := yarpc.ConsistentHash(director).Pick(keyContext, method, endpoints)
+	require.True(t, ok)
+	require.Equal(t, replicas[1], address)
+}
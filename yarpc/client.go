@@ -18,37 +18,42 @@ package yarpc
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/cenkalti/backoff/v4"
 	"github.com/hashicorp/yamux"
 
 	"go.pitz.tech/lib/encoding"
-	"go.pitz.tech/lib/logger"
 )
 
 // DialContext initializes a new client connection to the target server.
 func DialContext(ctx context.Context, network, target string, opts ...Option) *ClientConn {
 	c := NewClientConn(ctx).WithOptions(opts...)
+	c.Dialer = newNetDialer(network, target, c.options.tls)
 
+	return c
+}
+
+// newNetDialer returns a Dialer for the target, using TLS when a configuration is provided.
+func newNetDialer(network, target string, config *tls.Config) Dialer {
 	dialer := &NetDialerAdapter{
 		Dialer:  &net.Dialer{},
 		Network: network,
 		Target:  target,
 	}
 
-	if c.options.tls != nil {
+	if config != nil {
 		dialer.Dialer = &tls.Dialer{
 			NetDialer: &net.Dialer{},
-			Config:    c.options.tls,
+			Config:    config,
 		}
 	}
 
-	c.Dialer = dialer
-
-	return c
+	return dialer
 }
 
 // NewClientConn creates a default ClientConn with an empty dialer implementation. The Dialer must be configured before
@@ -60,17 +65,34 @@ func NewClientConn(ctx context.Context) *ClientConn {
 			context:  ctx,
 			yamux:    yamux.DefaultConfig(),
 			encoding: encoding.MsgPack,
+			metrics:  noopMetrics{},
 		},
-		mu: sync.Mutex{},
+		mu:        sync.Mutex{},
+		reconnect: make(chan struct{}, 1),
 	}
 }
 
-// ClientConn defines an abstract connection yarpc clients to use.
+// ClientConn defines an abstract connection yarpc clients to use. Once connected, the session to the server is
+// maintained in the background. Sessions that are lost, such as when the server stops responding to keepalives, are
+// replaced without waiting for the next stream to be opened. The state of the connection can be observed using
+// GetState and WaitForStateChange.
 type ClientConn struct {
-	Dialer  Dialer
-	options options
-	mu      sync.Mutex
-	session *yamux.Session
+	Dialer   Dialer
+	options  options
+	mu       sync.Mutex
+	session  *yamux.Session
+	balancer *balancer
+
+	connectivity connectivity
+	// connecting is set while the session is being maintained in the background
+	connecting bool
+	cancel     context.CancelFunc
+	// reconnect is signalled when the session should be replaced without closing it
+	reconnect chan struct{}
+	// err is the reason the last attempt to establish a session failed
+	err error
+	// failures counts the failed attempts to establish a session
+	failures uint64
 }
 
 // WithOptions configures the options for the underlying client connection.
@@ -82,62 +104,367 @@ func (c *ClientConn) WithOptions(opts ...Option) *ClientConn {
 	return c
 }
 
-func (c *ClientConn) obtainSession(ctx context.Context) (*yamux.Session, error) {
+// GetState returns the connectivity state of the connection.
+func (c *ClientConn) GetState() ConnectivityState {
+	state, _ := c.connectivity.get()
+
+	return state
+}
+
+// WaitForStateChange blocks until the connectivity state of the connection differs from the source state, or the
+// context is done. It reports whether the state changed before the context was done.
+func (c *ClientConn) WaitForStateChange(ctx context.Context, source ConnectivityState) bool {
+	return c.connectivity.wait(ctx, source)
+}
+
+// Connect starts establishing a session in the background if the connection is idle, without waiting for a stream to
+// be opened.
+func (c *ClientConn) Connect() {
+	if c.balancer != nil {
+		// balanced connections connect to their endpoints as soon as they're dialed
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.startConnecting()
+}
+
+// Close shuts down the connection. Open sessions are closed, cancelling any streams still running on them, and new
+// streams can no longer be opened. The connection is also shut down once the context it was created with is done.
+func (c *ClientConn) Close() error {
+	c.connectivity.set(Shutdown)
+
+	if c.balancer != nil {
+		c.balancer.close()
+
+		return nil
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.session == nil || c.session.IsClosed() {
-		backoffConfig := backoff.WithContext(backoff.NewExponentialBackOff(), ctx)
-
-		err := backoff.Retry(
-			func() error {
-				conn, err := c.Dialer.DialContext(ctx)
-				if err != nil {
-					return err
-				}
-
-				yamuxcfg := *c.options.yamux
-				yamuxcfg.Logger = logger.HashiCorpStdLogger(logger.Extract(ctx))
-				yamuxcfg.LogOutput = nil
-
-				c.session, err = yamux.Client(conn, &yamuxcfg)
-				if err != nil {
-					return err
-				}
-
-				return nil
-			},
-			backoffConfig,
-		)
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	if c.session != nil {
+		_ = c.session.Close()
+		c.session = nil
+	}
+
+	return nil
+}
+
+// startConnecting maintains a session in the background unless the connection is already doing so, or has been shut
+// down. It reports whether it started connecting, and must be called while holding the lock.
+func (c *ClientConn) startConnecting() bool {
+	if c.connecting || c.GetState() == Shutdown {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(c.options.context)
+
+	c.connecting = true
+	c.cancel = cancel
+	c.err = nil
+
+	go c.connect(ctx)
+
+	return true
+}
+
+// connect maintains a session to the server until the context is done, or an attempt to establish one fails in a way
+// that will not change by retrying. Failed attempts are retried using an exponential backoff.
+func (c *ClientConn) connect(ctx context.Context) {
+	yamuxcfg := c.options.yamuxConfig(ctx)
+
+	backoffConfig := backoff.NewExponentialBackOff()
+	backoffConfig.MaxElapsedTime = 0
+
+	for {
+		c.connectivity.set(Connecting)
+
+		session, err := dialSession(ctx, c.Dialer, c.options, yamuxcfg)
 		if err != nil {
-			return nil, err
+			preambleErr := &PreambleError{}
+
+			switch {
+			case ctx.Err() != nil:
+				c.stopConnecting(ctx.Err())
+
+				return
+			case errors.As(err, &preambleErr):
+				// the server will continue to refuse the connection, so there's no point in retrying
+				c.stopConnecting(err)
+
+				return
+			}
+
+			c.setSession(nil, err)
+
+			timer := time.NewTimer(backoffConfig.NextBackOff())
+
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				c.stopConnecting(ctx.Err())
+
+				return
+			case <-timer.C:
+				continue
+			}
+		}
+
+		backoffConfig.Reset()
+		c.setSession(session, nil)
+
+		select {
+		case <-ctx.Done():
+			_ = session.Close()
+			c.stopConnecting(ctx.Err())
+
+			return
+		case <-session.CloseChan():
+			// yamux closes the session once a keepalive goes unanswered. The session was lost rather than failing to be
+			// established, so streams wait for the next attempt.
+			c.setSession(nil, nil)
+		case <-c.reconnect:
 		}
 	}
+}
+
+// setSession replaces the session streams are opened on. A nil session marks the connection as failed. When a reason is
+// provided, it's counted as a failed attempt to establish a session, failing the streams that are waiting on it.
+func (c *ClientConn) setSession(session *yamux.Session, err error) {
+	c.mu.Lock()
+	c.session = session
+	c.err = err
+
+	if err != nil {
+		c.failures++
+	}
+
+	c.mu.Unlock()
+
+	// drop any request to replace the previous session
+	select {
+	case <-c.reconnect:
+	default:
+	}
 
-	return c.session, nil
+	if session != nil {
+		c.connectivity.set(Ready)
+	} else {
+		c.connectivity.set(TransientFailure)
+	}
 }
 
-// OpenStream starts a stream for the named RPC.
-func (c *ClientConn) OpenStream(ctx context.Context, method string) (Stream, error) {
-	session, err := c.obtainSession(ctx)
+// stopConnecting records why the session is no longer being maintained in the background.
+func (c *ClientConn) stopConnecting(err error) {
+	c.mu.Lock()
+	c.session = nil
+	c.connecting = false
+	c.err = err
+	c.mu.Unlock()
+
+	if c.options.context.Err() != nil {
+		c.connectivity.set(Shutdown)
+	} else {
+		c.connectivity.set(TransientFailure)
+	}
+}
+
+// obtainSession waits for a session to become available, connecting in the background if the connection isn't already.
+// With fail fast enabled, an unavailable error is returned once an attempt to establish a session made while waiting
+// fails, rather than waiting for the connection to recover.
+func (c *ClientConn) obtainSession(ctx context.Context) (*yamux.Session, error) {
+	started := false
+
+	c.mu.Lock()
+	failures := c.failures
+	c.mu.Unlock()
+
+	for {
+		state, changed := c.connectivity.get()
+		if state == Shutdown {
+			return nil, ErrClientConnClosed
+		}
+
+		c.mu.Lock()
+		session, err := c.session, c.err
+
+		switch {
+		case session != nil && !session.IsClosed():
+			c.mu.Unlock()
+
+			return session, nil
+		case !c.connecting && started:
+			// the connection stopped trying after the attempt this call started
+			c.mu.Unlock()
+
+			return nil, err
+		case c.options.failFast && c.failures != failures && err != nil:
+			c.mu.Unlock()
+
+			return nil, Errorf(CodeUnavailable, "failed to connect: %v", err)
+		case !c.connecting:
+			started = c.startConnecting()
+		}
+
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// dialSession establishes a new client session using the provided dialer.
+func dialSession(ctx context.Context, dialer Dialer, o options, yamuxcfg *yamux.Config) (*yamux.Session, error) {
+	conn, err := dialer.DialContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	stream, err := session.OpenStream()
+	if err = negotiate(ctx, conn, o.encoding); err != nil {
+		return nil, err
+	}
+
+	session, err := yamux.Client(conn, yamuxcfg)
 	if err != nil {
+		_ = conn.Close()
+
 		return nil, err
 	}
 
-	rpcStream := Wrap(stream, withOptions(&c.options))
+	observeSession(o.metrics, SideClient, session)
+
+	return session, nil
+}
+
+// obtainStreamSession returns the session a stream for the method should be opened on. When the connection balances
+// streams across multiple endpoints, the returned function releases the stream from its endpoint once it's done.
+func (c *ClientConn) obtainStreamSession(ctx context.Context, method string) (*yamux.Session, func(), error) {
+	if c.balancer != nil {
+		return c.balancer.pick(ctx, method)
+	}
+
+	session, err := c.obtainSession(ctx)
+
+	return session, func() {}, err
+}
+
+// OpenStream starts a stream for the named RPC. The deadline of the provided context is sent along to the server, and
+// the stream is closed once the context is done, cancelling the handler on the other end.
+func (c *ClientConn) OpenStream(ctx context.Context, method string) (Stream, error) {
+	intercept := ChainClientInterceptors(c.options.clientInterceptors...)
+
+	return intercept(ctx, method, c.openStream)
+}
 
-	err = rpcStream.WriteMsg(&Invoke{
+func (c *ClientConn) openStream(ctx context.Context, method string) (Stream, error) {
+	invoke := &Invoke{
 		Method: method,
+		Header: ExtractOutgoingHeader(ctx),
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		invoke.Timeout = time.Until(deadline)
+		if invoke.Timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+
+	var stream *yamux.Stream
+	var done func()
+
+	for stream == nil {
+		var session *yamux.Session
+		var err error
+
+		session, done, err = c.obtainStreamSession(ctx, method)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err = session.OpenStream()
+		switch {
+		case errors.Is(err, yamux.ErrRemoteGoAway):
+			// the server is draining, so leave the session for the streams that remain and open the stream elsewhere
+			done()
+			c.discardSession(session)
+		case errors.Is(err, yamux.ErrSessionShutdown):
+			// the session was torn down since it was obtained, so open the stream on a new one
+			done()
+			c.discardSession(session)
+		case err != nil:
+			done()
+
+			return nil, err
+		}
+	}
+
+	rpcStream := newStream(stream, c.options)
+
+	parent, _ := ExtractSpanContext(ctx)
+
+	switch {
+	case c.options.spanRecorder != nil:
+		span := newSpan(parent, SideClient, method, stream.RemoteAddr().String())
+		injectSpanContext(invoke.Header, span.Context)
+		rpcStream.trace(c.options.spanRecorder, span)
+	case parent.IsValid():
+		injectSpanContext(invoke.Header, parent)
+	}
+
+	rpcStream.setContext(ctx)
+	rpcStream.instrument(c.options.metrics, SideClient, method)
+	rpcStream.start()
+
+	go func() {
+		<-rpcStream.Context().Done()
+		_ = rpcStream.Close()
+		rpcStream.finished(rpcStream.result())
+		done()
+	}()
+
+	// the invoke frame is written directly so it is not reported as a message
+	err := rpcStream.encode(&Frame{
+		Nonce: nonce(),
+		Body:  invoke,
 	})
 
 	return rpcStream, err
 }
 
+// discardSession stops new streams from being opened on the provided session. Streams that are already open on the
+// session are left running.
+func (c *ClientConn) discardSession(session *yamux.Session) {
+	if c.balancer != nil {
+		c.balancer.discard(session)
+
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session != session {
+		return
+	}
+
+	c.session = nil
+
+	select {
+	case c.reconnect <- struct{}{}:
+	default:
+	}
+}
+
 // Dialer provides a minimal interface needed to establish a client.
 type Dialer interface {
 	DialContext(ctx context.Context) (io.ReadWriteCloser, error)
@@ -0,0 +1,63 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// yarpc-gen generates the server registration, typed client, and stream wrappers for a Go interface describing a yarpc
+// service. It's intended to be invoked using go generate:
+//
+//	//go:generate go run go.pitz.tech/lib/yarpc/cmd/yarpc-gen --type AcceptorServer --service paxos.acceptor
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+
+	"go.pitz.tech/lib/flagset"
+	yarpcgen "go.pitz.tech/lib/yarpc/gen"
+)
+
+func main() {
+	cfg := yarpcgen.Config{
+		Dir: ".",
+	}
+
+	app := &cli.App{
+		Name:      "yarpc-gen",
+		Usage:     "Generate typed yarpc stubs for a Go interface",
+		UsageText: "yarpc-gen --type <interface> [options]",
+		Flags:     flagset.Extract(&cfg),
+		Action: func(ctx *cli.Context) error {
+			source, err := yarpcgen.Generate(cfg)
+			if err != nil {
+				return err
+			}
+
+			// relative output files are placed alongside the package they're generated for
+			output := cfg.OutputFile()
+			if !filepath.IsAbs(output) {
+				output = filepath.Join(cfg.Dir, output)
+			}
+
+			return os.WriteFile(output, source, 0o644)
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
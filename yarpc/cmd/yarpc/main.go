@@ -0,0 +1,201 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// yarpc is a command line client for debugging yarpc services. It invokes arbitrary methods on a server or plugin,
+// reading messages as JSON from the command line or stdin, and writing each response as a line of JSON to stdout. The
+// status of the call is written to stderr, and used as the exit code when the call fails.
+//
+//	yarpc --address localhost:8080 call /echo.Echo/Echo '{"Text": "hello"}'
+//	yarpc --plugin myago-plugin-echo call /echo < messages.json
+//	yarpc --address localhost:8080 list
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"go.pitz.tech/lib/encoding"
+	"go.pitz.tech/lib/flagset"
+	"go.pitz.tech/lib/headers"
+	"go.pitz.tech/lib/livetls"
+	"go.pitz.tech/lib/plugin"
+	"go.pitz.tech/lib/yarpc"
+	"go.pitz.tech/lib/yarpc/dynamic"
+)
+
+// Config defines the options available to the client.
+type Config struct {
+	Network  string           `json:"network"  usage:"the network used to reach the server, such as tcp or unix" default:"tcp"`
+	Address  string           `json:"address"  usage:"the address of the server" alias:"a" default:"localhost:8080"`
+	Plugin   string           `json:"plugin"   usage:"fork the plugin binary, including any arguments, instead of dialing a server"`
+	Encoding string           `json:"encoding" usage:"how messages are encoded on the wire, either msgpack or json" default:"msgpack"`
+	Timeout  time.Duration    `json:"timeout"  usage:"how long to wait for the call to complete" default:"30s"`
+	Header   *cli.StringSlice `json:"header"   usage:"a header sent along with the call, formatted as key=value" alias:"H"`
+	TLS      livetls.Config   `json:"tls"`
+}
+
+var encodings = map[string]*encoding.Encoding{
+	encoding.MsgPack.Name: encoding.MsgPack,
+	encoding.JSON.Name:    encoding.JSON,
+}
+
+// dial creates a client connection to the configured server or plugin.
+func dial(ctx context.Context, cfg Config) (*yarpc.ClientConn, error) {
+	enc, ok := encodings[cfg.Encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %q, expected msgpack or json", cfg.Encoding)
+	}
+
+	if cfg.Plugin != "" {
+		args := strings.Fields(cfg.Plugin)
+
+		return plugin.DialContext(ctx, args[0], args[1:]...).WithOptions(yarpc.WithEncoding(enc)), nil
+	}
+
+	tlsConfig, err := livetls.New(ctx, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return yarpc.DialContext(ctx, cfg.Network, cfg.Address, yarpc.WithEncoding(enc), yarpc.WithTLS(tlsConfig)), nil
+}
+
+// callContext returns the context used for a call, carrying the configured timeout and headers.
+func callContext(ctx context.Context, cfg Config) (context.Context, context.CancelFunc, error) {
+	header := headers.New()
+
+	for _, value := range cfg.Header.Value() {
+		key, val, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid header %q, expected key=value", value)
+		}
+
+		header.SetAll(key, append(header.GetAll(key), val))
+	}
+
+	ctx = yarpc.OutgoingHeaderToContext(ctx, header)
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+
+	return ctx, cancel, nil
+}
+
+// exit reports the status of a call to stderr, and converts failures into an exit code matching their status code.
+func exit(err error) error {
+	status, _ := yarpc.StatusFromError(err)
+	if status == nil {
+		fmt.Fprintln(os.Stderr, "status:", yarpc.CodeOK)
+
+		return nil
+	}
+
+	fmt.Fprintln(os.Stderr, "status:", status)
+
+	return cli.Exit("", int(status.Code))
+}
+
+func main() {
+	cfg := Config{}
+
+	app := &cli.App{
+		Name:      "yarpc",
+		Usage:     "Invoke methods on yarpc servers and plugins",
+		UsageText: "yarpc [options] <command> [arguments]",
+		Flags:     flagset.ExtractPrefix("yarpc", &cfg),
+		Commands: []*cli.Command{
+			{
+				Name:      "call",
+				Usage:     "Invoke a method, printing each response as JSON",
+				UsageText: "yarpc [options] call <method> [message]",
+				Description: strings.Join([]string{
+					"The message is provided as a JSON argument. When omitted, JSON messages are streamed from stdin,",
+					"allowing client and bidirectional streams to be driven from the terminal or another program.",
+				}, " "),
+				Action: func(ctx *cli.Context) error {
+					method := ctx.Args().First()
+					if method == "" {
+						return cli.Exit("a method must be provided", 1)
+					}
+
+					var in io.Reader = os.Stdin
+					if ctx.Args().Len() > 1 {
+						in = strings.NewReader(ctx.Args().Get(1))
+					}
+
+					cc, err := dial(ctx.Context, cfg)
+					if err != nil {
+						return err
+					}
+					defer cc.Close()
+
+					callContext, cancel, err := callContext(ctx.Context, cfg)
+					if err != nil {
+						return err
+					}
+					defer cancel()
+
+					if err = dynamic.CheckMethod(callContext, cc, method); err != nil {
+						return exit(err)
+					}
+
+					return exit(dynamic.Call(callContext, cc, method, in, os.Stdout))
+				},
+			},
+			{
+				Name:      "list",
+				Usage:     "List the methods exposed by a server that provides the reflection service",
+				UsageText: "yarpc [options] list",
+				Action: func(ctx *cli.Context) error {
+					cc, err := dial(ctx.Context, cfg)
+					if err != nil {
+						return err
+					}
+					defer cc.Close()
+
+					callContext, cancel, err := callContext(ctx.Context, cfg)
+					if err != nil {
+						return err
+					}
+					defer cancel()
+
+					methods, ok, err := dynamic.Methods(callContext, cc)
+					switch {
+					case err != nil:
+						return exit(err)
+					case !ok:
+						return cli.Exit("the server does not provide the reflection service", 1)
+					}
+
+					for _, method := range methods {
+						fmt.Println(method)
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
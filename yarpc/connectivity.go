@@ -0,0 +1,111 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// ErrClientConnClosed is returned when opening streams on a ClientConn that has been closed.
+var ErrClientConnClosed = errors.New("yarpc: client connection is closed")
+
+// ConnectivityState describes the state of the connection between a ClientConn and its servers.
+type ConnectivityState int
+
+const (
+	// Idle indicates the ClientConn has not started connecting. Connections are established when the first stream is
+	// opened, or when Connect is called.
+	Idle ConnectivityState = iota
+	// Connecting indicates the ClientConn is establishing a session.
+	Connecting
+	// Ready indicates the ClientConn has a session that streams can be opened on.
+	Ready
+	// TransientFailure indicates the last attempt to establish a session failed, or the session was lost. The
+	// ClientConn continues to reconnect in the background.
+	TransientFailure
+	// Shutdown indicates the ClientConn has been closed.
+	Shutdown
+)
+
+var connectivityStateNames = map[ConnectivityState]string{
+	Idle:             "IDLE",
+	Connecting:       "CONNECTING",
+	Ready:            "READY",
+	TransientFailure: "TRANSIENT_FAILURE",
+	Shutdown:         "SHUTDOWN",
+}
+
+func (s ConnectivityState) String() string {
+	if name, ok := connectivityStateNames[s]; ok {
+		return name
+	}
+
+	return "ConnectivityState(" + strconv.Itoa(int(s)) + ")"
+}
+
+// connectivity tracks the state of a connection and notifies anyone waiting for it to change. Once shut down, the
+// state can no longer be changed.
+type connectivity struct {
+	mu      sync.Mutex
+	state   ConnectivityState
+	changed chan struct{}
+}
+
+func (c *connectivity) get() (ConnectivityState, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+
+	return c.state, c.changed
+}
+
+func (c *connectivity) set(state ConnectivityState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == state || c.state == Shutdown {
+		return
+	}
+
+	c.state = state
+
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// wait blocks until the state differs from the source state, reporting false if the context is done first.
+func (c *connectivity) wait(ctx context.Context, source ConnectivityState) bool {
+	for {
+		state, changed := c.get()
+		if state != source {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
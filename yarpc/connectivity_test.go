@@ -0,0 +1,255 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"net"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// waitForState waits for the connection to reach the provided state.
+func waitForState(ctx context.Context, t *testing.T, cc *yarpc.ClientConn, state yarpc.ConnectivityState) {
+	t.Helper()
+
+	for current := cc.GetState(); current != state; current = cc.GetState() {
+		require.True(t, cc.WaitForStateChange(ctx, current), "timed out waiting for %s, last saw %s", state, current)
+	}
+}
+
+func TestConnectivityState(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	listener := &connListener{Listener: netListener}
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return stream.WriteMsg(address)
+	}))
+
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: listener})
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	cc := yarpc.DialContext(ctx, "unix", address)
+	require.Equal(t, yarpc.Idle, cc.GetState())
+
+	// nothing happens until the connection is asked to connect
+	idleContext, idleCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer idleCancel()
+	require.False(t, cc.WaitForStateChange(idleContext, yarpc.Idle))
+
+	cc.Connect()
+	waitForState(ctx, t, cc, yarpc.Ready)
+
+	// losing the session is noticed, and replaced, without opening a stream
+	listener.closeConns()
+	require.True(t, cc.WaitForStateChange(ctx, yarpc.Ready))
+	waitForState(ctx, t, cc, yarpc.Ready)
+
+	reply := ""
+	require.NoError(t, cc.Invoke(ctx, method, "", &reply))
+	require.Equal(t, address, reply)
+
+	require.NoError(t, cc.Close())
+	require.Equal(t, yarpc.Shutdown, cc.GetState())
+
+	_, err = cc.OpenStream(ctx, method)
+	require.ErrorIs(t, err, yarpc.ErrClientConnClosed)
+}
+
+func TestConnectivityStateFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+	cc := yarpc.DialContext(ctx, "unix", address)
+
+	// the server is not running, so the connection keeps trying in the background
+	cc.Connect()
+	waitForState(ctx, t, cc, yarpc.TransientFailure)
+
+	_, address = startServer(t, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return nil
+	}))
+
+	// the connection is shut down along with the context it was dialed with
+	dialContext, dialCancel := context.WithCancel(ctx)
+	cc = yarpc.DialContext(dialContext, "unix", address)
+	cc.Connect()
+	waitForState(ctx, t, cc, yarpc.Ready)
+
+	dialCancel()
+	waitForState(ctx, t, cc, yarpc.Shutdown)
+}
+
+func TestConnectivityFailFast(t *testing.T) {
+	t.Parallel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	// by default, streams wait for the connection to recover
+	waiting := yarpc.DialContext(context.Background(), "unix", address)
+	t.Cleanup(func() { _ = waiting.Close() })
+
+	waitContext, waitCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer waitCancel()
+
+	_, err := waiting.OpenStream(waitContext, method)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	cc := yarpc.DialContext(context.Background(), "unix", address, yarpc.WithFailFast())
+	t.Cleanup(func() { _ = cc.Close() })
+
+	// streams fail once an attempt to connect fails, rather than waiting on a context that never ends
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := cc.OpenStream(context.Background(), method)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, &yarpc.Error{Code: yarpc.CodeUnavailable})
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "stream did not fail while the server was unavailable")
+	}
+
+	// once the server is running, the connection recovers in the background
+	netListener, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	svr := &yarpc.Server{Handler: yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return nil
+	})}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener})
+	}()
+
+	t.Cleanup(func() { _ = svr.Shutdown() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	waitForState(ctx, t, cc, yarpc.Ready)
+
+	_, err = cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+}
+
+// stallListener accepts connections that stop reading from the client once stalled, as though the server is no longer
+// responding.
+type stallListener struct {
+	net.Listener
+	stalled chan struct{}
+}
+
+func (l *stallListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &stallConn{Conn: conn, stalled: l.stalled, closed: make(chan struct{})}, nil
+}
+
+type stallConn struct {
+	net.Conn
+	stalled chan struct{}
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	select {
+	case <-c.stalled:
+		<-c.closed
+
+		return 0, net.ErrClosed
+	default:
+	}
+
+	return c.Conn.Read(p)
+}
+
+func (c *stallConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	return c.Conn.Close()
+}
+
+func TestKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	listener := &stallListener{Listener: netListener, stalled: make(chan struct{})}
+	svr := &yarpc.Server{Handler: &yarpc.ServeMux{}}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: listener})
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	yamuxcfg := yamux.DefaultConfig()
+	yamuxcfg.ConnectionWriteTimeout = 100 * time.Millisecond
+
+	cc := yarpc.DialContext(ctx, "unix", address, yarpc.WithYamux(yamuxcfg), yarpc.WithKeepAlive(20*time.Millisecond))
+	cc.Connect()
+	waitForState(ctx, t, cc, yarpc.Ready)
+
+	// the server stops responding without closing the connection, which is only noticed by the keepalive
+	close(listener.stalled)
+	require.True(t, cc.WaitForStateChange(ctx, yarpc.Ready))
+	require.NotEqual(t, yarpc.Shutdown, cc.GetState())
+}
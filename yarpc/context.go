@@ -0,0 +1,197 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"go.pitz.tech/lib/headers"
+	"go.pitz.tech/lib/libctx"
+)
+
+const (
+	invokeContextKey         = libctx.Key("yarpc.invoke")
+	outgoingHeaderContextKey = libctx.Key("yarpc.outgoing_header")
+	trailerContextKey        = libctx.Key("yarpc.trailer")
+	hashKeyContextKey        = libctx.Key("yarpc.hash_key")
+	spanContextKey           = libctx.Key("yarpc.span")
+	peerCredContextKey       = libctx.Key("yarpc.peer_cred")
+	peerContextKey           = libctx.Key("yarpc.peer")
+)
+
+// withInvoke attaches the Invoke frame that started the stream to the context.
+func withInvoke(ctx context.Context, invoke *Invoke) context.Context {
+	return context.WithValue(ctx, invokeContextKey, invoke)
+}
+
+// extractInvoke attempts to obtain the Invoke frame that started the stream from the context.
+func extractInvoke(ctx context.Context) *Invoke {
+	v := ctx.Value(invokeContextKey)
+	if v == nil {
+		return nil
+	}
+
+	return v.(*Invoke)
+}
+
+// Method returns the name of the method being invoked on the stream that owns the provided context. An empty string is
+// returned when the context did not come from a stream.
+func Method(ctx context.Context) string {
+	invoke := extractInvoke(ctx)
+	if invoke == nil {
+		return ""
+	}
+
+	return invoke.Method
+}
+
+// OutgoingHeaderToContext attaches headers to the context that are sent to the server when a stream is opened using the
+// context. On the server, these are made available to the handler using headers.Extract.
+func OutgoingHeaderToContext(ctx context.Context, header headers.Header) context.Context {
+	return context.WithValue(ctx, outgoingHeaderContextKey, header)
+}
+
+// ExtractOutgoingHeader returns a copy of the headers that will be sent to the server when a stream is opened using the
+// provided context.
+func ExtractOutgoingHeader(ctx context.Context) headers.Header {
+	header, _ := ctx.Value(outgoingHeaderContextKey).(headers.Header)
+
+	return cloneHeader(header)
+}
+
+func cloneHeader(header headers.Header) headers.Header {
+	clone := headers.New()
+	for key, values := range header {
+		clone.SetAll(key, append([]string{}, values...))
+	}
+
+	return clone
+}
+
+// normalizeHeader lowercases the keys of a header received from a peer so they can be looked up using headers.Get.
+// Values for keys that only differ in case are merged.
+func normalizeHeader(header headers.Header) headers.Header {
+	normalized := headers.New()
+	for key, values := range header {
+		key = strings.ToLower(key)
+		normalized[key] = append(normalized[key], values...)
+	}
+
+	return normalized
+}
+
+// trailer holds the headers sent by the server once the handler for a stream returns.
+type trailer struct {
+	mu     sync.Mutex
+	header headers.Header
+}
+
+func (t *trailer) set(header headers.Header) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.header == nil {
+		t.header = headers.New()
+	}
+
+	for key, values := range header {
+		t.header.SetAll(key, values)
+	}
+}
+
+func (t *trailer) get() headers.Header {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return cloneHeader(t.header)
+}
+
+func withTrailer(ctx context.Context) (context.Context, *trailer) {
+	t := &trailer{}
+
+	return context.WithValue(ctx, trailerContextKey, t), t
+}
+
+// SetTrailer adds the provided headers to the trailer of the stream that owns the context. The trailer is sent to the
+// client once the handler returns, alongside its status.
+func SetTrailer(ctx context.Context, header headers.Header) {
+	if t, ok := ctx.Value(trailerContextKey).(*trailer); ok {
+		t.set(header)
+	}
+}
+
+// Trailer returns the trailer of the stream that owns the context. On the client, the trailer is populated once the
+// server has finished handling the stream (i.e. after ReadMsg returns an error).
+func Trailer(ctx context.Context) headers.Header {
+	if t, ok := ctx.Value(trailerContextKey).(*trailer); ok {
+		return t.get()
+	}
+
+	return headers.New()
+}
+
+// HashKeyToContext attaches the key used by the ConsistentHash strategy to route streams opened using the context.
+func HashKeyToContext(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyContextKey, key)
+}
+
+// ExtractHashKey returns the key used to route streams opened using the provided context. An empty string is returned
+// when no key was provided.
+func ExtractHashKey(ctx context.Context) string {
+	key, _ := ctx.Value(hashKeyContextKey).(string)
+
+	return key
+}
+
+// SpanContextToContext attaches the span context to the context. Streams opened using the context are recorded as
+// children of the span, and handlers are given the span context of the server side of their stream.
+func SpanContextToContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey, sc)
+}
+
+// ExtractSpanContext returns the span context attached to the provided context, if any.
+func ExtractSpanContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey).(SpanContext)
+
+	return sc, ok && sc.IsValid()
+}
+
+// PeerCredToContext attaches the credentials of the process on the other end of the connection to the context.
+func PeerCredToContext(ctx context.Context, cred PeerCred) context.Context {
+	return context.WithValue(ctx, peerCredContextKey, cred)
+}
+
+// ExtractPeerCred returns the credentials of the process that opened the stream. Credentials are only available for
+// streams received over unix domain sockets on platforms that support them.
+func ExtractPeerCred(ctx context.Context) (PeerCred, bool) {
+	cred, ok := ctx.Value(peerCredContextKey).(PeerCred)
+
+	return cred, ok
+}
+
+// PeerToContext attaches information about the remote end of the connection to the context.
+func PeerToContext(ctx context.Context, peer *PeerInfo) context.Context {
+	return context.WithValue(ctx, peerContextKey, peer)
+}
+
+// Peer returns information about the client that opened the stream that owns the provided context.
+func Peer(ctx context.Context) (*PeerInfo, bool) {
+	peer, ok := ctx.Value(peerContextKey).(*PeerInfo)
+
+	return peer, ok && peer != nil
+}
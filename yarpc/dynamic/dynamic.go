@@ -0,0 +1,190 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package dynamic invokes arbitrary yarpc methods without generated stubs. Messages are read and written as JSON, making
+// it possible to call a service from tools like the yarpc command line client.
+//
+//	err := dynamic.Call(ctx, cc, "/echo.Echo/Echo", strings.NewReader(`{"Text": "hello"}`), os.Stdout)
+package dynamic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"go.pitz.tech/lib/yarpc"
+	"go.pitz.tech/lib/yarpc/reflection"
+)
+
+// Call invokes the method, sending each JSON value read from in as a message and writing each message received as a
+// line of JSON to out. Once in is exhausted, the server is told that no more messages will be sent. This allows the
+// same function to be used for unary and streaming methods. The returned error carries the status the call completed
+// with.
+func Call(ctx context.Context, cc *yarpc.ClientConn, method string, in io.Reader, out io.Writer) error {
+	stream, err := cc.OpenStream(ctx, method)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	sendErr := make(chan error, 1)
+
+	go func() {
+		if err := send(stream, in); err != nil {
+			sendErr <- err
+			_ = stream.Close()
+		}
+	}()
+
+	encoder := json.NewEncoder(out)
+
+	for {
+		var msg interface{}
+
+		if err = stream.ReadMsg(&msg); err != nil {
+			// messages that could not be parsed end the call early, which is more useful to report
+			select {
+			case err = <-sendErr:
+			default:
+			}
+
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		if err = encoder.Encode(toJSON(msg)); err != nil {
+			return err
+		}
+	}
+}
+
+// send writes each of the JSON values read from in to the stream, followed by the status marking the end of the
+// messages sent by the client. Only failures to parse the messages are returned. Failures to write them are reported
+// when reading from the stream.
+func send(stream yarpc.Stream, in io.Reader) error {
+	decoder := json.NewDecoder(in)
+	decoder.UseNumber()
+
+	for {
+		var msg interface{}
+
+		err := decoder.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return yarpc.Errorf(yarpc.CodeInvalidArgument, "failed to parse message: %v", err)
+		}
+
+		if err = stream.WriteMsg(fromJSON(msg)); err != nil {
+			return nil
+		}
+	}
+
+	_ = stream.CloseSend()
+
+	return nil
+}
+
+// fromJSON converts the numbers found in a decoded JSON value into integers where possible, so they can be decoded into
+// integer fields by encodings like msgpack.
+func fromJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+
+		f, _ := v.Float64()
+
+		return f
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = fromJSON(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = fromJSON(elem)
+		}
+	}
+
+	return value
+}
+
+// toJSON converts maps with non-string keys, as produced by some decoders, into values that can be written as JSON.
+func toJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			converted[fmt.Sprint(key)] = toJSON(elem)
+		}
+
+		return converted
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = toJSON(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = toJSON(elem)
+		}
+	}
+
+	return value
+}
+
+// Methods lists the methods exposed by the server using the reflection service. The boolean result reports whether the
+// server provides the reflection service.
+func Methods(ctx context.Context, cc *yarpc.ClientConn) ([]string, bool, error) {
+	resp, err := reflection.NewReflectionClient(cc).ListMethods(ctx, &reflection.ListMethodsRequest{})
+
+	switch {
+	case errors.Is(err, &yarpc.Error{Code: yarpc.CodeNotFound}), errors.Is(err, &yarpc.Error{Code: yarpc.CodeUnimplemented}):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	}
+
+	methods := resp.Methods
+	sort.Strings(methods)
+
+	return methods, true, nil
+}
+
+// CheckMethod verifies the server exposes the method when the server provides the reflection service. A not found error
+// listing the available methods is returned when it does not.
+func CheckMethod(ctx context.Context, cc *yarpc.ClientConn, method string) error {
+	methods, ok, err := Methods(ctx, cc)
+	if err != nil || !ok {
+		return err
+	}
+
+	for _, m := range methods {
+		if m == method {
+			return nil
+		}
+	}
+
+	return yarpc.Errorf(yarpc.CodeNotFound, "method %q not found, expected one of: %s", method, strings.Join(methods, ", "))
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dynamic_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/encoding"
+	"go.pitz.tech/lib/yarpc"
+	"go.pitz.tech/lib/yarpc/dynamic"
+	"go.pitz.tech/lib/yarpc/reflection"
+)
+
+type Number struct {
+	Value int `json:"value"`
+}
+
+// startServer starts a server with a few methods of each kind, and returns a client connection to it.
+func startServer(t *testing.T, withReflection bool, opts ...yarpc.Option) *yarpc.ClientConn {
+	t.Helper()
+
+	mux := &yarpc.ServeMux{}
+
+	mux.Handle("/math/Double", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		number := Number{}
+		if err := stream.ReadMsg(&number); err != nil {
+			return err
+		}
+
+		if number.Value < 0 {
+			return yarpc.Errorf(yarpc.CodeOutOfRange, "value must not be negative")
+		}
+
+		return stream.WriteMsg(Number{Value: number.Value * 2})
+	}))
+
+	mux.Handle("/math/Count", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		number := Number{}
+		if err := stream.ReadMsg(&number); err != nil {
+			return err
+		}
+
+		for i := 1; i <= number.Value; i++ {
+			if err := stream.WriteMsg(Number{Value: i}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}))
+
+	mux.Handle("/math/Sum", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		sum := Number{}
+
+		for {
+			number := Number{}
+
+			err := stream.ReadMsg(&number)
+			if errors.Is(err, io.EOF) {
+				return stream.WriteMsg(sum)
+			} else if err != nil {
+				return err
+			}
+
+			sum.Value += number.Value
+		}
+	}))
+
+	if withReflection {
+		reflection.Register(mux)
+	}
+
+	listener := yarpc.NewMemoryListener()
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(listener, yarpc.WithEncodings(encoding.JSON))
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	return yarpc.DialMemory(context.Background(), listener, opts...)
+}
+
+func TestCall(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	testCases := []struct {
+		name     string
+		encoding *encoding.Encoding
+		method   string
+		in       string
+		out      string
+		code     yarpc.Code
+	}{
+		{"unary", encoding.MsgPack, "/math/Double", `{"Value": 21}`, "{\"Value\":42}\n", yarpc.CodeOK},
+		{"json encoding", encoding.JSON, "/math/Double", `{"value": 21}`, "{\"value\":42}\n", yarpc.CodeOK},
+		{"server stream", encoding.MsgPack, "/math/Count", `{"Value": 3}`, "{\"Value\":1}\n{\"Value\":2}\n{\"Value\":3}\n", yarpc.CodeOK},
+		{"client stream", encoding.MsgPack, "/math/Sum", "{\"Value\": 1}\n{\"Value\": 2}\n{\"Value\": 3}", "{\"Value\":6}\n", yarpc.CodeOK},
+		{"handler error", encoding.MsgPack, "/math/Double", `{"Value": -1}`, "", yarpc.CodeOutOfRange},
+		{"invalid message", encoding.MsgPack, "/math/Sum", `{"Value": `, "", yarpc.CodeInvalidArgument},
+		{"unknown method", encoding.MsgPack, "/math/Unknown", `{}`, "", yarpc.CodeNotFound},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+
+			cc := startServer(t, false, yarpc.WithEncoding(testCase.encoding))
+			out := &bytes.Buffer{}
+
+			err := dynamic.Call(ctx, cc, testCase.method, strings.NewReader(testCase.in), out)
+			if testCase.code == yarpc.CodeOK {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, &yarpc.Error{Code: testCase.code})
+			}
+
+			require.Equal(t, testCase.out, out.String())
+		})
+	}
+}
+
+func TestMethods(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	t.Run("with reflection", func(t *testing.T) {
+		t.Parallel()
+
+		cc := startServer(t, true)
+
+		methods, ok, err := dynamic.Methods(ctx, cc)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []string{"/math/Count", "/math/Double", "/math/Sum", "/yarpc.Reflection/ListMethods"}, methods)
+
+		require.NoError(t, dynamic.CheckMethod(ctx, cc, "/math/Sum"))
+
+		err = dynamic.CheckMethod(ctx, cc, "/math/Unknown")
+		require.ErrorIs(t, err, &yarpc.Error{Code: yarpc.CodeNotFound})
+		require.Contains(t, err.Error(), "expected one of: /math/Count, /math/Double")
+	})
+
+	t.Run("without reflection", func(t *testing.T) {
+		t.Parallel()
+
+		cc := startServer(t, false)
+
+		_, ok, err := dynamic.Methods(ctx, cc)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// without reflection, the server is left to report unknown methods
+		require.NoError(t, dynamic.CheckMethod(ctx, cc, "/math/Unknown"))
+	})
+}
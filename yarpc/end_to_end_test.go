@@ -17,14 +17,18 @@ package yarpc_test
 
 import (
 	"context"
+	"io"
+	"net"
 	"os"
 	"path"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/yamux"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 
+	"go.pitz.tech/lib/headers"
 	"go.pitz.tech/lib/yarpc"
 )
 
@@ -100,3 +104,266 @@ func TestEndToEnd(t *testing.T) {
 
 	require.NoError(t, group.Wait())
 }
+
+func startServer(t *testing.T, handler yarpc.Handler, opts ...yarpc.Option) (network, address string) {
+	t.Helper()
+
+	network = "unix"
+	address = path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	svr := &yarpc.Server{
+		Handler: handler,
+	}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener}, opts...)
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	return network, address
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	t.Parallel()
+
+	deadlines := make(chan time.Time, 1)
+	errs := make(chan error, 1)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		deadline, _ := stream.Context().Deadline()
+		deadlines <- deadline
+
+		<-stream.Context().Done()
+		errs <- stream.Context().Err()
+
+		return stream.Context().Err()
+	}))
+
+	network, address := startServer(t, mux)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	conn := yarpc.DialContext(ctx, network, address)
+
+	stream, err := conn.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	expected, _ := ctx.Deadline()
+	require.WithinDuration(t, expected, <-deadlines, 100*time.Millisecond)
+
+	require.ErrorIs(t, stream.ReadMsg(&Stat{}), context.DeadlineExceeded)
+	require.Error(t, <-errs)
+}
+
+func TestCancelPropagation(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{})
+	errs := make(chan error, 1)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		close(started)
+
+		select {
+		case <-stream.Context().Done():
+			errs <- stream.Context().Err()
+		case <-time.After(5 * time.Second):
+			errs <- nil
+		}
+
+		return nil
+	}))
+
+	network, address := startServer(t, mux)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := yarpc.DialContext(context.Background(), network, address)
+
+	stream, err := conn.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	<-started
+	cancel()
+
+	require.ErrorIs(t, <-errs, context.Canceled)
+	require.ErrorIs(t, stream.ReadMsg(&Stat{}), context.Canceled)
+}
+
+func TestServerCloseCancelsClient(t *testing.T) {
+	t.Parallel()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return nil
+	}))
+
+	network, address := startServer(t, mux)
+
+	ctx := context.Background()
+	conn := yarpc.DialContext(ctx, network, address)
+
+	stream, err := conn.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	select {
+	case <-stream.Context().Done():
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "client stream was not cancelled")
+	}
+
+	require.ErrorIs(t, stream.ReadMsg(&Stat{}), io.EOF)
+}
+
+func TestHeadersAndTrailers(t *testing.T) {
+	t.Parallel()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		header := headers.Extract(stream.Context())
+
+		trailer := headers.New()
+		trailer.Set("request-id", header.Get("request-id"))
+		yarpc.SetTrailer(stream.Context(), trailer)
+
+		if header.Get("authorization") == "" {
+			return yarpc.Errorf(yarpc.CodeUnauthenticated, "missing authorization")
+		}
+
+		return stream.WriteMsg(&Stat{Name: header.Get("authorization")})
+	}))
+
+	network, address := startServer(t, mux)
+
+	conn := yarpc.DialContext(context.Background(), network, address)
+
+	header := headers.New()
+	header.Set("Request-ID", "abc")
+	ctx := yarpc.OutgoingHeaderToContext(context.Background(), header)
+
+	{
+		stream, err := conn.OpenStream(ctx, method)
+		require.NoError(t, err)
+
+		require.ErrorIs(t, stream.ReadMsg(&Stat{}), &yarpc.Error{Code: yarpc.CodeUnauthenticated})
+		require.Equal(t, "abc", yarpc.Trailer(stream.Context()).Get("request-id"))
+		require.NoError(t, stream.Close())
+	}
+
+	header.Set("Authorization", "Bearer token")
+	ctx = yarpc.OutgoingHeaderToContext(context.Background(), header)
+
+	{
+		stream, err := conn.OpenStream(ctx, method)
+		require.NoError(t, err)
+
+		stat := &Stat{}
+		require.NoError(t, stream.ReadMsg(stat))
+		require.Equal(t, "Bearer token", stat.Name)
+
+		require.ErrorIs(t, stream.ReadMsg(stat), io.EOF)
+		require.Equal(t, "abc", yarpc.Trailer(stream.Context()).Get("request-id"))
+		require.NoError(t, stream.Close())
+	}
+}
+
+func TestInvokeHeaderCase(t *testing.T) {
+	t.Parallel()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return stream.WriteMsg(headers.Extract(stream.Context()).GetAll("request-id"))
+	}))
+
+	network, address := startServer(t, mux)
+
+	conn, err := net.Dial(network, address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// peers that don't use the yarpc client send the preamble and invoke frame themselves
+	_, err = conn.Write(append([]byte("yarpc\x01\x07"), "msgpack"...))
+	require.NoError(t, err)
+
+	response := make([]byte, 8)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+	require.Equal(t, "yarpc\x01\x00\x00", string(response))
+
+	session, err := yamux.Client(conn, nil)
+	require.NoError(t, err)
+	defer session.Close()
+
+	ys, err := session.OpenStream()
+	require.NoError(t, err)
+
+	stream := yarpc.Wrap(ys)
+	require.NoError(t, stream.WriteMsg(&yarpc.Invoke{
+		Method: method,
+		Header: headers.Header{"Request-ID": {"abc"}},
+	}))
+
+	var values []string
+	require.NoError(t, stream.ReadMsg(&values))
+	require.Equal(t, []string{"abc"}, values)
+}
+
+func TestServeMuxWrap(t *testing.T) {
+	t.Parallel()
+
+	serverConn, clientConn := net.Pipe()
+
+	serverSession, err := yamux.Server(serverConn, nil)
+	require.NoError(t, err)
+	defer serverSession.Close()
+
+	clientSession, err := yamux.Client(clientConn, nil)
+	require.NoError(t, err)
+	defer clientSession.Close()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		msg := ""
+		if err := stream.ReadMsg(&msg); err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(msg)
+	}))
+
+	// streams created using Wrap do not carry the method, so the mux reads it off of the stream
+	served := make(chan error, 1)
+
+	go func() {
+		stream, err := serverSession.AcceptStream()
+		if err != nil {
+			served <- err
+
+			return
+		}
+
+		served <- mux.ServeYARPC(yarpc.Wrap(stream))
+	}()
+
+	stream, err := clientSession.OpenStream()
+	require.NoError(t, err)
+
+	client := yarpc.Wrap(stream)
+	require.NoError(t, client.WriteMsg(&yarpc.Invoke{Method: method}))
+	require.NoError(t, client.WriteMsg("hello world"))
+
+	reply := ""
+	require.NoError(t, client.ReadMsg(&reply))
+	require.Equal(t, "hello world", reply)
+	require.NoError(t, <-served)
+}
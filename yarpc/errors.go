@@ -0,0 +1,164 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Code classifies the status of a call. The values mirror the codes used by gRPC so they are easy to map between
+// systems.
+type Code int
+
+const (
+	// CodeOK is returned on success.
+	CodeOK Code = iota
+	// CodeCanceled indicates the call was cancelled, typically by the caller.
+	CodeCanceled
+	// CodeUnknown indicates an error that could not be classified.
+	CodeUnknown
+	// CodeInvalidArgument indicates the caller sent an invalid request.
+	CodeInvalidArgument
+	// CodeDeadlineExceeded indicates the deadline expired before the call could complete.
+	CodeDeadlineExceeded
+	// CodeNotFound indicates a requested entity (or method) was not found.
+	CodeNotFound
+	// CodeAlreadyExists indicates the entity the caller attempted to create already exists.
+	CodeAlreadyExists
+	// CodePermissionDenied indicates the caller is not allowed to perform the call.
+	CodePermissionDenied
+	// CodeResourceExhausted indicates a resource, such as a quota or message size, has been exhausted.
+	CodeResourceExhausted
+	// CodeFailedPrecondition indicates the system is not in a state required for the call.
+	CodeFailedPrecondition
+	// CodeAborted indicates the call was aborted, typically due to a concurrency conflict.
+	CodeAborted
+	// CodeOutOfRange indicates the call was attempted past a valid range.
+	CodeOutOfRange
+	// CodeUnimplemented indicates the call is not implemented or supported.
+	CodeUnimplemented
+	// CodeInternal indicates an internal error on the server.
+	CodeInternal
+	// CodeUnavailable indicates the service is currently unavailable and the call may be retried.
+	CodeUnavailable
+	// CodeDataLoss indicates unrecoverable data loss or corruption.
+	CodeDataLoss
+	// CodeUnauthenticated indicates the caller could not be authenticated.
+	CodeUnauthenticated
+)
+
+var codeNames = map[Code]string{
+	CodeOK:                 "OK",
+	CodeCanceled:           "Canceled",
+	CodeUnknown:            "Unknown",
+	CodeInvalidArgument:    "InvalidArgument",
+	CodeDeadlineExceeded:   "DeadlineExceeded",
+	CodeNotFound:           "NotFound",
+	CodeAlreadyExists:      "AlreadyExists",
+	CodePermissionDenied:   "PermissionDenied",
+	CodeResourceExhausted:  "ResourceExhausted",
+	CodeFailedPrecondition: "FailedPrecondition",
+	CodeAborted:            "Aborted",
+	CodeOutOfRange:         "OutOfRange",
+	CodeUnimplemented:      "Unimplemented",
+	CodeInternal:           "Internal",
+	CodeUnavailable:        "Unavailable",
+	CodeDataLoss:           "DataLoss",
+	CodeUnauthenticated:    "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+
+	return "Code(" + strconv.Itoa(int(c)) + ")"
+}
+
+// Errorf returns an Error with the provided code and a formatted message.
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Error is an error that carries a status code and optional details. Handlers can return an Error to control the status
+// sent to the client, and clients receive an Error whenever the server reports a failed status.
+type Error struct {
+	Code    Code
+	Message string
+	Details map[string]string
+}
+
+func (e *Error) Error() string {
+	return e.Code.String() + ": " + e.Message
+}
+
+// Is reports whether the target is an Error with the same code. Canceled and DeadlineExceeded errors also match their
+// context counterparts, so callers can continue to check for context.DeadlineExceeded after a remote call.
+func (e *Error) Is(target error) bool {
+	switch {
+	case target == context.Canceled:
+		return e.Code == CodeCanceled
+	case target == context.DeadlineExceeded:
+		return e.Code == CodeDeadlineExceeded
+	}
+
+	other, ok := target.(*Error)
+
+	return ok && other.Code == e.Code
+}
+
+// StatusFromError returns the Error found in the provided errors chain. Context errors are translated into their
+// matching codes. The boolean result reports whether the error carried a status. When it does not, an Error with an
+// Unknown code is returned in its place. A nil error returns nil and true.
+func StatusFromError(err error) (*Error, bool) {
+	if err == nil {
+		return nil, true
+	}
+
+	yerr := &Error{}
+
+	switch {
+	case errors.As(err, &yerr):
+		return yerr, true
+	case errors.Is(err, context.Canceled):
+		return &Error{Code: CodeCanceled, Message: err.Error()}, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: CodeDeadlineExceeded, Message: err.Error()}, true
+	}
+
+	return &Error{Code: CodeUnknown, Message: err.Error()}, false
+}
+
+// toStatus converts the error returned by a handler into the Status sent to the client. Errors that do not carry a
+// status are reported as internal errors.
+func toStatus(err error) *Status {
+	yerr, ok := StatusFromError(err)
+	if !ok {
+		yerr.Code = CodeInternal
+	}
+
+	return &Status{
+		Code:    yerr.Code,
+		Message: yerr.Message,
+		Details: yerr.Details,
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+func TestStatusFromError(t *testing.T) {
+	t.Parallel()
+
+	yerr, ok := yarpc.StatusFromError(nil)
+	require.True(t, ok)
+	require.Nil(t, yerr)
+
+	yerr, ok = yarpc.StatusFromError(fmt.Errorf("wrapped: %w", yarpc.Errorf(yarpc.CodeNotFound, "missing")))
+	require.True(t, ok)
+	require.Equal(t, yarpc.CodeNotFound, yerr.Code)
+	require.Equal(t, "missing", yerr.Message)
+
+	yerr, ok = yarpc.StatusFromError(context.DeadlineExceeded)
+	require.True(t, ok)
+	require.Equal(t, yarpc.CodeDeadlineExceeded, yerr.Code)
+
+	yerr, ok = yarpc.StatusFromError(fmt.Errorf("boom"))
+	require.False(t, ok)
+	require.Equal(t, yarpc.CodeUnknown, yerr.Code)
+	require.Equal(t, "boom", yerr.Message)
+}
+
+func TestErrorCodes(t *testing.T) {
+	t.Parallel()
+
+	mux := &yarpc.ServeMux{}
+
+	mux.Handle("not-found", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return &yarpc.Error{
+			Code:    yarpc.CodeNotFound,
+			Message: "stat not found",
+			Details: map[string]string{"name": "uptime"},
+		}
+	}))
+
+	mux.Handle("internal", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return fmt.Errorf("something broke")
+	}))
+
+	mux.Handle("deadline", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return context.DeadlineExceeded
+	}))
+
+	network, address := startServer(t, mux)
+
+	ctx := context.Background()
+	conn := yarpc.DialContext(ctx, network, address)
+
+	call := func(method string) error {
+		stream, err := conn.OpenStream(ctx, method)
+		require.NoError(t, err)
+
+		defer stream.Close()
+
+		return stream.ReadMsg(&Stat{})
+	}
+
+	testCases := []struct {
+		method  string
+		code    yarpc.Code
+		message string
+		details map[string]string
+	}{
+		{"not-found", yarpc.CodeNotFound, "stat not found", map[string]string{"name": "uptime"}},
+		{"internal", yarpc.CodeInternal, "something broke", nil},
+		{"deadline", yarpc.CodeDeadlineExceeded, context.DeadlineExceeded.Error(), nil},
+		{"missing", yarpc.CodeNotFound, `method "missing" not found`, nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Log(testCase.method)
+
+		err := call(testCase.method)
+		require.Error(t, err)
+		require.ErrorIs(t, err, &yarpc.Error{Code: testCase.code})
+
+		yerr := &yarpc.Error{}
+		require.True(t, errors.As(err, &yerr))
+		require.Equal(t, testCase.message, yerr.Message)
+		require.Equal(t, testCase.details, yerr.Details)
+
+		status, ok := yarpc.StatusFromError(err)
+		require.True(t, ok)
+		require.Equal(t, testCase.code, status.Code)
+	}
+
+	require.ErrorIs(t, call("deadline"), context.DeadlineExceeded)
+}
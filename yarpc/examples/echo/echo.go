@@ -0,0 +1,97 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package echo provides an example service whose yarpc stubs are produced by yarpc-gen.
+package echo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+//go:generate go run go.pitz.tech/lib/yarpc/cmd/yarpc-gen --type EchoServer --service echo.Echo
+
+// Message is passed between the client and server.
+type Message struct {
+	Value string `json:"value,omitempty"`
+	Count int    `json:"count,omitempty"`
+}
+
+// EchoServer demonstrates each type of method supported by yarpc-gen.
+type EchoServer interface {
+	// Echo returns the message it was sent.
+	Echo(ctx context.Context, msg *Message) (*Message, error)
+	// Repeat sends the message back to the client Count times.
+	Repeat(ctx context.Context, msg *Message, send func(*Message) error) error
+	// Collect joins the values of all messages sent by the client.
+	Collect(ctx context.Context, recv func() (*Message, error)) (*Message, error)
+	// Chat echoes each message sent by the client until the client closes the stream.
+	Chat(ctx context.Context, recv func() (*Message, error), send func(*Message) error) error
+}
+
+// Server is a simple implementation of the EchoServer.
+type Server struct{}
+
+func (s *Server) Echo(ctx context.Context, msg *Message) (*Message, error) {
+	return msg, nil
+}
+
+func (s *Server) Repeat(ctx context.Context, msg *Message, send func(*Message) error) error {
+	for i := 0; i < msg.Count; i++ {
+		err := send(&Message{Value: msg.Value, Count: i + 1})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) Collect(ctx context.Context, recv func() (*Message, error)) (*Message, error) {
+	values := make([]string, 0)
+
+	for {
+		msg, err := recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		values = append(values, msg.Value)
+	}
+
+	return &Message{Value: strings.Join(values, " "), Count: len(values)}, nil
+}
+
+func (s *Server) Chat(ctx context.Context, recv func() (*Message, error), send func(*Message) error) error {
+	for {
+		msg, err := recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = send(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var _ EchoServer = &Server{}
@@ -0,0 +1,108 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package echo_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+	"go.pitz.tech/lib/yarpc/examples/echo"
+)
+
+func TestEcho(t *testing.T) {
+	t.Parallel()
+
+	network := "unix"
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	mux := &yarpc.ServeMux{}
+	echo.RegisterEchoServer(mux, &echo.Server{})
+
+	svr := &yarpc.Server{Handler: mux}
+	go func() { _ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener}) }()
+	t.Cleanup(func() { _ = svr.Shutdown() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := echo.NewEchoClient(yarpc.DialContext(ctx, network, address))
+
+	t.Run("unary", func(t *testing.T) {
+		msg, err := client.Echo(ctx, &echo.Message{Value: "hello"})
+		require.NoError(t, err)
+		require.Equal(t, "hello", msg.Value)
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		stream, err := client.Repeat(ctx, &echo.Message{Value: "hello", Count: 3})
+		require.NoError(t, err)
+		defer stream.Close()
+
+		for i := 1; i <= 3; i++ {
+			msg, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, "hello", msg.Value)
+			require.Equal(t, i, msg.Count)
+		}
+
+		_, err = stream.Recv()
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("client streaming", func(t *testing.T) {
+		stream, err := client.Collect(ctx)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		for _, value := range []string{"a", "b", "c"} {
+			require.NoError(t, stream.Send(&echo.Message{Value: value}))
+		}
+
+		msg, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		require.Equal(t, "a b c", msg.Value)
+		require.Equal(t, 3, msg.Count)
+	})
+
+	t.Run("bidi streaming", func(t *testing.T) {
+		stream, err := client.Chat(ctx)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		for _, value := range []string{"a", "b", "c"} {
+			require.NoError(t, stream.Send(&echo.Message{Value: value}))
+
+			msg, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, value, msg.Value)
+		}
+
+		require.NoError(t, stream.CloseSend())
+
+		_, err = stream.Recv()
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
@@ -0,0 +1,189 @@
+// Code generated by yarpc-gen. DO NOT EDIT.
+
+package echo
+
+import (
+	"context"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// RegisterEchoServer registers the provided EchoServer implementation with the yarpc.ServeMux to handle
+// requests.
+func RegisterEchoServer(svr *yarpc.ServeMux, impl EchoServer) {
+	svr.Handle("/echo.Echo/Echo", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		req := new(Message)
+		if err := stream.ReadMsg(req); err != nil {
+			return err
+		}
+
+		resp, err := impl.Echo(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(resp)
+	}))
+
+	svr.Handle("/echo.Echo/Repeat", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		req := new(Message)
+		if err := stream.ReadMsg(req); err != nil {
+			return err
+		}
+
+		return impl.Repeat(stream.Context(), req, func(msg *Message) error {
+			return stream.WriteMsg(msg)
+		})
+	}))
+
+	svr.Handle("/echo.Echo/Collect", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		resp, err := impl.Collect(stream.Context(), func() (*Message, error) {
+			msg := new(Message)
+			err := stream.ReadMsg(msg)
+
+			return msg, err
+		})
+		if err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(resp)
+	}))
+
+	svr.Handle("/echo.Echo/Chat", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		recv := func() (*Message, error) {
+			msg := new(Message)
+			err := stream.ReadMsg(msg)
+
+			return msg, err
+		}
+
+		send := func(msg *Message) error {
+			return stream.WriteMsg(msg)
+		}
+
+		return impl.Chat(stream.Context(), recv, send)
+	}))
+}
+
+// EchoClient is the client API for the echo.Echo service.
+type EchoClient interface {
+	Echo(ctx context.Context, req *Message) (*Message, error)
+	Repeat(ctx context.Context, req *Message) (*EchoRepeatClient, error)
+	Collect(ctx context.Context) (*EchoCollectClient, error)
+	Chat(ctx context.Context) (*EchoChatClient, error)
+}
+
+// NewEchoClient wraps the provided yarpc.ClientConn with an implementation of the EchoClient.
+func NewEchoClient(cc *yarpc.ClientConn) EchoClient {
+	return &echoClient{
+		cc: cc,
+	}
+}
+
+type echoClient struct {
+	cc *yarpc.ClientConn
+}
+
+func (c *echoClient) Echo(ctx context.Context, req *Message) (*Message, error) {
+	resp := new(Message)
+	if err := c.cc.Invoke(ctx, "/echo.Echo/Echo", req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (c *echoClient) Repeat(ctx context.Context, req *Message) (*EchoRepeatClient, error) {
+	stream, err := c.cc.OpenStream(ctx, "/echo.Echo/Repeat")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stream.WriteMsg(req); err != nil {
+		_ = stream.Close()
+
+		return nil, err
+	}
+
+	return &EchoRepeatClient{Stream: stream}, nil
+}
+
+func (c *echoClient) Collect(ctx context.Context) (*EchoCollectClient, error) {
+	stream, err := c.cc.OpenStream(ctx, "/echo.Echo/Collect")
+	if err != nil {
+		return nil, err
+	}
+
+	return &EchoCollectClient{Stream: stream}, nil
+}
+
+func (c *echoClient) Chat(ctx context.Context) (*EchoChatClient, error) {
+	stream, err := c.cc.OpenStream(ctx, "/echo.Echo/Chat")
+	if err != nil {
+		return nil, err
+	}
+
+	return &EchoChatClient{Stream: stream}, nil
+}
+
+var _ EchoClient = &echoClient{}
+
+// EchoRepeatClient is the client side of the Repeat stream.
+type EchoRepeatClient struct {
+	yarpc.Stream
+}
+
+// Recv receives the next message from the server. io.EOF is returned once the server has finished sending messages.
+func (s *EchoRepeatClient) Recv() (*Message, error) {
+	msg := new(Message)
+	if err := s.ReadMsg(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// EchoCollectClient is the client side of the Collect stream.
+type EchoCollectClient struct {
+	yarpc.Stream
+}
+
+// Send sends a message to the server.
+func (s *EchoCollectClient) Send(msg *Message) error {
+	return s.WriteMsg(msg)
+}
+
+// CloseAndRecv tells the server no more messages will be sent on the stream and waits for its response.
+func (s *EchoCollectClient) CloseAndRecv() (*Message, error) {
+	if err := s.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	msg := new(Message)
+	if err := s.ReadMsg(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// EchoChatClient is the client side of the Chat stream.
+type EchoChatClient struct {
+	yarpc.Stream
+}
+
+// Send sends a message to the server.
+func (s *EchoChatClient) Send(msg *Message) error {
+	return s.WriteMsg(msg)
+}
+
+// Recv receives the next message from the server. io.EOF is returned once the server has finished sending messages.
+func (s *EchoChatClient) Recv() (*Message, error) {
+	msg := new(Message)
+	if err := s.ReadMsg(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
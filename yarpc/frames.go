@@ -15,19 +15,36 @@
 
 package yarpc
 
-// Status reports an optional code and message along with the request.
+import (
+	"time"
+
+	"go.pitz.tech/lib/headers"
+)
+
+// Status reports an optional code and message along with the request. Details carry additional, structured information
+// about the status.
 type Status struct {
-	Code    int    `json:"code,omitempty"`
-	Message string `json:"message,omitempty"`
+	Code    Code              `json:"code,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
 }
 
-// Frame is the generalized structure passed along the wire.
+// Frame is the generalized structure passed along the wire. Each frame is prefixed with its length (as a varint) so the
+// stream can be read ahead of the handler. The body is omitted from status frames so decoding them leaves the callers
+// message untouched. A status frame with an OK code is the end-of-stream frame written by CloseSend, telling the remote
+// end that no more messages will be sent. The final frame sent by the server may also carry a trailer.
 type Frame struct {
-	Nonce  string      `json:"nonce,omitempty"`
-	Status *Status     `json:"status,omitempty"`
-	Body   interface{} `json:"body"`
+	Nonce   string         `json:"nonce,omitempty"`
+	Status  *Status        `json:"status,omitempty"`
+	Trailer headers.Header `json:"trailer,omitempty"`
+	Body    interface{}    `json:"body" msgpack:",omitempty"`
 }
 
+// Invoke is the first message sent on every stream. It tells the server which method is being called and how long the
+// caller is willing to wait for it. The timeout is sent relative to when the call was made so client and server clocks
+// do not need to agree. Headers carry additional metadata about the call, such as credentials or request IDs.
 type Invoke struct {
-	Method string `json:"method,omitempty"`
+	Method  string         `json:"method,omitempty"`
+	Timeout time.Duration  `json:"timeout,omitempty"`
+	Header  headers.Header `json:"header,omitempty"`
 }
@@ -0,0 +1,135 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package yarpcgen generates typed yarpc stubs from a Go interface describing a service. For each method, the
+// generated code registers a handler with a yarpc.ServeMux, adds a method to a typed client, and (for streaming
+// methods) declares a typed stream wrapper for the client. Methods are registered using the /<package>.<service>/Method
+// path convention.
+//
+// The kind of each method is determined by its signature:
+//
+//	Unary(ctx context.Context, req *Req) (*Resp, error)
+//	ServerStreaming(ctx context.Context, req *Req, send func(*Resp) error) error
+//	ClientStreaming(ctx context.Context, recv func() (*Req, error)) (*Resp, error)
+//	BidiStreaming(ctx context.Context, recv func() (*Req, error), send func(*Resp) error) error
+//
+// Streaming methods may also accept a yarpc.ServerStream (such as paxos.ObserverServer), or a stream type declared in
+// the same package that embeds the underlying stream and provides Recv, Send, or SendAndClose methods.
+//
+//	ServerStreaming(req *Req, stream *yarpc.ServerStream[*Req, *Resp]) error
+//	BidiStreaming(stream *yarpc.ServerStream[*Req, *Resp]) error
+//	ServerStreaming(req *Req, stream *Stream) error
+//	ClientStreaming(stream *Stream) error
+//	BidiStreaming(stream *Stream) error
+//
+// When the package already declares the client interface (<base>Client, such as paxos.ObserverClient), the generated
+// client implements it instead of declaring a new one. Streaming methods of a declared client return either a
+// yarpc.ClientStream or a stream type declared in the package, and may send the first message of a stream the server
+// reads for itself.
+//
+//	Observe(ctx context.Context, req *Req) (*yarpc.ClientStream[*Req, *Resp], error)
+package yarpcgen
+
+import (
+	"bytes"
+	_ "embed"
+	"go/format"
+	"strings"
+	"text/template"
+)
+
+//go:embed stubs.go.tmpl
+var stubs string
+
+var stubsTemplate = template.Must(template.New("stubs").Funcs(template.FuncMap{
+	// elem returns the type allocated when reading a message of the provided type.
+	"elem": func(typ string) string {
+		return strings.TrimPrefix(typ, "*")
+	},
+	// deref returns the operator needed to convert an allocated message back into the provided type.
+	"deref": func(typ string) string {
+		if strings.HasPrefix(typ, "*") {
+			return ""
+		}
+
+		return "*"
+	},
+	// zero returns the zero value of the provided type.
+	"zero": func(typ string) string {
+		for _, prefix := range []string{"*", "[]", "map[", "chan ", "func("} {
+			if strings.HasPrefix(typ, prefix) {
+				return "nil"
+			}
+		}
+
+		return "*new(" + typ + ")"
+	},
+	// lower converts the first letter of the name to lowercase so the type is unexported.
+	"lower": func(name string) string {
+		if name == "" {
+			return name
+		}
+
+		return strings.ToLower(name[:1]) + name[1:]
+	},
+}).Parse(stubs))
+
+// Config defines the options available when generating stubs.
+type Config struct {
+	// Dir is the directory of the package containing the interface.
+	Dir string `json:"dir" usage:"the directory of the package containing the interface" default:"."`
+	// Type is the name of the server interface to generate stubs for.
+	Type string `json:"type" usage:"the name of the server interface to generate stubs for" required:"true"`
+	// Service is the name the methods are registered under. Defaults to <package>.<Type> without the Server suffix.
+	Service string `json:"service" usage:"the name of the service used in method paths (defaults to <package>.<base>)"`
+	// Output is the name of the generated file, relative to Dir unless it's absolute. Defaults to <base>_yarpc.go in
+	// lowercase.
+	Output string `json:"output" usage:"the name of the generated file (defaults to <base>_yarpc.go)"`
+}
+
+// OutputFile returns the name of the file stubs are written to.
+func (c Config) OutputFile() string {
+	if c.Output != "" {
+		return c.Output
+	}
+
+	return strings.ToLower(strings.TrimSuffix(c.Type, "Server")) + "_yarpc.go"
+}
+
+// Load parses the package and describes the server interface named in the Config.
+func Load(cfg Config) (*Service, error) {
+	p, err := parse(cfg.Dir, cfg.OutputFile())
+	if err != nil {
+		return nil, err
+	}
+
+	return p.service(cfg.Type, cfg.Service)
+}
+
+// Generate returns the formatted source code containing the server registration, client, and stream wrappers for the
+// interface named in the Config.
+func Generate(cfg Config) ([]byte, error) {
+	svc, err := Load(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := stubsTemplate.Execute(buffer, svc); err != nil {
+		return nil, err
+	}
+
+	return format.Source(buffer.Bytes())
+}
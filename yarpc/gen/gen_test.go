@@ -0,0 +1,192 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpcgen_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	yarpcgen "go.pitz.tech/lib/yarpc/gen"
+)
+
+func TestGenerate(t *testing.T) {
+	t.Parallel()
+
+	cfg := yarpcgen.Config{
+		Dir:     filepath.Join("..", "examples", "echo"),
+		Type:    "EchoServer",
+		Service: "echo.Echo",
+	}
+
+	svc, err := yarpcgen.Load(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "Echo", svc.Base)
+	require.Len(t, svc.Methods, 4)
+
+	kinds := []yarpcgen.Kind{yarpcgen.Unary, yarpcgen.ServerStreaming, yarpcgen.ClientStreaming, yarpcgen.BidiStreaming}
+	for i, method := range svc.Methods {
+		require.Equal(t, kinds[i], method.Kind)
+		require.Equal(t, "*Message", method.Request)
+		require.Equal(t, "*Message", method.Response)
+	}
+
+	source, err := yarpcgen.Generate(cfg)
+	require.NoError(t, err)
+
+	// the checked in stubs should always match the output of the generator
+	expected, err := os.ReadFile(filepath.Join(cfg.Dir, cfg.OutputFile()))
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(source))
+}
+
+func TestGenerateDeclaredStream(t *testing.T) {
+	t.Parallel()
+
+	cfg := yarpcgen.Config{
+		Dir:  filepath.Join("testdata", "observer"),
+		Type: "ObserverServer",
+	}
+
+	svc, err := yarpcgen.Load(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "observer.Observer", svc.Name)
+	require.Equal(t, []yarpcgen.Method{
+		{
+			Name:        "Observe",
+			Kind:        yarpcgen.BidiStreaming,
+			Request:     "*Request",
+			Response:    "*Proposal",
+			Stream:      "ObserveServerStream",
+			StreamField: "Stream",
+
+			ClientKind:        yarpcgen.BidiStreaming,
+			ClientStreamField: "Stream",
+		},
+	}, svc.Methods)
+
+	source, err := yarpcgen.Generate(cfg)
+	require.NoError(t, err)
+	require.Contains(t, string(source), `svr.Handle("/observer.Observer/Observe"`)
+	require.Contains(t, string(source), "impl.Observe(&ObserveServerStream{Stream: stream})")
+	require.Contains(t, string(source), "Observe(ctx context.Context) (*ObserverObserveClient, error)")
+}
+
+func TestGenerateTypedStream(t *testing.T) {
+	t.Parallel()
+
+	cfg := yarpcgen.Config{
+		Dir:  filepath.Join("testdata", "observer"),
+		Type: "TypedObserverServer",
+	}
+
+	svc, err := yarpcgen.Load(cfg)
+	require.NoError(t, err)
+	require.Equal(t, []yarpcgen.Method{
+		{
+			Name:        "Observe",
+			Kind:        yarpcgen.BidiStreaming,
+			Request:     "*Request",
+			Response:    "*Proposal",
+			Stream:      "yarpc.ServerStream[*Request, *Proposal]",
+			StreamField: "Stream",
+
+			ClientKind:        yarpcgen.BidiStreaming,
+			ClientStreamField: "Stream",
+		},
+		{
+			Name:        "Tail",
+			Kind:        yarpcgen.ServerStreaming,
+			Request:     "*Request",
+			Response:    "*Proposal",
+			Stream:      "yarpc.ServerStream[*Request, *Proposal]",
+			StreamField: "Stream",
+
+			ClientKind:        yarpcgen.ServerStreaming,
+			ClientStreamField: "Stream",
+		},
+	}, svc.Methods)
+
+	source, err := yarpcgen.Generate(cfg)
+	require.NoError(t, err)
+	require.Contains(t, string(source), "impl.Observe(&yarpc.ServerStream[*Request, *Proposal]{Stream: stream})")
+	require.Contains(t, string(source), "impl.Tail(req, &yarpc.ServerStream[*Request, *Proposal]{Stream: stream})")
+}
+
+func TestGenerateDeclaredClient(t *testing.T) {
+	t.Parallel()
+
+	cfg := yarpcgen.Config{
+		Dir:  filepath.Join("testdata", "observer"),
+		Type: "WatcherServer",
+	}
+
+	svc, err := yarpcgen.Load(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "WatcherClient", svc.Client)
+	require.True(t, svc.ClientDeclared)
+	require.Len(t, svc.Methods, 2)
+
+	// the server reads the request from the stream itself, but the client sends it when opening the stream
+	watch := svc.Methods[1]
+	require.Equal(t, yarpcgen.BidiStreaming, watch.Kind)
+	require.Equal(t, yarpcgen.ServerStreaming, watch.ClientKind)
+	require.Equal(t, "*yarpc.ClientStream[*Request, *Proposal]", watch.ClientStream)
+
+	source, err := yarpcgen.Generate(cfg)
+	require.NoError(t, err)
+	require.NotContains(t, string(source), "type WatcherClient interface")
+	require.NotContains(t, string(source), "WatcherWatchClient")
+	require.Contains(t, string(source), "var _ WatcherClient = &watcherClient{}")
+	require.Contains(t, string(source), "impl.Watch(&yarpc.ServerStream[*Request, *Proposal]{Stream: stream})")
+	require.Contains(t, string(source),
+		"Watch(ctx context.Context, req *Request) (*yarpc.ClientStream[*Request, *Proposal], error)")
+	require.Contains(t, string(source), "return &yarpc.ClientStream[*Request, *Proposal]{Stream: stream}, nil")
+}
+
+func TestGenerateValueTypes(t *testing.T) {
+	t.Parallel()
+
+	source, err := yarpcgen.Generate(yarpcgen.Config{
+		Dir:     filepath.Join("testdata", "observer"),
+		Type:    "ProposerServer",
+		Service: "observer.proposer",
+	})
+	require.NoError(t, err)
+	require.Contains(t, string(source), `svr.Handle("/observer.proposer/Propose"`)
+	require.Contains(t, string(source), "impl.Propose(stream.Context(), *req)")
+	require.Contains(t, string(source), "Propose(ctx context.Context, req []byte) ([]byte, error)")
+}
+
+func TestGenerateErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join("testdata", "observer")
+
+	_, err := yarpcgen.Generate(yarpcgen.Config{Dir: dir, Type: "MissingServer"})
+	require.EqualError(t, err, "type MissingServer not found in package observer")
+
+	_, err = yarpcgen.Generate(yarpcgen.Config{Dir: dir, Type: "Request"})
+	require.EqualError(t, err, "type Request is not an interface")
+
+	_, err = yarpcgen.Generate(yarpcgen.Config{Dir: dir, Type: "InvalidServer"})
+	require.EqualError(t, err, "InvalidServer.Invalid: unsupported signature")
+
+	_, err = yarpcgen.Generate(yarpcgen.Config{Dir: dir, Type: "MismatchServer"})
+	require.EqualError(t, err, "MismatchClient.Last: signature does not match the server")
+}
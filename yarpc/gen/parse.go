@@ -0,0 +1,642 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpcgen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kind describes how messages flow between the client and server for a method.
+type Kind string
+
+const (
+	// Unary methods receive a single request and return a single response.
+	Unary Kind = "unary"
+	// ServerStreaming methods receive a single request and send any number of responses.
+	ServerStreaming Kind = "server_streaming"
+	// ClientStreaming methods receive any number of requests and return a single response.
+	ClientStreaming Kind = "client_streaming"
+	// BidiStreaming methods receive and send any number of messages.
+	BidiStreaming Kind = "bidi_streaming"
+)
+
+// Method describes a single method of the service interface.
+type Method struct {
+	Name     string
+	Kind     Kind
+	Request  string
+	Response string
+
+	// Stream is the server stream type, either declared alongside the interface or a yarpc.ServerStream instantiated
+	// with the message types. It's empty when the method uses functions to receive and send messages.
+	Stream string
+	// StreamField is the name of the field the yarpc.Stream is embedded under in the declared stream type.
+	StreamField string
+
+	// ClientKind is how the client sends messages for the method. It matches Kind unless a client interface declared
+	// in the package sends the first message of a stream the server reads for itself.
+	ClientKind Kind
+	// ClientStream is the stream type returned by a client interface declared in the package. It's empty when the
+	// generated stream wrapper is used.
+	ClientStream string
+	// ClientStreamField is the name of the field the yarpc.Stream is embedded under in the client stream type.
+	ClientStreamField string
+}
+
+// Service describes the interface stubs are generated for.
+type Service struct {
+	Package string
+	Type    string
+	Base    string
+	Name    string
+	// Client is the name of the client interface. When ClientDeclared is set, the interface already exists in the
+	// package and the generated client implements it instead of declaring a new one.
+	Client         string
+	ClientDeclared bool
+	Imports        []string
+	// ExternalImports are grouped separately from imports of the standard library.
+	ExternalImports []string
+	Methods         []Method
+}
+
+// Path returns the path the method is registered under, following the /pkg.service/Method convention.
+func (s Service) Path(method Method) string {
+	return "/" + s.Name + "/" + method.Name
+}
+
+// ClientStreamType returns the type the client returns for a streaming method.
+func (s Service) ClientStreamType(method Method) string {
+	if method.ClientStream != "" {
+		return method.ClientStream
+	}
+
+	return "*" + s.Base + method.Name + "Client"
+}
+
+type streamType struct {
+	recv     string
+	send     string
+	sendDone string
+}
+
+type pkg struct {
+	name    string
+	imports map[string]string
+	types   map[string]*ast.TypeSpec
+	streams map[string]*streamType
+}
+
+// parse loads the non-test files of the Go package in dir, skipping the file stubs are written to.
+func parse(dir, output string) (*pkg, error) {
+	fset := token.NewFileSet()
+
+	filter := func(info fs.FileInfo) bool {
+		name := info.Name()
+
+		return !strings.HasSuffix(name, "_test.go") && name != filepath.Base(output)
+	}
+
+	pkgs, err := parser.ParseDir(fset, dir, filter, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected a single package in %s, found %d", dir, len(pkgs))
+	}
+
+	p := &pkg{
+		imports: make(map[string]string),
+		types:   make(map[string]*ast.TypeSpec),
+		streams: make(map[string]*streamType),
+	}
+
+	for name, astPkg := range pkgs {
+		p.name = name
+
+		for _, file := range astPkg.Files {
+			p.load(file)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *pkg) load(file *ast.File) {
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+
+		name := path.Base(importPath)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+
+		p.imports[name] = importPath
+	}
+
+	for _, decl := range file.Decls {
+		switch decl := decl.(type) {
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				if spec, ok := spec.(*ast.TypeSpec); ok {
+					p.types[spec.Name.Name] = spec
+				}
+			}
+		case *ast.FuncDecl:
+			if decl.Recv == nil || len(decl.Recv.List) != 1 {
+				continue
+			}
+
+			receiver := decl.Recv.List[0].Type
+			if star, ok := receiver.(*ast.StarExpr); ok {
+				receiver = star.X
+			}
+
+			ident, ok := receiver.(*ast.Ident)
+			if !ok {
+				continue
+			}
+
+			stream := p.stream(ident.Name)
+			params, results := fields(decl.Type.Params), fields(decl.Type.Results)
+
+			switch {
+			case decl.Name.Name == "Recv" && len(params) == 0 && len(results) == 2:
+				stream.recv = types.ExprString(results[0])
+			case decl.Name.Name == "Send" && len(params) == 1 && len(results) == 1:
+				stream.send = types.ExprString(params[0])
+			case decl.Name.Name == "SendAndClose" && len(params) == 1 && len(results) == 1:
+				stream.sendDone = types.ExprString(params[0])
+			}
+		}
+	}
+}
+
+func (p *pkg) stream(name string) *streamType {
+	if _, ok := p.streams[name]; !ok {
+		p.streams[name] = &streamType{}
+	}
+
+	return p.streams[name]
+}
+
+// service builds the Service for the named interface.
+func (p *pkg) service(typeName, serviceName string) (*Service, error) {
+	spec, ok := p.types[typeName]
+	if !ok {
+		return nil, fmt.Errorf("type %s not found in package %s", typeName, p.name)
+	}
+
+	iface, ok := spec.Type.(*ast.InterfaceType)
+	if !ok {
+		return nil, fmt.Errorf("type %s is not an interface", typeName)
+	}
+
+	base := strings.TrimSuffix(typeName, "Server")
+	if serviceName == "" {
+		serviceName = p.name + "." + base
+	}
+
+	svc := &Service{
+		Package: p.name,
+		Type:    typeName,
+		Base:    base,
+		Name:    serviceName,
+		Client:  base + "Client",
+	}
+
+	clientMethods, err := p.clientMethods(svc.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	svc.ClientDeclared = clientMethods != nil
+
+	qualifiers := map[string]bool{"context": true}
+
+	for _, field := range iface.Methods.List {
+		fn, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			return nil, fmt.Errorf("%s: embedded interfaces are not supported", typeName)
+		}
+
+		name := field.Names[0].Name
+
+		method, err := p.method(name, fn)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", typeName, name, err)
+		}
+
+		method.ClientKind = method.Kind
+		method.ClientStreamField = "Stream"
+
+		if svc.ClientDeclared {
+			fn, ok := clientMethods[name]
+			if !ok {
+				return nil, fmt.Errorf("%s.%s: method not found in %s", typeName, name, svc.Client)
+			}
+
+			if err := p.clientMethod(method, fn); err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", svc.Client, name, err)
+			}
+		}
+
+		for _, typ := range []string{method.Request, method.Response, method.ClientStream} {
+			if typ == "" {
+				continue
+			}
+
+			expr, err := parser.ParseExpr(typ)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", typeName, name, err)
+			}
+
+			collectQualifiers(expr, qualifiers)
+		}
+
+		svc.Methods = append(svc.Methods, *method)
+	}
+
+	svc.Imports, svc.ExternalImports, err = p.resolve(qualifiers)
+	if err != nil {
+		return nil, err
+	}
+
+	return svc, nil
+}
+
+// clientMethods returns the methods of the named client interface, or nil when the package doesn't declare it.
+func (p *pkg) clientMethods(typeName string) (map[string]*ast.FuncType, error) {
+	spec, ok := p.types[typeName]
+	if !ok {
+		return nil, nil
+	}
+
+	iface, ok := spec.Type.(*ast.InterfaceType)
+	if !ok {
+		return nil, fmt.Errorf("type %s is not an interface", typeName)
+	}
+
+	methods := make(map[string]*ast.FuncType)
+
+	for _, field := range iface.Methods.List {
+		fn, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			return nil, fmt.Errorf("%s: embedded interfaces are not supported", typeName)
+		}
+
+		methods[field.Names[0].Name] = fn
+	}
+
+	return methods, nil
+}
+
+// clientMethod describes how a client interface declared in the package calls the method. Unary methods must mirror
+// the server. Streaming methods return a stream, and may accept the first message of a stream the server reads for
+// itself.
+//
+//	Unary(ctx context.Context, req *Req) (*Resp, error)
+//	ServerStreaming(ctx context.Context, req *Req) (*yarpc.ClientStream[*Req, *Resp], error)
+//	BidiStreaming(ctx context.Context) (*yarpc.ClientStream[*Req, *Resp], error)
+func (p *pkg) clientMethod(method *Method, fn *ast.FuncType) error {
+	params, results := fields(fn.Params), fields(fn.Results)
+	if len(params) == 0 || types.ExprString(params[0]) != "context.Context" || len(params) > 2 ||
+		len(results) != 2 || types.ExprString(results[1]) != "error" {
+		return fmt.Errorf("unsupported signature")
+	}
+
+	if method.Kind == Unary {
+		if len(params) != 2 || types.ExprString(params[1]) != method.Request ||
+			types.ExprString(results[0]) != method.Response {
+			return fmt.Errorf("signature does not match the server")
+		}
+
+		return nil
+	}
+
+	star, ok := results[0].(*ast.StarExpr)
+	if !ok {
+		return fmt.Errorf("stream must be a pointer to a yarpc.ClientStream or a type declared in the package")
+	}
+
+	field := "Stream"
+
+	if index, ok := star.X.(*ast.IndexListExpr); !ok || types.ExprString(index.X) != "yarpc.ClientStream" {
+		ident, ok := star.X.(*ast.Ident)
+		if !ok {
+			return fmt.Errorf("stream must be a pointer to a yarpc.ClientStream or a type declared in the package")
+		}
+
+		var err error
+		if field, err = p.streamField(ident.Name); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case len(params) == 2 && types.ExprString(params[1]) == method.Request &&
+		(method.Kind == ServerStreaming || method.Kind == BidiStreaming):
+		method.ClientKind = ServerStreaming
+	case len(params) == 1 && method.Kind != ServerStreaming:
+		method.ClientKind = method.Kind
+	default:
+		return fmt.Errorf("signature does not match the server")
+	}
+
+	method.ClientStream = types.ExprString(star)
+	method.ClientStreamField = field
+
+	return nil
+}
+
+// method classifies the method using its signature. Streaming methods either accept functions for receiving and
+// sending messages, a yarpc.ServerStream, or a stream type declared in the package with Recv, Send, and SendAndClose
+// methods.
+func (p *pkg) method(name string, fn *ast.FuncType) (*Method, error) {
+	params, results := fields(fn.Params), fields(fn.Results)
+	if len(results) == 0 || types.ExprString(results[len(results)-1]) != "error" {
+		return nil, fmt.Errorf("last result must be an error")
+	}
+
+	if len(params) > 0 && types.ExprString(params[0]) == "context.Context" {
+		return p.funcMethod(name, params[1:], results)
+	}
+
+	return p.streamMethod(name, params, results)
+}
+
+func (p *pkg) funcMethod(name string, params, results []ast.Expr) (*Method, error) {
+	method := &Method{Name: name}
+
+	var recv, send string
+
+	switch len(params) {
+	case 1:
+		if recv = recvFunc(params[0]); recv == "" {
+			method.Request = messageType(params[0])
+		}
+	case 2:
+		if recv = recvFunc(params[0]); recv == "" {
+			method.Request = messageType(params[0])
+		}
+
+		send = sendFunc(params[1])
+	}
+
+	switch {
+	case method.Request != "" && len(params) == 1 && len(results) == 2:
+		method.Kind = Unary
+		method.Response = messageType(results[0])
+	case method.Request != "" && send != "" && len(results) == 1:
+		method.Kind = ServerStreaming
+		method.Response = send
+	case recv != "" && send == "" && len(params) == 1 && len(results) == 2:
+		method.Kind = ClientStreaming
+		method.Request = recv
+		method.Response = messageType(results[0])
+	case recv != "" && send != "" && len(results) == 1:
+		method.Kind = BidiStreaming
+		method.Request = recv
+		method.Response = send
+	}
+
+	if method.Kind == "" || method.Request == "" || method.Response == "" {
+		return nil, fmt.Errorf("unsupported signature")
+	}
+
+	return method, nil
+}
+
+func (p *pkg) streamMethod(name string, params, results []ast.Expr) (*Method, error) {
+	if len(params) == 0 || len(params) > 2 || len(results) != 1 {
+		return nil, fmt.Errorf("unsupported signature")
+	}
+
+	star, ok := params[len(params)-1].(*ast.StarExpr)
+	if !ok {
+		return nil, fmt.Errorf("stream must be a pointer to a yarpc.ServerStream or a type declared in the package")
+	}
+
+	stream, field, err := p.streamType(star.X)
+	if err != nil {
+		return nil, err
+	}
+
+	method := &Method{
+		Name:        name,
+		Stream:      types.ExprString(star.X),
+		StreamField: field,
+	}
+
+	switch {
+	case len(params) == 2 && stream.send != "":
+		method.Kind = ServerStreaming
+		method.Request = messageType(params[0])
+		method.Response = stream.send
+	case len(params) == 1 && stream.recv != "" && stream.sendDone != "":
+		method.Kind = ClientStreaming
+		method.Request = stream.recv
+		method.Response = stream.sendDone
+	case len(params) == 1 && stream.recv != "" && stream.send != "":
+		method.Kind = BidiStreaming
+		method.Request = stream.recv
+		method.Response = stream.send
+	default:
+		return nil, fmt.Errorf("stream %s is missing Recv, Send, or SendAndClose methods", method.Stream)
+	}
+
+	if method.Request == "" {
+		return nil, fmt.Errorf("unsupported signature")
+	}
+
+	return method, nil
+}
+
+// streamType describes the stream and returns the name of the field the underlying stream is embedded under. A
+// yarpc.ServerStream receives messages of its first type parameter and sends messages of its second.
+func (p *pkg) streamType(expr ast.Expr) (*streamType, string, error) {
+	if index, ok := expr.(*ast.IndexListExpr); ok && types.ExprString(index.X) == "yarpc.ServerStream" &&
+		len(index.Indices) == 2 {
+		return &streamType{
+			recv: types.ExprString(index.Indices[0]),
+			send: types.ExprString(index.Indices[1]),
+		}, "Stream", nil
+	}
+
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return nil, "", fmt.Errorf("stream must be a pointer to a yarpc.ServerStream or a type declared in the package")
+	}
+
+	field, err := p.streamField(ident.Name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return p.stream(ident.Name), field, nil
+}
+
+// streamField returns the name of the field the underlying stream is embedded under.
+func (p *pkg) streamField(name string) (string, error) {
+	spec, ok := p.types[name]
+	if !ok {
+		return "", fmt.Errorf("stream type %s not found", name)
+	}
+
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		return "", fmt.Errorf("stream type %s is not a struct", name)
+	}
+
+	for _, field := range st.Fields.List {
+		if len(field.Names) > 0 {
+			continue
+		}
+
+		switch expr := field.Type.(type) {
+		case *ast.Ident:
+			return expr.Name, nil
+		case *ast.SelectorExpr:
+			return expr.Sel.Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("stream type %s must embed a stream", name)
+}
+
+// resolve maps the package qualifiers used by the interface to import specs. Imports from the standard library are
+// returned separately from external ones.
+func (p *pkg) resolve(qualifiers map[string]bool) (std, external []string, err error) {
+	names := make([]string, 0, len(qualifiers))
+	for qualifier := range qualifiers {
+		names = append(names, qualifier)
+	}
+
+	sort.Strings(names)
+
+	std = []string{strconv.Quote("context")}
+	external = []string{strconv.Quote("go.pitz.tech/lib/yarpc")}
+
+	for _, qualifier := range names {
+		if qualifier == "context" || qualifier == "yarpc" {
+			continue
+		}
+
+		importPath, ok := p.imports[qualifier]
+		if !ok {
+			return nil, nil, fmt.Errorf("unable to resolve import for %s", qualifier)
+		}
+
+		spec := strconv.Quote(importPath)
+		if path.Base(importPath) != qualifier {
+			spec = qualifier + " " + spec
+		}
+
+		if strings.Contains(strings.Split(importPath, "/")[0], ".") {
+			external = append(external, spec)
+		} else {
+			std = append(std, spec)
+		}
+	}
+
+	sort.Strings(std)
+	sort.Strings(external)
+
+	return std, external, nil
+}
+
+// fields flattens the field list so each entry has a single type.
+func fields(list *ast.FieldList) []ast.Expr {
+	if list == nil {
+		return nil
+	}
+
+	var exprs []ast.Expr
+
+	for _, field := range list.List {
+		count := len(field.Names)
+		if count == 0 {
+			count = 1
+		}
+
+		for i := 0; i < count; i++ {
+			exprs = append(exprs, field.Type)
+		}
+	}
+
+	return exprs
+}
+
+// messageType returns the type of the message, or an empty string when the expression is a function.
+func messageType(expr ast.Expr) string {
+	if _, ok := expr.(*ast.FuncType); ok {
+		return ""
+	}
+
+	return types.ExprString(expr)
+}
+
+// recvFunc returns the message type of a func() (T, error), or an empty string.
+func recvFunc(expr ast.Expr) string {
+	fn, ok := expr.(*ast.FuncType)
+	if !ok {
+		return ""
+	}
+
+	params, results := fields(fn.Params), fields(fn.Results)
+	if len(params) != 0 || len(results) != 2 || types.ExprString(results[1]) != "error" {
+		return ""
+	}
+
+	return messageType(results[0])
+}
+
+// sendFunc returns the message type of a func(T) error, or an empty string.
+func sendFunc(expr ast.Expr) string {
+	fn, ok := expr.(*ast.FuncType)
+	if !ok {
+		return ""
+	}
+
+	params, results := fields(fn.Params), fields(fn.Results)
+	if len(params) != 1 || len(results) != 1 || types.ExprString(results[0]) != "error" {
+		return ""
+	}
+
+	return messageType(params[0])
+}
+
+func collectQualifiers(node ast.Node, qualifiers map[string]bool) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		if sel, ok := node.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				qualifiers[ident.Name] = true
+			}
+		}
+
+		return true
+	})
+}
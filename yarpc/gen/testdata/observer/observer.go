@@ -0,0 +1,80 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package observer
+
+import (
+	"context"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+type Request struct {
+	ID uint64 `json:"id,omitempty"`
+}
+
+type Proposal struct {
+	ID    uint64 `json:"id,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+type ObserveServerStream struct {
+	yarpc.Stream
+}
+
+func (s *ObserveServerStream) Recv() (*Request, error) {
+	msg := &Request{}
+
+	return msg, s.ReadMsg(msg)
+}
+
+func (s *ObserveServerStream) Send(msg *Proposal) error {
+	return s.WriteMsg(msg)
+}
+
+type ObserverServer interface {
+	Observe(call *ObserveServerStream) error
+}
+
+type TypedObserverServer interface {
+	Observe(call *yarpc.ServerStream[*Request, *Proposal]) error
+	Tail(req *Request, call *yarpc.ServerStream[*Request, *Proposal]) error
+}
+
+type ProposerServer interface {
+	Propose(ctx context.Context, value []byte) ([]byte, error)
+}
+
+type InvalidServer interface {
+	Invalid(ctx context.Context) error
+}
+
+type WatcherServer interface {
+	Last(ctx context.Context, req *Request) (*Proposal, error)
+	Watch(call *yarpc.ServerStream[*Request, *Proposal]) error
+}
+
+type WatcherClient interface {
+	Last(ctx context.Context, req *Request) (*Proposal, error)
+	Watch(ctx context.Context, req *Request) (*yarpc.ClientStream[*Request, *Proposal], error)
+}
+
+type MismatchServer interface {
+	Last(ctx context.Context, req *Request) (*Proposal, error)
+}
+
+type MismatchClient interface {
+	Last(ctx context.Context, req *Proposal) (*Proposal, error)
+}
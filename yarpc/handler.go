@@ -16,7 +16,7 @@
 package yarpc
 
 import (
-	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -59,6 +59,7 @@ func (fn HandlerFunc) ServeYARPC(stream Stream) error {
 // ServeMux provides a router implementation for yarpc calls.
 type ServeMux struct {
 	once     sync.Once
+	mu       sync.RWMutex
 	handlers map[string]Handler
 }
 
@@ -71,23 +72,64 @@ func (s *ServeMux) init() {
 func (s *ServeMux) Handle(pattern string, handler Handler) {
 	s.init()
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.handlers[pattern] = handler
 }
 
-func (s *ServeMux) ServeYARPC(stream Stream) (err error) {
+// Patterns returns the sorted list of patterns registered with the ServeMux.
+func (s *ServeMux) Patterns() []string {
 	s.init()
 
-	invoke := &Invoke{}
-	err = stream.ReadMsg(invoke)
-	if err != nil {
-		return
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	patterns := make([]string, 0, len(s.handlers))
+	for pattern := range s.handlers {
+		patterns = append(patterns, pattern)
 	}
 
-	handler := s.handlers[invoke.Method]
-	if handler == nil {
-		err = fmt.Errorf("handler not found")
+	sort.Strings(patterns)
+
+	return patterns
+}
 
-		return
+// handles reports whether a handler is registered for the method.
+func (s *ServeMux) handles(method string) bool {
+	s.init()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.handlers[method]
+
+	return ok
+}
+
+// ServeYARPC dispatches the stream to the handler registered for the method being invoked. Streams served by a Server
+// carry the method on their context. Streams that were created using Wrap do not, so the Invoke message is read off of
+// the stream instead.
+func (s *ServeMux) ServeYARPC(stream Stream) error {
+	s.init()
+
+	method := Method(stream.Context())
+
+	if extractInvoke(stream.Context()) == nil {
+		invoke := &Invoke{}
+		if err := stream.ReadMsg(invoke); err != nil {
+			return err
+		}
+
+		method = invoke.Method
+	}
+
+	s.mu.RLock()
+	handler := s.handlers[method]
+	s.mu.RUnlock()
+
+	if handler == nil {
+		return Errorf(CodeNotFound, "method %q not found", method)
 	}
 
 	return handler.ServeYARPC(stream)
@@ -0,0 +1,196 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package health provides a yarpc service that reports whether a server, or the individual services it hosts, are
+// ready to receive traffic. The overall health of the server is reported using the empty service name.
+//
+//	healthServer := health.NewServer()
+//	health.RegisterHealthServer(mux, healthServer)
+//
+//	// later, when shutting down
+//	healthServer.Shutdown()
+package health
+
+import (
+	"context"
+	"sync"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+//go:generate go run go.pitz.tech/lib/yarpc/cmd/yarpc-gen --type HealthServer --service yarpc.Health
+
+// Status describes whether a service is able to handle requests.
+type Status string
+
+const (
+	// Unknown is reported when the status of a service could not be determined.
+	Unknown Status = "UNKNOWN"
+	// Serving is reported when the service is ready to handle requests.
+	Serving Status = "SERVING"
+	// NotServing is reported when the service should not receive traffic.
+	NotServing Status = "NOT_SERVING"
+	// ServiceUnknown is reported to watchers when the service has not been registered.
+	ServiceUnknown Status = "SERVICE_UNKNOWN"
+)
+
+// CheckRequest names the service whose status is being requested. An empty name refers to the server as a whole.
+type CheckRequest struct {
+	Service string `json:"service,omitempty"`
+}
+
+// CheckResponse contains the status of the requested service.
+type CheckResponse struct {
+	Status Status `json:"status,omitempty"`
+}
+
+// HealthServer describes the health service.
+type HealthServer interface {
+	// Check returns the current status of the requested service. A not found error is returned when the service is
+	// unknown.
+	Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error)
+	// Watch sends the current status of the requested service, followed by every change to its status until the call
+	// is cancelled.
+	Watch(ctx context.Context, req *CheckRequest, send func(*CheckResponse) error) error
+}
+
+// NewServer returns a Server that reports the server as a whole as serving.
+func NewServer() *Server {
+	return &Server{
+		statuses: map[string]Status{
+			"": Serving,
+		},
+		watchers: make(map[string]map[chan Status]struct{}),
+	}
+}
+
+// Server is an in-memory implementation of the HealthServer.
+type Server struct {
+	mu       sync.Mutex
+	shutdown bool
+	statuses map[string]Status
+	watchers map[string]map[chan Status]struct{}
+}
+
+// SetServingStatus updates the status of the named service and notifies any watchers. Updates are ignored once the
+// server has been shut down.
+func (s *Server) SetServingStatus(service string, status Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return
+	}
+
+	s.setServingStatus(service, status)
+}
+
+// setServingStatus requires external locking of the sync.Mutex.
+func (s *Server) setServingStatus(service string, status Status) {
+	s.statuses[service] = status
+
+	for watcher := range s.watchers[service] {
+		// only the latest status matters to watchers, so replace any status they have yet to receive
+		select {
+		case <-watcher:
+		default:
+		}
+
+		watcher <- status
+	}
+}
+
+// Shutdown marks every service as not serving and ignores future updates until Resume is called.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shutdown = true
+
+	for service := range s.statuses {
+		s.setServingStatus(service, NotServing)
+	}
+}
+
+// Resume marks every service as serving and allows the status of services to be updated again.
+func (s *Server) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shutdown = false
+
+	for service := range s.statuses {
+		s.setServingStatus(service, Serving)
+	}
+}
+
+func (s *Server) Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, ok := s.statuses[req.Service]
+	if !ok {
+		return nil, yarpc.Errorf(yarpc.CodeNotFound, "unknown service %q", req.Service)
+	}
+
+	return &CheckResponse{Status: status}, nil
+}
+
+func (s *Server) Watch(ctx context.Context, req *CheckRequest, send func(*CheckResponse) error) error {
+	watcher, cancel := s.watch(req.Service)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case status := <-watcher:
+			err := send(&CheckResponse{Status: status})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// watch registers a watcher for the service that starts with the current status of the service.
+func (s *Server) watch(service string) (chan Status, func()) {
+	watcher := make(chan Status, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, ok := s.statuses[service]
+	if !ok {
+		status = ServiceUnknown
+	}
+
+	watcher <- status
+
+	if s.watchers[service] == nil {
+		s.watchers[service] = make(map[chan Status]struct{})
+	}
+
+	s.watchers[service][watcher] = struct{}{}
+
+	return watcher, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.watchers[service], watcher)
+	}
+}
+
+var _ HealthServer = &Server{}
@@ -0,0 +1,93 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package health_test
+
+import (
+	"context"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+	"go.pitz.tech/lib/yarpc/health"
+)
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+
+	network := "unix"
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	healthServer := health.NewServer()
+
+	mux := &yarpc.ServeMux{}
+	health.RegisterHealthServer(mux, healthServer)
+
+	svr := &yarpc.Server{Handler: mux}
+	go func() { _ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener}) }()
+	t.Cleanup(func() { _ = svr.Shutdown() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := health.NewHealthClient(yarpc.DialContext(ctx, network, address))
+
+	resp, err := client.Check(ctx, &health.CheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, health.Serving, resp.Status)
+
+	_, err = client.Check(ctx, &health.CheckRequest{Service: "example"})
+	require.ErrorIs(t, err, &yarpc.Error{Code: yarpc.CodeNotFound})
+
+	watch, err := client.Watch(ctx, &health.CheckRequest{Service: "example"})
+	require.NoError(t, err)
+	defer watch.Close()
+
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, health.ServiceUnknown, resp.Status)
+
+	healthServer.SetServingStatus("example", health.Serving)
+
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, health.Serving, resp.Status)
+
+	healthServer.Shutdown()
+
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, health.NotServing, resp.Status)
+
+	// updates are ignored once shut down
+	healthServer.SetServingStatus("example", health.Serving)
+
+	resp, err = client.Check(ctx, &health.CheckRequest{Service: "example"})
+	require.NoError(t, err)
+	require.Equal(t, health.NotServing, resp.Status)
+
+	healthServer.Resume()
+
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, health.Serving, resp.Status)
+}
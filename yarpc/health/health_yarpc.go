@@ -0,0 +1,96 @@
+// Code generated by yarpc-gen. DO NOT EDIT.
+
+package health
+
+import (
+	"context"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// RegisterHealthServer registers the provided HealthServer implementation with the yarpc.ServeMux to handle
+// requests.
+func RegisterHealthServer(svr *yarpc.ServeMux, impl HealthServer) {
+	svr.Handle("/yarpc.Health/Check", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		req := new(CheckRequest)
+		if err := stream.ReadMsg(req); err != nil {
+			return err
+		}
+
+		resp, err := impl.Check(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(resp)
+	}))
+
+	svr.Handle("/yarpc.Health/Watch", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		req := new(CheckRequest)
+		if err := stream.ReadMsg(req); err != nil {
+			return err
+		}
+
+		return impl.Watch(stream.Context(), req, func(msg *CheckResponse) error {
+			return stream.WriteMsg(msg)
+		})
+	}))
+}
+
+// HealthClient is the client API for the yarpc.Health service.
+type HealthClient interface {
+	Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error)
+	Watch(ctx context.Context, req *CheckRequest) (*HealthWatchClient, error)
+}
+
+// NewHealthClient wraps the provided yarpc.ClientConn with an implementation of the HealthClient.
+func NewHealthClient(cc *yarpc.ClientConn) HealthClient {
+	return &healthClient{
+		cc: cc,
+	}
+}
+
+type healthClient struct {
+	cc *yarpc.ClientConn
+}
+
+func (c *healthClient) Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error) {
+	resp := new(CheckResponse)
+	if err := c.cc.Invoke(ctx, "/yarpc.Health/Check", req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (c *healthClient) Watch(ctx context.Context, req *CheckRequest) (*HealthWatchClient, error) {
+	stream, err := c.cc.OpenStream(ctx, "/yarpc.Health/Watch")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stream.WriteMsg(req); err != nil {
+		_ = stream.Close()
+
+		return nil, err
+	}
+
+	return &HealthWatchClient{Stream: stream}, nil
+}
+
+var _ HealthClient = &healthClient{}
+
+// HealthWatchClient is the client side of the Watch stream.
+type HealthWatchClient struct {
+	yarpc.Stream
+}
+
+// Recv receives the next message from the server. io.EOF is returned once the server has finished sending messages.
+func (s *HealthWatchClient) Recv() (*CheckResponse, error) {
+	msg := new(CheckResponse)
+	if err := s.ReadMsg(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
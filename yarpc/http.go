@@ -0,0 +1,393 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// UpgradeProtocol is the protocol named in the Upgrade header when a yarpc session is started using an HTTP/1.1
+// upgrade instead of a WebSocket.
+const UpgradeProtocol = "yarpc"
+
+// NewHTTPListener returns a Listener that accepts sessions from HTTP requests. It must be mounted on an http.Handler,
+// such as an http.ServeMux, so the server can share a port with other HTTP handlers.
+//
+//	listener := yarpc.NewHTTPListener()
+//	http.Handle("/yarpc", listener)
+//
+//	go svr.Serve(listener)
+func NewHTTPListener() *HTTPListener {
+	return &HTTPListener{
+		conns:  make(chan io.ReadWriteCloser),
+		closed: make(chan struct{}),
+	}
+}
+
+// HTTPListener upgrades HTTP requests into connections for yarpc sessions. Requests can either be WebSocket handshakes,
+// which browsers and most proxies support, or HTTP/1.1 upgrades using the UpgradeProtocol.
+type HTTPListener struct {
+	// CheckOrigin decides whether a WebSocket handshake is allowed to proceed. When nil, SameOrigin is used so pages
+	// served from other hosts cannot open sessions using the credentials of the browser. To accept every origin, set it
+	// to a function that always returns true.
+	CheckOrigin func(r *http.Request) bool
+
+	conns     chan io.ReadWriteCloser
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *HTTPListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.closed:
+		http.Error(w, "yarpc listener closed", http.StatusServiceUnavailable)
+
+		return
+	default:
+	}
+
+	switch {
+	case headerContains(r.Header, "Upgrade", "websocket"):
+		websocket.Server{
+			Handshake: l.handshake,
+			Handler:   l.serveWebSocket,
+		}.ServeHTTP(w, r)
+	case headerContains(r.Header, "Upgrade", UpgradeProtocol):
+		l.serveUpgrade(w, r)
+	default:
+		w.Header().Set("Upgrade", UpgradeProtocol)
+		http.Error(w, "yarpc requires a websocket or "+UpgradeProtocol+" upgrade", http.StatusUpgradeRequired)
+	}
+}
+
+func (l *HTTPListener) handshake(config *websocket.Config, r *http.Request) error {
+	checkOrigin := l.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+
+	if !checkOrigin(r) {
+		return fmt.Errorf("origin %q not allowed", r.Header.Get("Origin"))
+	}
+
+	return nil
+}
+
+// SameOrigin allows WebSocket handshakes whose Origin has the same host as the request. Requests without an Origin
+// header don't come from a browser, and are allowed.
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// serveWebSocket hands the connection to the server. The connection is closed once this function returns, so it blocks
+// until the session is done with it.
+func (l *HTTPListener) serveWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+
+	conn := &webSocketConn{
+		Conn:   ws,
+		closed: make(chan struct{}),
+	}
+
+	if !l.offer(conn) {
+		return
+	}
+
+	<-conn.closed
+}
+
+func (l *HTTPListener) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+
+		return
+	}
+
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + UpgradeProtocol + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+
+		return
+	}
+
+	l.offer(&bufferedConn{Conn: conn, reader: rw.Reader})
+}
+
+// offer passes the connection to Accept. False is returned when the listener was closed before the connection could
+// be accepted.
+func (l *HTTPListener) offer(conn io.ReadWriteCloser) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		_ = conn.Close()
+
+		return false
+	}
+}
+
+func (l *HTTPListener) Accept() (io.ReadWriteCloser, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *HTTPListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+var _ Listener = &HTTPListener{}
+var _ http.Handler = &HTTPListener{}
+
+// DialHTTP initializes a new client connection to a server mounted using an HTTPListener. Targets using the ws or wss
+// schemes connect using a WebSocket, while http and https targets use an HTTP/1.1 upgrade.
+func DialHTTP(ctx context.Context, target string, opts ...Option) *ClientConn {
+	c := NewClientConn(ctx).WithOptions(opts...)
+	c.Dialer = &HTTPDialer{
+		URL: target,
+		TLS: c.options.tls,
+	}
+
+	return c
+}
+
+// HTTPDialer establishes connections to servers mounted using an HTTPListener.
+type HTTPDialer struct {
+	// URL locates the listener. The ws and wss schemes connect using a WebSocket, while the http and https schemes use
+	// an HTTP/1.1 upgrade.
+	URL string
+	// Header contains additional headers sent with the request, such as credentials required by a proxy.
+	Header http.Header
+	// Origin is sent during WebSocket handshakes. It defaults to the URL of the listener.
+	Origin string
+	// TLS configures the connection for the wss and https schemes.
+	TLS *tls.Config
+}
+
+func (d *HTTPDialer) DialContext(ctx context.Context) (io.ReadWriteCloser, error) {
+	location, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	secure := false
+
+	switch location.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		secure = true
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", location.Scheme)
+	}
+
+	conn, err := d.dial(ctx, location, secure)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake is bound by the context, but the connection outlives it
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var rwc io.ReadWriteCloser
+
+	if location.Scheme == "ws" || location.Scheme == "wss" {
+		rwc, err = d.handshakeWebSocket(location, conn)
+	} else {
+		rwc, err = d.handshakeUpgrade(location, conn)
+	}
+
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return rwc, nil
+}
+
+func (d *HTTPDialer) dial(ctx context.Context, location *url.URL, secure bool) (net.Conn, error) {
+	address := location.Host
+	if location.Port() == "" {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+
+		address = net.JoinHostPort(location.Hostname(), port)
+	}
+
+	if !secure {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	}
+
+	config := d.TLS
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	return (&tls.Dialer{Config: config}).DialContext(ctx, "tcp", address)
+}
+
+func (d *HTTPDialer) handshakeWebSocket(location *url.URL, conn net.Conn) (io.ReadWriteCloser, error) {
+	origin := d.Origin
+	if origin == "" {
+		originURL := *location
+		originURL.Scheme = strings.Replace(location.Scheme, "ws", "http", 1)
+		origin = originURL.String()
+	}
+
+	config, err := websocket.NewConfig(location.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Header != nil {
+		config.Header = d.Header.Clone()
+	}
+
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.PayloadType = websocket.BinaryFrame
+
+	return ws, nil
+}
+
+func (d *HTTPDialer) handshakeUpgrade(location *url.URL, conn net.Conn) (io.ReadWriteCloser, error) {
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        location,
+		Host:       location.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+
+	if d.Header != nil {
+		req.Header = d.Header.Clone()
+	}
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", UpgradeProtocol)
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || !headerContains(resp.Header, "Upgrade", UpgradeProtocol) {
+		return nil, fmt.Errorf("failed to upgrade connection: %s", resp.Status)
+	}
+
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+var _ Dialer = &HTTPDialer{}
+
+// headerContains reports whether the comma separated values of the header contain the token, ignoring case.
+func headerContains(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, candidate := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(candidate), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// webSocketConn signals when the server is done with the WebSocket.
+type webSocketConn struct {
+	*websocket.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *webSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	return c.Conn.Close()
+}
+
+// bufferedConn reads through the buffer used during the upgrade so bytes read ahead of the handshake are not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
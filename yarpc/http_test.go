@@ -0,0 +1,181 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+func TestHTTPListener(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		msg := ""
+		if err := stream.ReadMsg(&msg); err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(strings.ToUpper(msg))
+	}))
+
+	listener := yarpc.NewHTTPListener()
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(listener)
+	}()
+
+	// the yarpc listener shares the http server with other handlers
+	httpMux := http.NewServeMux()
+	httpMux.Handle("/yarpc", listener)
+	httpMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	httpServer := httptest.NewServer(httpMux)
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(func() { _ = svr.Shutdown() })
+
+	resp, err := http.Get(httpServer.URL + "/healthz")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(httpServer.URL + "/yarpc")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+
+	for _, scheme := range []string{"ws", "http"} {
+		target := scheme + strings.TrimPrefix(httpServer.URL, "http") + "/yarpc"
+		cc := yarpc.DialHTTP(ctx, target)
+
+		for i := 0; i < 3; i++ {
+			stream, err := cc.OpenStream(ctx, method)
+			require.NoError(t, err, scheme)
+			require.NoError(t, stream.WriteMsg("hello"), scheme)
+
+			reply := ""
+			require.NoError(t, stream.ReadMsg(&reply), scheme)
+			require.Equal(t, "HELLO", reply, scheme)
+			require.NoError(t, stream.Close())
+		}
+	}
+}
+
+func TestHTTPListenerCheckOrigin(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	listener := yarpc.NewHTTPListener()
+	listener.CheckOrigin = func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "https://example.com"
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	httpServer := httptest.NewServer(listener)
+	t.Cleanup(httpServer.Close)
+
+	dialer := &yarpc.HTTPDialer{URL: "ws" + strings.TrimPrefix(httpServer.URL, "http")}
+
+	_, err := dialer.DialContext(ctx)
+	require.Error(t, err)
+
+	dialer.Origin = "https://example.com"
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := dialer.DialContext(ctx)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
+
+func TestHTTPListenerSameOrigin(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	listener := yarpc.NewHTTPListener()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	httpServer := httptest.NewServer(listener)
+	t.Cleanup(httpServer.Close)
+
+	// pages served from other hosts are rejected by default
+	dialer := &yarpc.HTTPDialer{
+		URL:    "ws" + strings.TrimPrefix(httpServer.URL, "http"),
+		Origin: "https://example.com",
+	}
+
+	_, err := dialer.DialContext(ctx)
+	require.Error(t, err)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	// the dialer defaults to the origin of the listener
+	dialer.Origin = ""
+
+	conn, err := dialer.DialContext(ctx)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
+
+func TestSameOrigin(t *testing.T) {
+	t.Parallel()
+
+	for origin, allowed := range map[string]bool{
+		"":                         true,
+		"http://yarpc.local:8080":  true,
+		"https://YARPC.local:8080": true,
+		"http://yarpc.local":       false,
+		"https://example.com":      false,
+		"://":                      false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://yarpc.local:8080/yarpc", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+
+		require.Equal(t, allowed, yarpc.SameOrigin(r), origin)
+	}
+}
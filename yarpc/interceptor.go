@@ -0,0 +1,85 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+)
+
+// ServerInterceptor wraps the invocation of a Handler on the server. Interceptors are given the name of the method being
+// invoked and can replace the stream passed to the next handler, or reject the call entirely by returning an error.
+type ServerInterceptor func(method string, stream Stream, next Handler) error
+
+// ChainServerInterceptors returns a ServerInterceptor that invokes each of the provided interceptors in order. The first
+// interceptor is the outermost one, and the last interceptor calls the handler.
+func ChainServerInterceptors(interceptors ...ServerInterceptor) ServerInterceptor {
+	return func(method string, stream Stream, next Handler) error {
+		for i := len(interceptors); i > 0; i-- {
+			interceptor := interceptors[i-1]
+			handler := next
+
+			next = HandlerFunc(func(stream Stream) error {
+				return interceptor(method, stream, handler)
+			})
+		}
+
+		return next.ServeYARPC(stream)
+	}
+}
+
+// OpenStreamFunc opens a new stream for the named method.
+type OpenStreamFunc func(ctx context.Context, method string) (Stream, error)
+
+// ClientInterceptor wraps the opening of a stream on the client. Interceptors are given the name of the method being
+// invoked and can modify the context used to open the stream, wrap the returned stream, or fail the call entirely.
+type ClientInterceptor func(ctx context.Context, method string, next OpenStreamFunc) (Stream, error)
+
+// ChainClientInterceptors returns a ClientInterceptor that invokes each of the provided interceptors in order. The first
+// interceptor is the outermost one, and the last interceptor opens the stream.
+func ChainClientInterceptors(interceptors ...ClientInterceptor) ClientInterceptor {
+	return func(ctx context.Context, method string, next OpenStreamFunc) (Stream, error) {
+		for i := len(interceptors); i > 0; i-- {
+			interceptor := interceptors[i-1]
+			open := next
+
+			next = func(ctx context.Context, method string) (Stream, error) {
+				return interceptor(ctx, method, open)
+			}
+		}
+
+		return next(ctx, method)
+	}
+}
+
+// StreamWithContext returns a Stream that reports the provided context instead of the one from the underlying stream.
+// This is useful for interceptors that need to attach information to the context before calling the next handler.
+func StreamWithContext(ctx context.Context, stream Stream) Stream {
+	return &contextStream{
+		Stream:  stream,
+		context: ctx,
+	}
+}
+
+type contextStream struct {
+	Stream
+	context context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.context
+}
+
+var _ Stream = &contextStream{}
@@ -0,0 +1,141 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/libctx"
+	"go.pitz.tech/lib/yarpc"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recorder) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, call)
+}
+
+func (r *recorder) Calls() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string{}, r.calls...)
+}
+
+func (r *recorder) server(name string) yarpc.ServerInterceptor {
+	return func(method string, stream yarpc.Stream, next yarpc.Handler) error {
+		r.record(name + ":" + method)
+
+		return next.ServeYARPC(stream)
+	}
+}
+
+func (r *recorder) client(name string) yarpc.ClientInterceptor {
+	return func(ctx context.Context, method string, next yarpc.OpenStreamFunc) (yarpc.Stream, error) {
+		r.record(name + ":" + method)
+
+		return next(ctx, method)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	t.Parallel()
+
+	const key = libctx.Key("interceptor")
+
+	server := &recorder{}
+	client := &recorder{}
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		server.record("handler:" + fmt.Sprint(stream.Context().Value(key)))
+
+		return stream.WriteMsg(&Stat{Name: "uptime"})
+	}))
+
+	network, address := startServer(t, mux,
+		yarpc.WithServerInterceptors(
+			server.server("first"),
+			func(method string, stream yarpc.Stream, next yarpc.Handler) error {
+				ctx := context.WithValue(stream.Context(), key, "wrapped")
+
+				return next.ServeYARPC(yarpc.StreamWithContext(ctx, stream))
+			},
+		),
+		yarpc.WithServerInterceptors(server.server("second")),
+	)
+
+	ctx := context.Background()
+	conn := yarpc.DialContext(ctx, network, address,
+		yarpc.WithClientInterceptors(client.client("first"), client.client("second")),
+	)
+
+	stream, err := conn.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	stat := &Stat{}
+	require.NoError(t, stream.ReadMsg(stat))
+	require.Equal(t, "uptime", stat.Name)
+	require.NoError(t, stream.Close())
+
+	require.Equal(t, []string{"first:" + method, "second:" + method}, client.Calls())
+	require.Equal(t, []string{"first:" + method, "second:" + method, "handler:wrapped"}, server.Calls())
+}
+
+func TestInterceptorsReject(t *testing.T) {
+	t.Parallel()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		return stream.WriteMsg(&Stat{Name: "uptime"})
+	}))
+
+	network, address := startServer(t, mux, yarpc.WithServerInterceptors(
+		func(method string, stream yarpc.Stream, next yarpc.Handler) error {
+			return fmt.Errorf("rejected")
+		},
+	))
+
+	ctx := context.Background()
+	conn := yarpc.DialContext(ctx, network, address)
+
+	stream, err := conn.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	err = stream.ReadMsg(&Stat{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rejected")
+
+	conn = conn.WithOptions(yarpc.WithClientInterceptors(
+		func(ctx context.Context, method string, next yarpc.OpenStreamFunc) (yarpc.Stream, error) {
+			return nil, fmt.Errorf("rejected")
+		},
+	))
+
+	_, err = conn.OpenStream(ctx, method)
+	require.Error(t, err)
+}
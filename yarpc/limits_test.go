@@ -0,0 +1,135 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"net"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// echoServer starts a server that replies to every message with a message of the requested length.
+func echoServer(t *testing.T, opts ...yarpc.Option) (network, address string) {
+	t.Helper()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		for {
+			length := 0
+			if err := stream.ReadMsg(&length); err != nil {
+				return err
+			}
+
+			if err := stream.WriteMsg(strings.Repeat("a", length)); err != nil {
+				return err
+			}
+		}
+	}))
+
+	return startServer(t, mux, opts...)
+}
+
+func TestMaxRecvMsgSize(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network, address := echoServer(t, yarpc.WithMaxRecvMsgSize(1024))
+	cc := yarpc.DialContext(ctx, network, address, yarpc.WithMaxRecvMsgSize(1024))
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	reply := ""
+	require.NoError(t, stream.WriteMsg(16))
+	require.NoError(t, stream.ReadMsg(&reply))
+	require.Len(t, reply, 16)
+
+	// replies larger than the clients limit are rejected by the client
+	require.NoError(t, stream.WriteMsg(4096))
+	require.ErrorIs(t, stream.ReadMsg(&reply), &yarpc.Error{Code: yarpc.CodeResourceExhausted})
+
+	// requests larger than the servers limit are rejected by the server
+	stream, err = cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+	require.NoError(t, stream.WriteMsg(strings.Repeat("a", 4096)))
+	require.ErrorIs(t, stream.ReadMsg(&reply), &yarpc.Error{Code: yarpc.CodeResourceExhausted})
+
+	// the server continues to serve other streams
+	stream, err = cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+	require.NoError(t, stream.WriteMsg(16))
+	require.NoError(t, stream.ReadMsg(&reply))
+	require.Len(t, reply, 16)
+}
+
+func TestMaxSendMsgSize(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network, address := echoServer(t)
+	cc := yarpc.DialContext(ctx, network, address, yarpc.WithMaxSendMsgSize(64))
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	// oversize messages are never written, so the stream remains usable
+	require.ErrorIs(t, stream.WriteMsg(strings.Repeat("a", 128)), &yarpc.Error{Code: yarpc.CodeResourceExhausted})
+
+	reply := ""
+	require.NoError(t, stream.WriteMsg(16))
+	require.NoError(t, stream.ReadMsg(&reply))
+	require.Len(t, reply, 16)
+}
+
+func TestStreamWindow(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	netListener, err := net.Listen("unix", path.Join(t.TempDir(), "yarpc.sock"))
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = netListener.Close() })
+
+	// windows smaller than the yamux minimum are rejected
+	svr := &yarpc.Server{Handler: &yarpc.ServeMux{}}
+	err = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener}, yarpc.WithStreamWindow(1024))
+	require.Error(t, err)
+
+	window := yarpc.WithStreamWindow(1 << 20)
+	network, address := echoServer(t, window, yarpc.WithMaxRecvMsgSize(8<<20))
+	cc := yarpc.DialContext(ctx, network, address, window, yarpc.WithMaxRecvMsgSize(8<<20))
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	reply := ""
+	require.NoError(t, stream.WriteMsg(4<<20))
+	require.NoError(t, stream.ReadMsg(&reply))
+	require.Len(t, reply, 4<<20)
+}
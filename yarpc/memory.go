@@ -0,0 +1,142 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+)
+
+// NewMemoryListener returns a Listener whose connections are established within the current process. It also acts as
+// the Dialer used to connect to it, allowing entire clients and servers to run in a single process without binding to
+// a port.
+//
+//	listener := yarpc.NewMemoryListener()
+//	go svr.Serve(listener)
+//
+//	conn := yarpc.DialMemory(ctx, listener)
+func NewMemoryListener() *MemoryListener {
+	return &MemoryListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		open:   make(map[*memoryConn]struct{}),
+	}
+}
+
+// MemoryListener connects clients and servers in the same process using synchronous, in-memory pipes. Closing the
+// listener closes every connection established through it, so tests tear down deterministically.
+type MemoryListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	open map[*memoryConn]struct{}
+}
+
+func (l *MemoryListener) Accept() (io.ReadWriteCloser, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// DialContext establishes a new connection to the listener. It blocks until the connection is accepted, the context
+// is done, or the listener is closed.
+func (l *MemoryListener) DialContext(ctx context.Context) (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+
+	clientConn := l.track(client)
+	serverConn := l.track(server)
+
+	select {
+	case l.conns <- serverConn:
+		return clientConn, nil
+	case <-ctx.Done():
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+
+		return nil, ctx.Err()
+	case <-l.closed:
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *MemoryListener) track(conn net.Conn) *memoryConn {
+	tracked := &memoryConn{Conn: conn, listener: l}
+
+	l.mu.Lock()
+	l.open[tracked] = struct{}{}
+	l.mu.Unlock()
+
+	return tracked
+}
+
+func (l *MemoryListener) untrack(conn *memoryConn) {
+	l.mu.Lock()
+	delete(l.open, conn)
+	l.mu.Unlock()
+}
+
+// Close stops accepting connections and closes every connection that is still open.
+func (l *MemoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	l.mu.Lock()
+	open := make([]*memoryConn, 0, len(l.open))
+	for conn := range l.open {
+		open = append(open, conn)
+	}
+	l.mu.Unlock()
+
+	for _, conn := range open {
+		_ = conn.Close()
+	}
+
+	return nil
+}
+
+var _ Listener = &MemoryListener{}
+var _ Dialer = &MemoryListener{}
+
+// memoryConn removes itself from the listener once it's closed.
+type memoryConn struct {
+	net.Conn
+	listener *MemoryListener
+}
+
+func (c *memoryConn) Close() error {
+	c.listener.untrack(c)
+
+	return c.Conn.Close()
+}
+
+// DialMemory initializes a new client connection to a server using the provided MemoryListener.
+func DialMemory(ctx context.Context, listener *MemoryListener, opts ...Option) *ClientConn {
+	c := NewClientConn(ctx).WithOptions(opts...)
+	c.Dialer = listener
+
+	return c
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+func TestMemoryListener(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	started := make(chan struct{})
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		msg := ""
+		if err := stream.ReadMsg(&msg); err != nil {
+			return err
+		}
+
+		if msg == "block" {
+			close(started)
+			<-stream.Context().Done()
+
+			return stream.Context().Err()
+		}
+
+		return stream.WriteMsg(msg)
+	}))
+
+	listener := yarpc.NewMemoryListener()
+	svr := &yarpc.Server{Handler: mux}
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- svr.Serve(listener)
+	}()
+
+	cc := yarpc.DialMemory(ctx, listener)
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+	require.NoError(t, stream.WriteMsg("hello"))
+
+	reply := ""
+	require.NoError(t, stream.ReadMsg(&reply))
+	require.Equal(t, "hello", reply)
+
+	blocked, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+	require.NoError(t, blocked.WriteMsg("block"))
+	<-started
+
+	// closing the listener tears down the server and every open connection
+	require.NoError(t, listener.Close())
+	require.Error(t, <-served)
+	require.Error(t, blocked.ReadMsg(&reply))
+
+	dialContext, dialCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer dialCancel()
+
+	_, err = listener.DialContext(dialContext)
+	require.Error(t, err)
+}
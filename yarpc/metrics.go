@@ -0,0 +1,78 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Side identifies which end of a session or stream an event was recorded on.
+type Side string
+
+const (
+	// SideClient marks events recorded by a ClientConn.
+	SideClient Side = "client"
+	// SideServer marks events recorded by a Server.
+	SideServer Side = "server"
+)
+
+// UnknownMethod is the method servers record streams under when they invoke a method that is not registered with the
+// servers ServeMux. This keeps clients from growing the number of series by invoking arbitrary methods.
+const UnknownMethod = "unknown"
+
+// Metrics receives events about the sessions and streams managed by clients and servers. Implementations must be safe
+// for concurrent use. See the metrics package for an implementation that exposes these events to Prometheus.
+//
+// Servers only record methods by name when their Handler is a ServeMux with a handler registered for the method. All
+// other streams are recorded under UnknownMethod.
+type Metrics interface {
+	// SessionOpened is called when a yamux session is established.
+	SessionOpened(side Side)
+	// SessionClosed is called once a yamux session has been closed.
+	SessionClosed(side Side)
+	// StreamStarted is called when a stream for the method is opened.
+	StreamStarted(side Side, method string)
+	// StreamFinished is called when a stream completes with the status code of the call and how long it ran for.
+	StreamFinished(side Side, method string, code Code, duration time.Duration)
+	// MessageSent is called with the encoded size of every message written to a stream.
+	MessageSent(side Side, method string, size int)
+	// MessageReceived is called with the encoded size of every message read from a stream.
+	MessageReceived(side Side, method string, size int)
+}
+
+// noopMetrics discards every event. It's used when no Metrics implementation has been configured.
+type noopMetrics struct{}
+
+func (noopMetrics) SessionOpened(side Side)                                             {}
+func (noopMetrics) SessionClosed(side Side)                                             {}
+func (noopMetrics) StreamStarted(side Side, method string)                              {}
+func (noopMetrics) StreamFinished(side Side, method string, code Code, d time.Duration) {}
+func (noopMetrics) MessageSent(side Side, method string, size int)                      {}
+func (noopMetrics) MessageReceived(side Side, method string, size int)                  {}
+
+var _ Metrics = noopMetrics{}
+
+// observeSession records the session as opened, and as closed once it shuts down.
+func observeSession(metrics Metrics, side Side, session *yamux.Session) {
+	metrics.SessionOpened(side)
+
+	go func() {
+		<-session.CloseChan()
+		metrics.SessionClosed(side)
+	}()
+}
@@ -0,0 +1,361 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package metrics provides a yarpc.Metrics implementation that exposes the sessions, streams, and messages handled by
+// clients and servers using the Prometheus text exposition format. No Prometheus client library is required. The
+// Registry can be served directly over HTTP or written to any io.Writer.
+//
+//	registry := metrics.New()
+//	http.Handle("/metrics", registry)
+//
+//	svr.Serve(listener, yarpc.WithMetrics(registry))
+//	conn := yarpc.DialContext(ctx, "tcp", "localhost:8080", yarpc.WithMetrics(registry))
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the buckets used to record stream durations.
+var DefaultDurationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// DefaultSizeBuckets are the upper bounds, in bytes, of the buckets used to record message sizes.
+var DefaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+
+// Option customizes the Registry.
+type Option func(r *Registry)
+
+// WithDurationBuckets overrides the buckets used to record stream durations.
+func WithDurationBuckets(buckets ...float64) Option {
+	return func(r *Registry) {
+		r.durationBuckets = sortedBuckets(buckets)
+	}
+}
+
+// WithSizeBuckets overrides the buckets used to record message sizes.
+func WithSizeBuckets(buckets ...float64) Option {
+	return func(r *Registry) {
+		r.sizeBuckets = sortedBuckets(buckets)
+	}
+}
+
+func sortedBuckets(buckets []float64) []float64 {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+
+	return buckets
+}
+
+// New constructs a Registry using the default buckets.
+func New(opts ...Option) *Registry {
+	r := &Registry{
+		durationBuckets: DefaultDurationBuckets,
+		sizeBuckets:     DefaultSizeBuckets,
+		sessions:        make(map[yarpc.Side]int64),
+		active:          make(map[streamKey]int64),
+		started:         make(map[streamKey]uint64),
+		handled:         make(map[handledKey]uint64),
+		durations:       make(map[streamKey]*histogram),
+		sent:            make(map[streamKey]*histogram),
+		received:        make(map[streamKey]*histogram),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+type streamKey struct {
+	side   yarpc.Side
+	method string
+}
+
+type handledKey struct {
+	streamKey
+	code yarpc.Code
+}
+
+// Registry accumulates yarpc events in memory and renders them using the Prometheus text exposition format.
+type Registry struct {
+	durationBuckets []float64
+	sizeBuckets     []float64
+
+	mu        sync.Mutex
+	sessions  map[yarpc.Side]int64
+	active    map[streamKey]int64
+	started   map[streamKey]uint64
+	handled   map[handledKey]uint64
+	durations map[streamKey]*histogram
+	sent      map[streamKey]*histogram
+	received  map[streamKey]*histogram
+}
+
+func (r *Registry) SessionOpened(side yarpc.Side) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[side]++
+}
+
+func (r *Registry) SessionClosed(side yarpc.Side) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[side]--
+}
+
+func (r *Registry) StreamStarted(side yarpc.Side, method string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := streamKey{side, method}
+	r.active[key]++
+	r.started[key]++
+}
+
+func (r *Registry) StreamFinished(side yarpc.Side, method string, code yarpc.Code, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := streamKey{side, method}
+	r.active[key]--
+	r.handled[handledKey{key, code}]++
+	observe(r.durations, key, r.durationBuckets, duration.Seconds())
+}
+
+func (r *Registry) MessageSent(side yarpc.Side, method string, size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	observe(r.sent, streamKey{side, method}, r.sizeBuckets, float64(size))
+}
+
+func (r *Registry) MessageReceived(side yarpc.Side, method string, size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	observe(r.received, streamKey{side, method}, r.sizeBuckets, float64(size))
+}
+
+// WriteTo renders every metric in the registry to the provided writer.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	out := &countingWriter{w: bufio.NewWriter(w)}
+
+	r.mu.Lock()
+
+	header(out, "yarpc_sessions_open", "gauge", "Number of yamux sessions currently open.")
+	for _, side := range sortedSides(r.sessions) {
+		sample(out, "yarpc_sessions_open", []string{"side", string(side)}, float64(r.sessions[side]))
+	}
+
+	header(out, "yarpc_streams_active", "gauge", "Number of streams currently in flight.")
+	for _, key := range sortedStreamKeys(r.active) {
+		sample(out, "yarpc_streams_active", key.labels(), float64(r.active[key]))
+	}
+
+	header(out, "yarpc_streams_started_total", "counter", "Total number of streams started.")
+	for _, key := range sortedStreamKeys(r.started) {
+		sample(out, "yarpc_streams_started_total", key.labels(), float64(r.started[key]))
+	}
+
+	header(out, "yarpc_streams_handled_total", "counter", "Total number of streams completed, by status code.")
+	for _, key := range sortedHandledKeys(r.handled) {
+		sample(out, "yarpc_streams_handled_total", key.labels(), float64(r.handled[key]))
+	}
+
+	header(out, "yarpc_stream_duration_seconds", "histogram", "Time taken for streams to complete.")
+	for _, key := range sortedStreamKeys(r.durations) {
+		r.durations[key].write(out, "yarpc_stream_duration_seconds", key.labels())
+	}
+
+	header(out, "yarpc_message_sent_bytes", "histogram", "Encoded size of the messages sent on streams.")
+	for _, key := range sortedStreamKeys(r.sent) {
+		r.sent[key].write(out, "yarpc_message_sent_bytes", key.labels())
+	}
+
+	header(out, "yarpc_message_received_bytes", "histogram", "Encoded size of the messages received on streams.")
+	for _, key := range sortedStreamKeys(r.received) {
+		r.received[key].write(out, "yarpc_message_received_bytes", key.labels())
+	}
+
+	r.mu.Unlock()
+
+	if out.err != nil {
+		return out.n, out.err
+	}
+
+	return out.n, out.w.Flush()
+}
+
+// ServeHTTP renders the registry in response to a scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = r.WriteTo(w)
+}
+
+var _ yarpc.Metrics = &Registry{}
+var _ http.Handler = &Registry{}
+
+// histogram tracks the cumulative distribution of observed values.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func observe(histograms map[streamKey]*histogram, key streamKey, buckets []float64, value float64) {
+	h, ok := histograms[key]
+	if !ok {
+		h = &histogram{
+			buckets: buckets,
+			counts:  make([]uint64, len(buckets)),
+		}
+
+		histograms[key] = h
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(out *countingWriter, name string, labelPairs []string) {
+	for i, bound := range h.buckets {
+		sample(out, name+"_bucket", append(labelPairs, "le", formatFloat(bound)), float64(h.counts[i]))
+	}
+
+	sample(out, name+"_bucket", append(labelPairs, "le", "+Inf"), float64(h.count))
+	sample(out, name+"_sum", labelPairs, h.sum)
+	sample(out, name+"_count", labelPairs, float64(h.count))
+}
+
+func (k streamKey) labels() []string {
+	return []string{"side", string(k.side), "method", k.method}
+}
+
+func (k handledKey) labels() []string {
+	return []string{"side", string(k.side), "method", k.method, "code", k.code.String()}
+}
+
+func sortedSides(values map[yarpc.Side]int64) []yarpc.Side {
+	sides := make([]yarpc.Side, 0, len(values))
+	for side := range values {
+		sides = append(sides, side)
+	}
+
+	sort.Slice(sides, func(i, j int) bool { return sides[i] < sides[j] })
+
+	return sides
+}
+
+func sortedStreamKeys[V any](values map[streamKey]V) []streamKey {
+	keys := make([]streamKey, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+
+	return keys
+}
+
+func sortedHandledKeys(values map[handledKey]uint64) []handledKey {
+	keys := make([]handledKey, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].streamKey != keys[j].streamKey {
+			return keys[i].streamKey.less(keys[j].streamKey)
+		}
+
+		return keys[i].code < keys[j].code
+	})
+
+	return keys
+}
+
+func (k streamKey) less(other streamKey) bool {
+	if k.side != other.side {
+		return k.side < other.side
+	}
+
+	return k.method < other.method
+}
+
+// countingWriter tracks the number of bytes written and the first error encountered while rendering.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) printf(format string, args ...interface{}) {
+	if c.err != nil {
+		return
+	}
+
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
+
+func header(out *countingWriter, name, kind, help string) {
+	out.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sample(out *countingWriter, name string, labelPairs []string, value float64) {
+	if len(labelPairs) == 0 {
+		out.printf("%s %s\n", name, formatFloat(value))
+
+		return
+	}
+
+	rendered := make([]string, 0, len(labelPairs)/2)
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		rendered = append(rendered, labelPairs[i]+`="`+labelEscaper.Replace(labelPairs[i+1])+`"`)
+	}
+
+	out.printf("%s{%s} %s\n", name, strings.Join(rendered, ","), formatFloat(value))
+}
+
+// labelEscaper escapes label values as required by the exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
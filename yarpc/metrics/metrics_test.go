@@ -0,0 +1,148 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+	"go.pitz.tech/lib/yarpc/metrics"
+)
+
+func render(t *testing.T, registry *metrics.Registry) string {
+	t.Helper()
+
+	buffer := &bytes.Buffer{}
+	n, err := registry.WriteTo(buffer)
+	require.NoError(t, err)
+	require.Equal(t, int64(buffer.Len()), n)
+
+	return buffer.String()
+}
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.New(metrics.WithDurationBuckets(1, 0.5), metrics.WithSizeBuckets(10))
+
+	registry.SessionOpened(yarpc.SideServer)
+	registry.StreamStarted(yarpc.SideServer, "echo.Echo")
+	registry.StreamStarted(yarpc.SideServer, `say "hi"`)
+	registry.MessageReceived(yarpc.SideServer, "echo.Echo", 8)
+	registry.MessageSent(yarpc.SideServer, "echo.Echo", 12)
+	registry.StreamFinished(yarpc.SideServer, "echo.Echo", yarpc.CodeNotFound, 750*time.Millisecond)
+
+	out := render(t, registry)
+
+	for _, line := range []string{
+		"# TYPE yarpc_sessions_open gauge",
+		`yarpc_sessions_open{side="server"} 1`,
+		`yarpc_streams_active{side="server",method="echo.Echo"} 0`,
+		`yarpc_streams_active{side="server",method="say \"hi\""} 1`,
+		`yarpc_streams_started_total{side="server",method="echo.Echo"} 1`,
+		`yarpc_streams_handled_total{side="server",method="echo.Echo",code="NotFound"} 1`,
+		`yarpc_stream_duration_seconds_bucket{side="server",method="echo.Echo",le="0.5"} 0`,
+		`yarpc_stream_duration_seconds_bucket{side="server",method="echo.Echo",le="1"} 1`,
+		`yarpc_stream_duration_seconds_bucket{side="server",method="echo.Echo",le="+Inf"} 1`,
+		`yarpc_stream_duration_seconds_sum{side="server",method="echo.Echo"} 0.75`,
+		`yarpc_stream_duration_seconds_count{side="server",method="echo.Echo"} 1`,
+		`yarpc_message_received_bytes_bucket{side="server",method="echo.Echo",le="10"} 1`,
+		`yarpc_message_sent_bytes_bucket{side="server",method="echo.Echo",le="10"} 0`,
+		`yarpc_message_sent_bytes_sum{side="server",method="echo.Echo"} 12`,
+	} {
+		require.Contains(t, out, line+"\n")
+	}
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, metrics.ContentType, recorder.Header().Get("Content-Type"))
+	require.Equal(t, out, recorder.Body.String())
+}
+
+func TestClientAndServer(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle("echo", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		msg := ""
+		if err := stream.ReadMsg(&msg); err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(msg)
+	}))
+
+	serverMetrics := metrics.New()
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener}, yarpc.WithMetrics(serverMetrics))
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	clientMetrics := metrics.New()
+	cc := yarpc.DialContext(ctx, "unix", address, yarpc.WithMetrics(clientMetrics))
+
+	stream, err := cc.OpenStream(ctx, "echo")
+	require.NoError(t, err)
+	require.NoError(t, stream.WriteMsg("hello"))
+
+	reply := ""
+	require.NoError(t, stream.ReadMsg(&reply))
+	require.Equal(t, "hello", reply)
+
+	stream, err = cc.OpenStream(ctx, "missing")
+	require.NoError(t, err)
+	require.Error(t, stream.ReadMsg(&reply))
+
+	// servers record methods that are not registered under a single label, as clients can invoke any method
+	missing := map[string]string{"server": yarpc.UnknownMethod, "client": "missing"}
+
+	for side, registry := range map[string]*metrics.Registry{"server": serverMetrics, "client": clientMetrics} {
+		require.Eventually(t, func() bool {
+			out := render(t, registry)
+
+			return strings.Contains(out, `yarpc_sessions_open{side="`+side+`"} 1`) &&
+				strings.Contains(out, `yarpc_streams_handled_total{side="`+side+`",method="echo",code="OK"} 1`) &&
+				strings.Contains(out, `yarpc_streams_handled_total{side="`+side+`",method="`+missing[side]+
+					`",code="NotFound"} 1`) &&
+				strings.Contains(out, `yarpc_message_sent_bytes_count{side="`+side+`",method="echo"} 1`) &&
+				strings.Contains(out, `yarpc_message_received_bytes_count{side="`+side+`",method="echo"} 1`)
+		}, 5*time.Second, 10*time.Millisecond, side)
+	}
+
+	require.NotContains(t, render(t, serverMetrics), `method="missing"`)
+}
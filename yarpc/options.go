@@ -18,20 +18,79 @@ package yarpc
 import (
 	"context"
 	"crypto/tls"
+	"time"
 
 	"github.com/hashicorp/yamux"
 
 	"go.pitz.tech/lib/encoding"
+	"go.pitz.tech/lib/logger"
 )
 
+// DefaultMaxRecvMsgSize is the largest message, in bytes, that clients and servers accept unless configured otherwise.
+const DefaultMaxRecvMsgSize = 4 << 20
+
 // Option defines an generic way to configure clients and servers.
 type Option func(opt *options)
 
 type options struct {
-	context  context.Context
-	yamux    *yamux.Config
-	tls      *tls.Config
-	encoding *encoding.Encoding
+	context            context.Context
+	yamux              *yamux.Config
+	tls                *tls.Config
+	encoding           *encoding.Encoding
+	encodings          []*encoding.Encoding
+	serverInterceptors []ServerInterceptor
+	clientInterceptors []ClientInterceptor
+	strategy           Strategy
+	metrics            Metrics
+	spanRecorder       SpanRecorder
+	maxRecvMsgSize     int
+	maxSendMsgSize     int
+	streamWindow       uint32
+	keepAlive          time.Duration
+	failFast           bool
+	retryPolicies      map[string]*RetryPolicy
+	hedgingPolicies    map[string]*HedgingPolicy
+	poolSize           int
+	queueSize          int
+	maxStreams         int
+	rateLimits         []*rateLimit
+}
+
+// yamuxConfig returns a copy of the yamux configuration that logs using the logger found on the provided context, with
+// the stream window and keepalive applied.
+func (o options) yamuxConfig(ctx context.Context) *yamux.Config {
+	yamuxcfg := *o.yamux
+	yamuxcfg.Logger = logger.HashiCorpStdLogger(logger.Extract(ctx))
+	yamuxcfg.LogOutput = nil
+
+	if o.streamWindow > 0 {
+		yamuxcfg.MaxStreamWindowSize = o.streamWindow
+	}
+
+	if o.keepAlive > 0 {
+		yamuxcfg.EnableKeepAlive = true
+		yamuxcfg.KeepAliveInterval = o.keepAlive
+	}
+
+	return &yamuxcfg
+}
+
+// retryPolicy returns the retry policy for the method, falling back to the policy configured for every method.
+func (o options) retryPolicy(method string) *RetryPolicy {
+	if policy, ok := o.retryPolicies[method]; ok {
+		return policy
+	}
+
+	return o.retryPolicies[""]
+}
+
+// hedgingPolicy returns the hedging policy for the method, falling back to the policy configured for every method.
+func (o options) hedgingPolicy(method string) *HedgingPolicy {
+	if policy, ok := o.hedgingPolicies[method]; ok {
+		return policy
+	}
+
+	return o.hedgingPolicies[""]
 }
 
 // WithTLS enables TLS.
@@ -70,8 +129,190 @@ func WithEncoding(encoding *encoding.Encoding) Option {
 	}
 }
 
-func withOptions(o *options) Option {
+// WithEncodings adds to the encodings a server accepts from clients, on top of the one configured using WithEncoding.
+// Each client names its encoding when it connects, allowing a single server to talk to clients using different
+// encodings, such as msgpack for services and JSON for debugging tools.
+func WithEncodings(encodings ...*encoding.Encoding) Option {
+	return func(opt *options) {
+		opt.encodings = append(opt.encodings, encodings...)
+	}
+}
+
+// WithServerInterceptors appends the provided interceptors to the chain invoked around every handler on a server.
+func WithServerInterceptors(interceptors ...ServerInterceptor) Option {
+	return func(opt *options) {
+		opt.serverInterceptors = append(opt.serverInterceptors, interceptors...)
+	}
+}
+
+// WithClientInterceptors appends the provided interceptors to the chain invoked every time a client opens a stream.
+func WithClientInterceptors(interceptors ...ClientInterceptor) Option {
+	return func(opt *options) {
+		opt.clientInterceptors = append(opt.clientInterceptors, interceptors...)
+	}
+}
+
+// WithStrategy configures how a client connection created using DialMembership or DialTargets picks the endpoint each
+// stream is opened against.
+func WithStrategy(strategy Strategy) Option {
+	return func(opt *options) {
+		if strategy != nil {
+			opt.strategy = strategy
+		}
+	}
+}
+
+// WithMetrics records the sessions, streams, and messages handled by a client or server using the provided Metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(opt *options) {
+		if metrics != nil {
+			opt.metrics = metrics
+		}
+	}
+}
+
+// WithSpanRecorder creates a span for every stream opened by a client or handled by a server, and reports them to the
+// provided SpanRecorder once they complete. Trace context is propagated to servers using the traceparent and tracestate
+// headers regardless of whether a recorder is configured.
+func WithSpanRecorder(recorder SpanRecorder) Option {
+	return func(opt *options) {
+		if recorder != nil {
+			opt.spanRecorder = recorder
+		}
+	}
+}
+
+// WithMaxRecvMsgSize limits the size of the messages, in bytes, that can be received. Larger messages are rejected
+// using their length prefix before they are read into memory, failing the stream with a resource exhausted status.
+// Defaults to DefaultMaxRecvMsgSize.
+func WithMaxRecvMsgSize(size int) Option {
+	return func(opt *options) {
+		if size > 0 {
+			opt.maxRecvMsgSize = size
+		}
+	}
+}
+
+// WithMaxSendMsgSize limits the size of the messages, in bytes, that can be sent. Attempts to send larger messages fail
+// with a resource exhausted status without writing anything to the stream. Sends are unlimited by default.
+func WithMaxSendMsgSize(size int) Option {
+	return func(opt *options) {
+		if size > 0 {
+			opt.maxSendMsgSize = size
+		}
+	}
+}
+
+// WithStreamWindow sets the size, in bytes, of the receive window given to every stream. A peer can only send this
+// much data on a stream before waiting for it to be read, bounding the memory used by each stream. It is applied on top
+// of the configuration provided using WithYamux, and must be at least 256KB.
+func WithStreamWindow(size uint32) Option {
+	return func(opt *options) {
+		opt.streamWindow = size
+	}
+}
+
+// WithKeepAlive sets how often sessions are pinged to check the other end is still responding. A session is closed
+// once a ping goes unanswered for longer than the write timeout of the yamux configuration, and clients reconnect in the
+// background. It is applied on top of the configuration provided using WithYamux.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(opt *options) {
+		if interval > 0 {
+			opt.keepAlive = interval
+		}
+	}
+}
+
+// WithFailFast fails streams with an unavailable status once an attempt to connect fails, rather than having them wait
+// for the connection to recover until their context is done. When balancing between endpoints, streams fail while every
+// endpoint is failing.
+func WithFailFast() Option {
+	return func(opt *options) {
+		opt.failFast = true
+	}
+}
+
+// WithRetryPolicy retries failed unary calls made using ClientConn.Invoke to the provided methods. When no methods are
+// provided, the policy applies to every method that does not have one of its own.
+func WithRetryPolicy(policy RetryPolicy, methods ...string) Option {
+	return func(opt *options) {
+		if opt.retryPolicies == nil {
+			opt.retryPolicies = make(map[string]*RetryPolicy)
+		}
+
+		if len(methods) == 0 {
+			methods = []string{""}
+		}
+
+		for _, method := range methods {
+			opt.retryPolicies[method] = &policy
+		}
+	}
+}
+
+// WithHedgingPolicy hedges unary calls made using ClientConn.Invoke to the provided methods. When no methods are
+// provided, the policy applies to every method that does not have one of its own. Only idempotent methods should be
+// hedged.
+func WithHedgingPolicy(policy HedgingPolicy, methods ...string) Option {
+	return func(opt *options) {
+		if opt.hedgingPolicies == nil {
+			opt.hedgingPolicies = make(map[string]*HedgingPolicy)
+		}
+
+		if len(methods) == 0 {
+			methods = []string{""}
+		}
+
+		for _, method := range methods {
+			opt.hedgingPolicies[method] = &policy
+		}
+	}
+}
+
+// WithPoolSize sets the number of handlers a server runs at once. Defaults to DefaultPoolSize.
+func WithPoolSize(size int) Option {
+	return func(opt *options) {
+		if size > 0 {
+			opt.poolSize = size
+		}
+	}
+}
+
+// WithQueueSize sets the number of streams that can wait for a handler once every handler in the pool is running.
+// Streams that arrive while the queue is full are rejected with a resource exhausted status. By default, streams are
+// rejected as soon as the pool is busy.
+func WithQueueSize(size int) Option {
+	return func(opt *options) {
+		if size > 0 {
+			opt.queueSize = size
+		}
+	}
+}
+
+// WithMaxConcurrentStreams limits the number of streams a single session can have handled at once, preventing one
+// client from consuming the entire pool. Additional streams are rejected with a resource exhausted status.
+func WithMaxConcurrentStreams(limit int) Option {
+	return func(opt *options) {
+		if limit > 0 {
+			opt.maxStreams = limit
+		}
+	}
+}
+
+// WithRateLimit limits how often the provided methods can be invoked on a server, rejecting streams over the limit
+// with a resource exhausted status. Each method is limited separately. When no methods are provided, the limit is
+// shared by every stream on the server. Multiple limits can be configured, and a stream must satisfy all of them.
+func WithRateLimit(limit RateLimit, methods ...string) Option {
+	return func(opt *options) {
+		opt.rateLimits = append(opt.rateLimits, newRateLimit(limit, false, methods))
+	}
+}
+
+// WithSubjectRateLimit behaves like WithRateLimit, but limits each authenticated subject separately. Subjects are
+// identified using the auth.UserInfo attached to the context of the stream by a server interceptor, such as the one
+// provided by the auth/yarpc package. Unauthenticated streams share a single limit.
+func WithSubjectRateLimit(limit RateLimit, methods ...string) Option {
 	return func(opt *options) {
-		*opt = *o
+		opt.rateLimits = append(opt.rateLimits, newRateLimit(limit, true, methods))
 	}
 }
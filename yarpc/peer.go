@@ -0,0 +1,98 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/url"
+)
+
+// PeerInfo describes the remote end of a connection. Handlers obtain it using Peer.
+type PeerInfo struct {
+	// Addr is the address of the peer, when known.
+	Addr net.Addr
+	// TLS contains the state of the TLS connection. It is nil when TLS is not enabled.
+	TLS *tls.ConnectionState
+}
+
+func newPeerInfo(conn io.ReadWriteCloser) *PeerInfo {
+	peer := &PeerInfo{}
+
+	if addressable, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		peer.Addr = addressable.RemoteAddr()
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		peer.TLS = &state
+	}
+
+	return peer
+}
+
+// VerifiedChains returns the certificate chains presented by the peer that were verified against the configured
+// certificate authorities. It is empty unless the server requires and verifies client certificates.
+func (p *PeerInfo) VerifiedChains() [][]*x509.Certificate {
+	if p.TLS == nil {
+		return nil
+	}
+
+	return p.TLS.VerifiedChains
+}
+
+// Certificate returns the verified leaf certificate of the peer, if it presented one.
+func (p *PeerInfo) Certificate() *x509.Certificate {
+	chains := p.VerifiedChains()
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+
+	return chains[0][0]
+}
+
+// CommonName returns the common name of the verified certificate of the peer.
+func (p *PeerInfo) CommonName() string {
+	cert := p.Certificate()
+	if cert == nil {
+		return ""
+	}
+
+	return cert.Subject.CommonName
+}
+
+// URIs returns the URI subject alternative names of the verified certificate of the peer.
+func (p *PeerInfo) URIs() []*url.URL {
+	cert := p.Certificate()
+	if cert == nil {
+		return nil
+	}
+
+	return cert.URIs
+}
+
+// SPIFFEID returns the SPIFFE ID of the peer, taken from the first URI subject alternative name using the spiffe scheme.
+func (p *PeerInfo) SPIFFEID() string {
+	for _, uri := range p.URIs() {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// issue creates a certificate signed by the parent. When the parent is nil, the certificate is self-signed and can act
+// as a certificate authority.
+func issue(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestPeer(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ca := issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+
+	spiffeID, err := url.Parse("spiffe://example.org/client")
+	require.NoError(t, err)
+
+	serverCert := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+
+	clientCert := issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		URIs:        []*url.URL{spiffeID},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	type identity struct {
+		CommonName string
+		SPIFFEID   string
+		Addr       string
+		Chains     int
+	}
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		peer, ok := yarpc.Peer(stream.Context())
+		if !ok {
+			return yarpc.Errorf(yarpc.CodeUnauthenticated, "missing peer")
+		}
+
+		return stream.WriteMsg(&identity{
+			CommonName: peer.CommonName(),
+			SPIFFEID:   peer.SPIFFEID(),
+			Addr:       peer.Addr.String(),
+			Chains:     len(peer.VerifiedChains()),
+		})
+	}))
+
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener}, yarpc.WithTLS(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		}))
+	}()
+
+	t.Cleanup(func() { _ = svr.Shutdown() })
+
+	cc := yarpc.DialContext(ctx, "tcp", netListener.Addr().String(), yarpc.WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}))
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	reply := &identity{}
+	require.NoError(t, stream.ReadMsg(reply))
+	require.Equal(t, "client", reply.CommonName)
+	require.Equal(t, "spiffe://example.org/client", reply.SPIFFEID)
+	require.NotEmpty(t, reply.Addr)
+	require.Equal(t, 1, reply.Chains)
+}
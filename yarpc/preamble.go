@@ -0,0 +1,213 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.pitz.tech/lib/encoding"
+)
+
+// handshakeTimeout bounds how long the server waits for a client to complete the TLS handshake and send its preamble.
+const handshakeTimeout = 10 * time.Second
+
+// ProtocolVersion is the version of the yarpc protocol sent in the preamble of every connection.
+const ProtocolVersion byte = 1
+
+// preambleMagic starts every preamble so unrelated protocols are rejected quickly.
+const preambleMagic = "yarpc"
+
+const (
+	preambleAccepted byte = iota
+	preambleRejected
+)
+
+// PreambleError is returned when the server refuses the protocol version or encoding requested by the client.
+type PreambleError struct {
+	Reason string
+}
+
+func (e *PreambleError) Error() string {
+	return "yarpc preamble rejected: " + e.Reason
+}
+
+// Before yamux takes over a connection, the client sends a preamble naming the protocol version and the encoding it
+// uses for messages. The server answers with whether it accepts them.
+//
+//	client: "yarpc" | version | len(encoding) | encoding
+//	server: "yarpc" | version | accepted or rejected | len(reason) | reason
+
+// writePreamble sends the clients preamble and waits for the server to accept it.
+func writePreamble(conn io.ReadWriter, enc *encoding.Encoding) error {
+	if enc.Name == "" || len(enc.Name) > 255 {
+		return fmt.Errorf("encoding name must be between 1 and 255 bytes, got %q", enc.Name)
+	}
+
+	preamble := append([]byte(preambleMagic), ProtocolVersion, byte(len(enc.Name)))
+	preamble = append(preamble, enc.Name...)
+
+	if _, err := conn.Write(preamble); err != nil {
+		return err
+	}
+
+	version, err := readPreambleHeader(conn)
+	if err != nil {
+		return err
+	}
+
+	status, reason, err := readPreambleStatus(conn)
+	if err != nil {
+		return err
+	}
+
+	if status != preambleAccepted {
+		return &PreambleError{Reason: reason}
+	}
+
+	if version != ProtocolVersion {
+		return &PreambleError{Reason: fmt.Sprintf("unsupported protocol version %d", version)}
+	}
+
+	return nil
+}
+
+// readPreamble reads the clients preamble and responds with whether the server accepts it. The encoding requested by
+// the client is returned when it's one of the supported encodings.
+func readPreamble(conn io.ReadWriter, supported []*encoding.Encoding) (*encoding.Encoding, error) {
+	version, err := readPreambleHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := readPreambleString(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if version != ProtocolVersion {
+		return nil, rejectPreamble(conn, fmt.Sprintf("unsupported protocol version %d", version))
+	}
+
+	names := make([]string, 0, len(supported))
+
+	for _, enc := range supported {
+		if enc.Name == name {
+			return enc, acceptPreamble(conn)
+		}
+
+		names = append(names, enc.Name)
+	}
+
+	return nil, rejectPreamble(conn, fmt.Sprintf("unsupported encoding %q, expected one of: %s", name, strings.Join(names, ", ")))
+}
+
+func acceptPreamble(conn io.Writer) error {
+	_, err := conn.Write(append([]byte(preambleMagic), ProtocolVersion, preambleAccepted, 0))
+
+	return err
+}
+
+func rejectPreamble(conn io.Writer, reason string) error {
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+
+	response := append([]byte(preambleMagic), ProtocolVersion, preambleRejected, byte(len(reason)))
+	response = append(response, reason...)
+
+	if _, err := conn.Write(response); err != nil {
+		return err
+	}
+
+	return &PreambleError{Reason: reason}
+}
+
+// readPreambleHeader verifies the magic prefix of a preamble and returns the protocol version that follows it.
+func readPreambleHeader(r io.Reader) (byte, error) {
+	header := make([]byte, len(preambleMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	if string(header[:len(preambleMagic)]) != preambleMagic {
+		return 0, fmt.Errorf("connection did not start with a yarpc preamble")
+	}
+
+	return header[len(preambleMagic)], nil
+}
+
+func readPreambleStatus(r io.Reader) (byte, string, error) {
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(r, status); err != nil {
+		return 0, "", err
+	}
+
+	reason, err := readPreambleString(r)
+
+	return status[0], reason, err
+}
+
+func readPreambleString(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+
+	value := make([]byte, length[0])
+	if _, err := io.ReadFull(r, value); err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+// handshake runs the provided function with a deadline applied to connections that support them.
+func handshake(conn io.ReadWriteCloser, deadline time.Time, fn func() error) error {
+	deadliner, ok := conn.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		return fn()
+	}
+
+	_ = deadliner.SetDeadline(deadline)
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	return deadliner.SetDeadline(time.Time{})
+}
+
+// negotiate sends the preamble for the encoding over a newly dialed connection. The connection is closed when the
+// server does not accept it.
+func negotiate(ctx context.Context, conn io.ReadWriteCloser, enc *encoding.Encoding) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+
+	err := handshake(conn, deadline, func() error {
+		return writePreamble(conn, enc)
+	})
+	if err != nil {
+		_ = conn.Close()
+	}
+
+	return err
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/encoding"
+	"go.pitz.tech/lib/yarpc"
+)
+
+func TestEncodingNegotiation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		stat := &Stat{}
+		if err := stream.ReadMsg(stat); err != nil {
+			return err
+		}
+
+		stat.Value *= 2
+
+		return stream.WriteMsg(stat)
+	}))
+
+	network, address := startServer(t, mux, yarpc.WithEncodings(encoding.JSON))
+
+	for _, enc := range []*encoding.Encoding{encoding.MsgPack, encoding.JSON} {
+		cc := yarpc.DialContext(ctx, network, address, yarpc.WithEncoding(enc))
+
+		stream, err := cc.OpenStream(ctx, method)
+		require.NoError(t, err, enc.Name)
+		require.NoError(t, stream.WriteMsg(&Stat{Name: enc.Name, Value: 1.5}), enc.Name)
+
+		stat := &Stat{}
+		require.NoError(t, stream.ReadMsg(stat), enc.Name)
+		require.Equal(t, &Stat{Name: enc.Name, Value: 3}, stat)
+	}
+
+	// unsupported encodings are refused without retrying
+	cc := yarpc.DialContext(ctx, network, address, yarpc.WithEncoding(encoding.YAML))
+
+	_, err := cc.OpenStream(ctx, method)
+	require.ErrorAs(t, err, new(*yarpc.PreambleError))
+	require.Contains(t, err.Error(), `unsupported encoding "yaml", expected one of: msgpack, json`)
+	require.NoError(t, ctx.Err())
+}
+
+func TestPreambleRequired(t *testing.T) {
+	t.Parallel()
+
+	network, address := startServer(t, &yarpc.ServeMux{})
+
+	conn, err := net.Dial(network, address)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	// connections that do not start with a preamble are closed
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	// the server may reset the connection as the request was never read
+	_, err = io.ReadAll(conn)
+	if err != nil {
+		netErr, ok := err.(net.Error)
+		require.False(t, ok && netErr.Timeout(), "connection was left open")
+	}
+}
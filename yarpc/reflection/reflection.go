@@ -0,0 +1,60 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package reflection provides a yarpc service that lists the methods exposed by a server.
+//
+//	reflection.Register(mux)
+package reflection
+
+import (
+	"context"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+//go:generate go run go.pitz.tech/lib/yarpc/cmd/yarpc-gen --type ReflectionServer --service yarpc.Reflection
+
+// ListMethodsRequest requests the methods exposed by the server.
+type ListMethodsRequest struct{}
+
+// ListMethodsResponse contains the sorted list of methods exposed by the server.
+type ListMethodsResponse struct {
+	Methods []string `json:"methods,omitempty"`
+}
+
+// ReflectionServer describes the reflection service.
+type ReflectionServer interface {
+	// ListMethods returns the methods exposed by the server.
+	ListMethods(ctx context.Context, req *ListMethodsRequest) (*ListMethodsResponse, error)
+}
+
+// Register adds the reflection service to the provided ServeMux. The methods of the reflection service are included in
+// the list of methods it returns.
+func Register(mux *yarpc.ServeMux) {
+	RegisterReflectionServer(mux, &Server{Mux: mux})
+}
+
+// Server implements the ReflectionServer by listing the patterns registered with a ServeMux.
+type Server struct {
+	Mux *yarpc.ServeMux
+}
+
+func (s *Server) ListMethods(ctx context.Context, req *ListMethodsRequest) (*ListMethodsResponse, error) {
+	return &ListMethodsResponse{
+		Methods: s.Mux.Patterns(),
+	}, nil
+}
+
+var _ ReflectionServer = &Server{}
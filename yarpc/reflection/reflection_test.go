@@ -0,0 +1,63 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package reflection_test
+
+import (
+	"context"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+	"go.pitz.tech/lib/yarpc/health"
+	"go.pitz.tech/lib/yarpc/reflection"
+)
+
+func TestReflection(t *testing.T) {
+	t.Parallel()
+
+	network := "unix"
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle("/example.Service/Method", yarpc.HandlerFunc(func(stream yarpc.Stream) error { return nil }))
+	health.RegisterHealthServer(mux, health.NewServer())
+	reflection.Register(mux)
+
+	svr := &yarpc.Server{Handler: mux}
+	go func() { _ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener}) }()
+	t.Cleanup(func() { _ = svr.Shutdown() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := reflection.NewReflectionClient(yarpc.DialContext(ctx, network, address))
+
+	resp, err := client.ListMethods(ctx, &reflection.ListMethodsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"/example.Service/Method",
+		"/yarpc.Health/Check",
+		"/yarpc.Health/Watch",
+		"/yarpc.Reflection/ListMethods",
+	}, resp.Methods)
+}
@@ -0,0 +1,54 @@
+// Code generated by yarpc-gen. DO NOT EDIT.
+
+package reflection
+
+import (
+	"context"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// RegisterReflectionServer registers the provided ReflectionServer implementation with the yarpc.ServeMux to handle
+// requests.
+func RegisterReflectionServer(svr *yarpc.ServeMux, impl ReflectionServer) {
+	svr.Handle("/yarpc.Reflection/ListMethods", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		req := new(ListMethodsRequest)
+		if err := stream.ReadMsg(req); err != nil {
+			return err
+		}
+
+		resp, err := impl.ListMethods(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(resp)
+	}))
+}
+
+// ReflectionClient is the client API for the yarpc.Reflection service.
+type ReflectionClient interface {
+	ListMethods(ctx context.Context, req *ListMethodsRequest) (*ListMethodsResponse, error)
+}
+
+// NewReflectionClient wraps the provided yarpc.ClientConn with an implementation of the ReflectionClient.
+func NewReflectionClient(cc *yarpc.ClientConn) ReflectionClient {
+	return &reflectionClient{
+		cc: cc,
+	}
+}
+
+type reflectionClient struct {
+	cc *yarpc.ClientConn
+}
+
+func (c *reflectionClient) ListMethods(ctx context.Context, req *ListMethodsRequest) (*ListMethodsResponse, error) {
+	resp := new(ListMethodsResponse)
+	if err := c.cc.Invoke(ctx, "/yarpc.Reflection/ListMethods", req, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+var _ ReflectionClient = &reflectionClient{}
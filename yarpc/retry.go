@@ -0,0 +1,215 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// RetryPolicy describes how failed unary calls to a method are retried. Calls are only retried when they fail with one
+// of the retryable codes. Streams that fail because their session was torn down report CodeUnavailable, and are retried
+// on a new session.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a call is attempted, including the first. Calls are not retried when this is
+	// less than 2.
+	MaxAttempts int `json:"max_attempts"`
+	// InitialBackoff is how long to wait before the first retry. Defaults to 100ms.
+	InitialBackoff time.Duration `json:"initial_backoff"`
+	// MaxBackoff caps how long to wait between any two attempts. Defaults to 5s.
+	MaxBackoff time.Duration `json:"max_backoff"`
+	// BackoffMultiplier grows the time waited after each attempt. Defaults to 2.
+	BackoffMultiplier float64 `json:"backoff_multiplier"`
+	// RetryableCodes are the codes a call can fail with and still be retried.
+	RetryableCodes []Code `json:"retryable_codes"`
+	// Budget bounds the time spent on a call across all attempts, including the time spent waiting between them. The
+	// call is bounded only by its context when zero.
+	Budget time.Duration `json:"budget"`
+}
+
+func (p *RetryPolicy) backOff() backoff.BackOff {
+	exponential := backoff.NewExponentialBackOff()
+	exponential.InitialInterval = 100 * time.Millisecond
+	exponential.MaxInterval = 5 * time.Second
+	exponential.Multiplier = 2
+	exponential.MaxElapsedTime = 0
+
+	if p.InitialBackoff > 0 {
+		exponential.InitialInterval = p.InitialBackoff
+	}
+
+	if p.MaxBackoff > 0 {
+		exponential.MaxInterval = p.MaxBackoff
+	}
+
+	if p.BackoffMultiplier > 0 {
+		exponential.Multiplier = p.BackoffMultiplier
+	}
+
+	exponential.Reset()
+
+	retries := 0
+	if p.MaxAttempts > 1 {
+		retries = p.MaxAttempts - 1
+	}
+
+	return backoff.WithMaxRetries(exponential, uint64(retries))
+}
+
+// HedgingPolicy describes how unary calls to a method are hedged. Rather than waiting for a call to fail, another
+// attempt is sent whenever the outstanding attempts have not responded within the delay. The first successful
+// response is used, and the remaining attempts are cancelled. Since the server may handle several attempts of the same
+// call, hedging should only be used for idempotent methods.
+type HedgingPolicy struct {
+	// MaxAttempts is the number of times a call is attempted, including the first.
+	MaxAttempts int `json:"max_attempts"`
+	// Delay is how long to wait for a response before sending the next attempt.
+	Delay time.Duration `json:"delay"`
+	// NonFatalCodes are the codes an attempt can fail with without failing the call. The next attempt is sent right
+	// away when one fails with a non-fatal code. Any other failure is returned to the caller.
+	NonFatalCodes []Code `json:"non_fatal_codes"`
+}
+
+// hasCode reports whether the error carries one of the provided codes.
+func hasCode(err error, codes []Code) bool {
+	status, ok := StatusFromError(err)
+	if !ok {
+		return false
+	}
+
+	for _, code := range codes {
+		if status.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Invoke performs a unary call to the method, sending the request and reading the response into resp, which must be a
+// pointer. The call is retried or hedged according to the policy configured for the method using WithRetryPolicy or
+// WithHedgingPolicy. When a method has both, it is hedged.
+func (c *ClientConn) Invoke(ctx context.Context, method string, req, resp interface{}) error {
+	if policy := c.options.hedgingPolicy(method); policy != nil {
+		return c.hedge(ctx, method, policy, req, resp)
+	}
+
+	if policy := c.options.retryPolicy(method); policy != nil {
+		return c.retry(ctx, method, policy, req, resp)
+	}
+
+	return c.invoke(ctx, method, req, resp)
+}
+
+// invoke makes a single attempt of a unary call.
+func (c *ClientConn) invoke(ctx context.Context, method string, req, resp interface{}) error {
+	stream, err := c.OpenStream(ctx, method)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err = stream.WriteMsg(req); err != nil {
+		return err
+	}
+
+	return stream.ReadMsg(resp)
+}
+
+func (c *ClientConn) retry(ctx context.Context, method string, policy *RetryPolicy, req, resp interface{}) error {
+	if policy.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Budget)
+		defer cancel()
+	}
+
+	return backoff.Retry(
+		func() error {
+			err := c.invoke(ctx, method, req, resp)
+			if err != nil && (ctx.Err() != nil || !hasCode(err, policy.RetryableCodes)) {
+				return backoff.Permanent(err)
+			}
+
+			return err
+		},
+		backoff.WithContext(policy.backOff(), ctx),
+	)
+}
+
+func (c *ClientConn) hedge(ctx context.Context, method string, policy *HedgingPolicy, req, resp interface{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp interface{}
+		err  error
+	}
+
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	// attempts decode into their own message so they don't race with one another
+	results := make(chan result, attempts)
+	respType := reflect.TypeOf(resp).Elem()
+
+	// the first attempt is sent right away
+	delay := time.NewTimer(0)
+	defer delay.Stop()
+
+	sent := 0
+
+	for received := 0; received < attempts; {
+		select {
+		case <-delay.C:
+			sent++
+
+			go func() {
+				msg := reflect.New(respType).Interface()
+				err := c.invoke(ctx, method, req, msg)
+				results <- result{msg, err}
+			}()
+
+			if sent < attempts {
+				delay.Reset(policy.Delay)
+			}
+		case res := <-results:
+			received++
+
+			switch {
+			case res.err == nil:
+				reflect.ValueOf(resp).Elem().Set(reflect.ValueOf(res.resp).Elem())
+
+				return nil
+			case received == attempts || !hasCode(res.err, policy.NonFatalCodes):
+				return res.err
+			case sent < attempts && sent == received:
+				// nothing is outstanding, so send the next attempt without waiting out the delay
+				if !delay.Stop() {
+					<-delay.C
+				}
+
+				delay.Reset(0)
+			}
+		}
+	}
+
+	return nil
+}
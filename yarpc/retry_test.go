@@ -0,0 +1,305 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"net"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// failingServer starts a server whose handler fails with the provided code until it has been called the given number
+// of times, after which it echoes the request back. The number of calls is returned along with the servers address.
+func failingServer(t *testing.T, code yarpc.Code, failures int64) (network, address string, calls *int64) {
+	t.Helper()
+
+	calls = new(int64)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		value := ""
+		if err := stream.ReadMsg(&value); err != nil {
+			return err
+		}
+
+		if atomic.AddInt64(calls, 1) <= failures {
+			return yarpc.Errorf(code, "attempt failed")
+		}
+
+		return stream.WriteMsg(value)
+	}))
+
+	network, address = startServer(t, mux)
+
+	return network, address, calls
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	policy := yarpc.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		RetryableCodes: []yarpc.Code{yarpc.CodeUnavailable},
+	}
+
+	t.Run("succeeds after retrying", func(t *testing.T) {
+		t.Parallel()
+
+		network, address, calls := failingServer(t, yarpc.CodeUnavailable, 2)
+		cc := yarpc.DialContext(ctx, network, address, yarpc.WithRetryPolicy(policy, method))
+
+		reply := ""
+		require.NoError(t, cc.Invoke(ctx, method, "hello", &reply))
+		require.Equal(t, "hello", reply)
+		require.Equal(t, int64(3), atomic.LoadInt64(calls))
+	})
+
+	t.Run("stops after max attempts", func(t *testing.T) {
+		t.Parallel()
+
+		network, address, calls := failingServer(t, yarpc.CodeUnavailable, 5)
+		cc := yarpc.DialContext(ctx, network, address, yarpc.WithRetryPolicy(policy))
+
+		reply := ""
+		require.ErrorIs(t, cc.Invoke(ctx, method, "hello", &reply), &yarpc.Error{Code: yarpc.CodeUnavailable})
+		require.Equal(t, int64(3), atomic.LoadInt64(calls))
+	})
+
+	t.Run("does not retry other codes", func(t *testing.T) {
+		t.Parallel()
+
+		network, address, calls := failingServer(t, yarpc.CodeInvalidArgument, 5)
+		cc := yarpc.DialContext(ctx, network, address, yarpc.WithRetryPolicy(policy))
+
+		reply := ""
+		require.ErrorIs(t, cc.Invoke(ctx, method, "hello", &reply), &yarpc.Error{Code: yarpc.CodeInvalidArgument})
+		require.Equal(t, int64(1), atomic.LoadInt64(calls))
+	})
+
+	t.Run("stops once the budget is spent", func(t *testing.T) {
+		t.Parallel()
+
+		network, address, calls := failingServer(t, yarpc.CodeUnavailable, 1000)
+		cc := yarpc.DialContext(ctx, network, address, yarpc.WithRetryPolicy(yarpc.RetryPolicy{
+			MaxAttempts:    1000,
+			InitialBackoff: 10 * time.Millisecond,
+			RetryableCodes: []yarpc.Code{yarpc.CodeUnavailable},
+			Budget:         100 * time.Millisecond,
+		}))
+
+		start := time.Now()
+
+		reply := ""
+		require.Error(t, cc.Invoke(ctx, method, "hello", &reply))
+		require.Less(t, time.Since(start), 5*time.Second)
+		require.Less(t, atomic.LoadInt64(calls), int64(1000))
+	})
+}
+
+// connListener keeps track of the connections it accepts so tests can tear them down.
+type connListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+
+	return conn, err
+}
+
+func (l *connListener) closeConns() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, conn := range l.conns {
+		_ = conn.Close()
+	}
+}
+
+func TestRetryPolicyReconnects(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	listener := &connListener{Listener: netListener}
+	calls := int64(0)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		value := ""
+		if err := stream.ReadMsg(&value); err != nil {
+			return err
+		}
+
+		// tear down the connection in the middle of the first call
+		if atomic.AddInt64(&calls, 1) == 1 {
+			listener.closeConns()
+			<-stream.Context().Done()
+
+			return stream.Context().Err()
+		}
+
+		return stream.WriteMsg(value)
+	}))
+
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: listener})
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	t.Run("without a policy", func(t *testing.T) {
+		cc := yarpc.DialContext(ctx, "unix", address)
+
+		reply := ""
+		require.ErrorIs(t, cc.Invoke(ctx, method, "hello", &reply), &yarpc.Error{Code: yarpc.CodeUnavailable})
+
+		// the next call is made using a new session
+		require.NoError(t, cc.Invoke(ctx, method, "hello", &reply))
+		require.Equal(t, "hello", reply)
+	})
+
+	atomic.StoreInt64(&calls, 0)
+
+	t.Run("with a policy", func(t *testing.T) {
+		cc := yarpc.DialContext(ctx, "unix", address, yarpc.WithRetryPolicy(yarpc.RetryPolicy{
+			MaxAttempts:    2,
+			InitialBackoff: time.Millisecond,
+			RetryableCodes: []yarpc.Code{yarpc.CodeUnavailable},
+		}))
+
+		reply := ""
+		require.NoError(t, cc.Invoke(ctx, method, "hello", &reply))
+		require.Equal(t, "hello", reply)
+		require.Equal(t, int64(2), atomic.LoadInt64(&calls))
+	})
+}
+
+func TestHedgingPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	calls := int64(0)
+	cancelled := make(chan struct{})
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		value := ""
+		if err := stream.ReadMsg(&value); err != nil {
+			return err
+		}
+
+		// the first attempt stalls until it's cancelled by the client
+		if atomic.AddInt64(&calls, 1) == 1 {
+			<-stream.Context().Done()
+			close(cancelled)
+
+			return stream.Context().Err()
+		}
+
+		return stream.WriteMsg(value)
+	}))
+
+	network, address := startServer(t, mux)
+	cc := yarpc.DialContext(ctx, network, address, yarpc.WithHedgingPolicy(yarpc.HedgingPolicy{
+		MaxAttempts: 3,
+		Delay:       50 * time.Millisecond,
+	}, method))
+
+	reply := ""
+	require.NoError(t, cc.Invoke(ctx, method, "hello", &reply))
+	require.Equal(t, "hello", reply)
+	require.Equal(t, int64(2), atomic.LoadInt64(&calls))
+
+	select {
+	case <-cancelled:
+	case <-ctx.Done():
+		require.Fail(t, "the outstanding attempt was not cancelled")
+	}
+}
+
+func TestHedgingPolicyFatalCodes(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	policy := yarpc.HedgingPolicy{
+		MaxAttempts:   3,
+		Delay:         time.Second,
+		NonFatalCodes: []yarpc.Code{yarpc.CodeUnavailable},
+	}
+
+	t.Run("non-fatal codes send the next attempt", func(t *testing.T) {
+		t.Parallel()
+
+		network, address, calls := failingServer(t, yarpc.CodeUnavailable, 2)
+		cc := yarpc.DialContext(ctx, network, address, yarpc.WithHedgingPolicy(policy))
+
+		start := time.Now()
+
+		reply := ""
+		require.NoError(t, cc.Invoke(ctx, method, "hello", &reply))
+		require.Equal(t, "hello", reply)
+		require.Equal(t, int64(3), atomic.LoadInt64(calls))
+
+		// failed attempts don't wait for the delay
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("fatal codes fail the call", func(t *testing.T) {
+		t.Parallel()
+
+		network, address, calls := failingServer(t, yarpc.CodeInvalidArgument, 5)
+		cc := yarpc.DialContext(ctx, network, address, yarpc.WithHedgingPolicy(policy))
+
+		reply := ""
+		require.ErrorIs(t, cc.Invoke(ctx, method, "hello", &reply), &yarpc.Error{Code: yarpc.CodeInvalidArgument})
+		require.Equal(t, int64(1), atomic.LoadInt64(calls))
+	})
+}
@@ -21,17 +21,23 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/yamux"
 	"github.com/panjf2000/ants/v2"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 
 	"go.pitz.tech/lib/encoding"
+	"go.pitz.tech/lib/headers"
 	"go.pitz.tech/lib/logger"
 )
 
+// abandonTimeout bounds how long GracefulStop waits for the handlers of abandoned streams to return.
+const abandonTimeout = time.Second
+
 type Listener interface {
 	Accept() (io.ReadWriteCloser, error)
 	Close() error
@@ -41,84 +47,535 @@ type Server struct {
 	Handler Handler
 
 	// set during serve
-	mu       sync.Mutex
-	options  options
+	mu sync.Mutex
+	// serves tracks each call to Serve until the connections it accepted are done
+	serves   map[*serveConfig]struct{}
+	sessions map[*yamux.Session]struct{}
+	// conns tracks the connections that are still being established, before they have a session
+	conns    map[io.ReadWriteCloser]struct{}
+	draining bool
+
+	// streams tracks the handlers that are currently running so the server can be drained
+	streams sync.WaitGroup
+	active  int64
+}
+
+// serveConfig holds what the connections accepted by a call to Serve are handled with. Each call has its own, so a server
+// can serve several listeners with different options at once.
+type serveConfig struct {
+	options   options
+	intercept ServerInterceptor
+	pool      *ants.Pool
+	// listener is cleared once it has been closed
 	listener Listener
-	pool     *ants.Pool
+	// cancel cancels the context handlers run under once they are abandoned by GracefulStop
+	cancel context.CancelFunc
+	// conns counts the accepted connections that are still being handled, as they submit streams to the pool
+	conns sync.WaitGroup
 }
 
-func (s *Server) handleStream(stream *yamux.Stream) func() {
+func (s *Server) handleStream(
+	cfg *serveConfig, sessionContext context.Context, stream *yamux.Stream, enc *encoding.Encoding,
+) func() {
 	return func() {
-		rpcStream := Wrap(stream, withOptions(&s.options))
-		var err error
+		defer s.doneStream()
+
+		log := logger.Extract(sessionContext).With(zap.Stringer("remote", stream.RemoteAddr()))
+		o := cfg.options
+		o.encoding = enc
+
+		rpcStream := newStream(stream, o)
 
 		defer func() {
-			if err != nil {
-				// log
+			if err := rpcStream.Close(); err != nil {
+				log.Debug("failed to close stream", zap.Error(err))
+			}
+		}()
+
+		// the invoke frame is read before the stream is started so the callers deadline is in place for the handler
+		data, err := rpcStream.readFrame()
+		if err != nil {
+			// peers that close or reset the stream before invoking a method are not a problem with the server
+			if disconnected(err) {
+				log.Debug("failed to read invoke frame", zap.Error(err))
+			} else {
+				log.Error("failed to read invoke frame", zap.Error(err))
 			}
 
-			if err := stream.Close(); err != nil {
-				// log
+			// let the caller know when the invoke frame was rejected, such as when it exceeds the size limit
+			if _, ok := StatusFromError(err); ok {
+				_ = rpcStream.encode(&Frame{
+					Nonce:  nonce(),
+					Status: toStatus(err),
+				})
 			}
-		}()
 
-		err = s.Handler.ServeYARPC(rpcStream)
+			return
+		}
+
+		invoke := &Invoke{}
+		if err = rpcStream.decode(data, invoke); err != nil {
+			log.Error("failed to decode invoke frame", zap.Error(err))
+
+			return
+		}
+
+		// peers that do not use headers.Header to build the invoke frame may send keys in any case
+		invoke.Header = normalizeHeader(invoke.Header)
+
+		log = log.With(zap.String("method", invoke.Method))
+
+		ctx := withInvoke(sessionContext, invoke)
+		ctx = headers.ToContext(ctx, invoke.Header)
+		if invoke.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, invoke.Timeout)
+			defer cancel()
+		}
+
+		parent, _ := extractSpanContext(invoke.Header)
+
+		switch {
+		case o.spanRecorder != nil:
+			span := newSpan(parent, SideServer, invoke.Method, stream.RemoteAddr().String())
+			ctx = SpanContextToContext(ctx, span.Context)
+			rpcStream.trace(o.spanRecorder, span)
+		case parent.IsValid():
+			ctx = SpanContextToContext(ctx, parent)
+		}
+
+		rpcStream.setContext(ctx)
+		rpcStream.instrument(o.metrics, SideServer, s.metricsMethod(invoke.Method))
+		rpcStream.start()
+
+		var status *Status
+		if err = s.invoke(cfg, log, invoke.Method, rpcStream); err != nil {
+			status = toStatus(err)
+
+			switch status.Code {
+			case CodeInternal, CodeUnknown, CodeDataLoss:
+				log.Error("handler failed", zap.Stringer("code", status.Code), zap.Error(err))
+			default:
+				log.Warn("handler failed", zap.Stringer("code", status.Code), zap.Error(err))
+			}
+		}
+
+		if err = rpcStream.finish(status); err != nil {
+			log.Error("failed to send status", zap.Error(err))
+		}
+
+		code := CodeOK
+		if status != nil {
+			code = status.Code
+		}
+
+		rpcStream.finished(code)
+	}
+}
+
+// metricsMethod returns the name streams invoking the method are recorded under. Methods are chosen by the client, so
+// only those registered with the ServeMux are recorded by name.
+func (s *Server) metricsMethod(method string) string {
+	if mux, ok := s.Handler.(*ServeMux); ok && mux.handles(method) {
+		return method
+	}
+
+	return UnknownMethod
+}
+
+// disconnected reports whether the error came from the peer closing or resetting the stream.
+func disconnected(err error) bool {
+	for _, target := range []error{
+		io.EOF, io.ErrUnexpectedEOF,
+		yamux.ErrStreamClosed, yamux.ErrConnectionReset, yamux.ErrSessionShutdown,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// invoke calls the handler for the stream through the server interceptors. The interceptors run before the handler is
+// given a worker from the pool, so streams rejected by admission never take one. Panics are recovered and reported to
+// the client as an internal error.
+func (s *Server) invoke(cfg *serveConfig, log *zap.Logger, method string, stream Stream) (err error) {
+	defer recovered(log, method, &err)
+
+	return cfg.intercept(method, stream, HandlerFunc(func(stream Stream) error {
+		return s.run(cfg, log, method, stream)
+	}))
+}
+
+// run calls the handler on a worker from the pool, waiting in the queue for one to free up when it has room.
+func (s *Server) run(cfg *serveConfig, log *zap.Logger, method string, stream Stream) error {
+	result := make(chan error, 1)
+
+	err := cfg.pool.Submit(func() {
+		result <- s.serveStream(log, method, stream)
+	})
+
+	switch {
+	case errors.Is(err, ants.ErrPoolOverload):
+		return Errorf(CodeResourceExhausted, "server is overloaded")
+	case err != nil:
+		return Errorf(CodeUnavailable, "server is shutting down")
+	}
+
+	return <-result
+}
+
+func (s *Server) serveStream(log *zap.Logger, method string, stream Stream) (err error) {
+	defer recovered(log, method, &err)
+
+	return s.Handler.ServeYARPC(stream)
+}
+
+// recovered replaces the error with an internal one when the handler for the method panicked. It must be deferred.
+func recovered(log *zap.Logger, method string, err *error) {
+	if r := recover(); r != nil {
+		log.Error("handler panicked", zap.Any("panic", r), zap.Stack("stack"))
+
+		*err = Errorf(CodeInternal, "handler for %s panicked", method)
+	}
+}
+
+// startStream counts a stream against the server until doneStream is called. Once the server is draining, streams are
+// no longer counted and false is returned, so none are added while GracefulStop waits on the running ones.
+func (s *Server) startStream() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.streams.Add(1)
+	atomic.AddInt64(&s.active, 1)
+
+	return true
+}
+
+func (s *Server) doneStream() {
+	atomic.AddInt64(&s.active, -1)
+	s.streams.Done()
+}
+
+// handleConn identifies the peer on the other end of the connection and negotiates the encoding used for messages
+// before serving a session over it. For TLS connections, this completes the handshake so the certificates presented by
+// the peer are available to handlers.
+func (s *Server) handleConn(cfg *serveConfig, conn io.ReadWriteCloser, yamuxcfg *yamux.Config) func() {
+	return func() {
+		defer cfg.conns.Done()
+
+		log := logger.Extract(cfg.options.context)
+
+		if !s.trackConn(conn) {
+			_ = conn.Close()
+
+			return
+		}
+
+		defer s.untrackConn(conn)
+
+		ctx, enc, err := s.connContext(cfg, conn)
+		if err != nil {
+			log.Warn("failed to establish connection", zap.Error(err))
+			_ = conn.Close()
+
+			return
+		}
+
+		session, err := yamux.Server(conn, yamuxcfg)
 		if err != nil {
-			err = rpcStream.WriteMsg(&Status{
-				Code:    http.StatusInternalServerError,
-				Message: err.Error(),
-			})
+			log.Error("failed to accept session", zap.Error(err))
+			_ = conn.Close()
+
+			return
 		}
+
+		if !s.trackSession(conn, session) {
+			_ = session.Close()
+
+			return
+		}
+
+		s.handleSession(cfg, ctx, session, enc)()
+	}
+}
+
+// trackConn records a connection that's still being established so GracefulStop can close it. It returns false once the
+// server is draining.
+func (s *Server) trackConn(conn io.ReadWriteCloser) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
 	}
+
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrackConn(conn io.ReadWriteCloser) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// trackSession replaces the connection with the session established over it. It returns false when the server started
+// draining during the handshake.
+func (s *Server) trackSession(conn io.ReadWriteCloser, session *yamux.Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+
+	if s.draining {
+		return false
+	}
+
+	s.sessions[session] = struct{}{}
+
+	return true
 }
 
-func (s *Server) handleSession(session *yamux.Session) func() {
+// connContext returns the context shared by every stream on the connection, along with the encoding requested by the
+// client.
+func (s *Server) connContext(cfg *serveConfig, conn io.ReadWriteCloser) (context.Context, *encoding.Encoding, error) {
+	ctx := cfg.options.context
+	deadline := time.Now().Add(handshakeTimeout)
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		handshakeContext, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+
+		if err := tlsConn.HandshakeContext(handshakeContext); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to complete tls handshake")
+		}
+	}
+
+	var enc *encoding.Encoding
+
+	err := handshake(conn, deadline, func() (err error) {
+		enc, err = readPreamble(conn, append([]*encoding.Encoding{cfg.options.encoding}, cfg.options.encodings...))
+
+		return err
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read preamble")
+	}
+
+	ctx = PeerToContext(ctx, newPeerInfo(conn))
+
+	if cred, err := peerCred(conn); err == nil {
+		ctx = PeerCredToContext(ctx, cred)
+	}
+
+	return ctx, enc, nil
+}
+
+// handleSession accepts streams off of the session until it's closed. The provided context carries information about
+// the connection, such as the credentials of the peer, to each of the handlers.
+func (s *Server) handleSession(
+	cfg *serveConfig, ctx context.Context, session *yamux.Session, enc *encoding.Encoding,
+) func() {
 	return func() {
-		var err error
+		log := logger.Extract(ctx).With(zap.Stringer("remote", session.RemoteAddr()))
+
+		cfg.options.metrics.SessionOpened(SideServer)
 
 		defer func() {
-			if err != nil {
-				// log
-			}
+			cfg.options.metrics.SessionClosed(SideServer)
+
+			s.mu.Lock()
+			delete(s.sessions, session)
+			s.mu.Unlock()
 
-			if err = session.Close(); err != nil {
-				// log
+			if err := session.Close(); err != nil {
+				log.Debug("failed to close session", zap.Error(err))
 			}
 		}()
 
-		var stream *yamux.Stream
+		// open counts the streams on the session that are queued or being handled
+		open := int64(0)
 
 		for {
-			stream, err = session.AcceptStream()
+			stream, err := session.AcceptStream()
 			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, yamux.ErrSessionShutdown) {
+					log.Error("failed to accept stream", zap.Error(err))
+				}
+
 				return
 			}
 
-			err = s.pool.Submit(s.handleStream(stream))
-			if err != nil {
-				// log
-				_ = stream.Close()
+			if !s.startStream() {
+				s.refuse(cfg, log, stream, enc, Errorf(CodeUnavailable, "server is shutting down"))
+
+				continue
+			}
+
+			active := atomic.AddInt64(&open, 1)
+			if limit := cfg.options.maxStreams; limit > 0 && active > int64(limit) {
+				atomic.AddInt64(&open, -1)
+				s.reject(cfg, log, stream, enc,
+					Errorf(CodeResourceExhausted, "too many concurrent streams (max %d)", limit))
+
+				continue
 			}
+
+			handle := s.handleStream(cfg, ctx, stream, enc)
+
+			// streams are not run on the pool until they have been admitted, so they're handled on their own goroutine
+			go func() {
+				defer atomic.AddInt64(&open, -1)
+
+				handle()
+			}()
 		}
 	}
 }
 
+// reject refuses a stream that was counted by startStream, and stops counting it.
+func (s *Server) reject(
+	cfg *serveConfig, log *zap.Logger, stream *yamux.Stream, enc *encoding.Encoding, err error,
+) {
+	defer s.doneStream()
+
+	s.refuse(cfg, log, stream, enc, err)
+}
+
+// refuse tells the client why its stream will not be handled before closing it. The status is sent in place of a
+// response, so the client sees it when reading from the stream.
+func (s *Server) refuse(
+	cfg *serveConfig, log *zap.Logger, stream *yamux.Stream, enc *encoding.Encoding, err error,
+) {
+	log.Warn("rejected stream", zap.Error(err))
+
+	o := cfg.options
+	o.encoding = enc
+
+	rpcStream := newStream(stream, o)
+
+	if err := rpcStream.encode(&Frame{Nonce: nonce(), Status: toStatus(err)}); err != nil {
+		log.Debug("failed to send status", zap.Error(err))
+	}
+
+	_ = stream.Close()
+}
+
 /* all public functions must start with s.once.Do(s.init) */
 
 func (s *Server) Shutdown() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if listener := s.listener; listener != nil {
-		s.listener = nil
+	for cfg := range s.serves {
+		cfg.close()
+		cfg.pool.Release()
+	}
+
+	return nil
+}
+
+// GracefulStop stops the server from accepting new sessions and streams, and waits for running handlers to finish.
+// Clients are sent a GOAWAY notice so they open new streams elsewhere, and connections that are still being established
+// are closed. Once the context is done, any remaining streams are abandoned: their contexts are canceled and they are
+// closed, and GracefulStop waits briefly for their handlers to return. The number of abandoned streams is returned along
+// with the error from the context.
+func (s *Server) GracefulStop(ctx context.Context) (int, error) {
+	s.mu.Lock()
+
+	s.draining = true
+
+	serves := make([]*serveConfig, 0, len(s.serves))
+	for cfg := range s.serves {
+		cfg.close()
+		serves = append(serves, cfg)
+	}
+
+	sessions := s.activeSessions()
+
+	conns := make([]io.ReadWriteCloser, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+
+	s.mu.Unlock()
+
+	// connections that are still being established have no streams to wait on
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+
+	for _, session := range sessions {
+		_ = session.GoAway()
+	}
+
+	drained := make(chan struct{})
+
+	go func() {
+		s.streams.Wait()
+		close(drained)
+	}()
+
+	abandoned := 0
+
+	var err error
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		abandoned = int(atomic.LoadInt64(&s.active))
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	sessions = s.activeSessions()
+	s.mu.Unlock()
+
+	for _, cfg := range serves {
+		cfg.cancel()
+	}
+
+	for _, session := range sessions {
+		_ = session.Close()
+	}
+
+	// handlers that ignore the cancellation of their context are left running, rather than holding up the server
+	select {
+	case <-drained:
+	case <-time.After(abandonTimeout):
+	}
+
+	for _, cfg := range serves {
+		cfg.pool.Release()
+	}
+
+	return abandoned, err
+}
+
+// close closes the listener, unless it already has been. It must be called while holding the lock.
+func (cfg *serveConfig) close() {
+	if listener := cfg.listener; listener != nil {
+		cfg.listener = nil
 		_ = listener.Close()
 	}
+}
 
-	if s.pool != nil {
-		s.pool.Release()
+// activeSessions returns the sessions currently being served. It must be called while holding the lock.
+func (s *Server) activeSessions() []*yamux.Session {
+	sessions := make([]*yamux.Session, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
 	}
 
-	return nil
+	return sessions
 }
 
 func (s *Server) Serve(listener Listener, opts ...Option) error {
@@ -126,6 +583,7 @@ func (s *Server) Serve(listener Listener, opts ...Option) error {
 		context:  context.Background(),
 		yamux:    yamux.DefaultConfig(),
 		encoding: encoding.MsgPack,
+		metrics:  noopMetrics{},
 	}
 
 	for _, opt := range opts {
@@ -143,30 +601,55 @@ func (s *Server) Serve(listener Listener, opts ...Option) error {
 		}
 	}
 
-	err := func() (err error) {
-		s.mu.Lock()
-		defer s.mu.Unlock()
+	size := o.poolSize
+	if size == 0 {
+		size = DefaultPoolSize
+	}
 
-		pool := s.pool
-		if pool == nil {
-			pool, err = ants.NewPool(3000, ants.WithOptions(ants.Options{
-				// Logger: zap.NewStdLog(logger),
-			}))
-			if err != nil {
-				return errors.Wrap(err, "failed to construct ant pool")
-			}
-		} else {
-			pool.Reboot()
-		}
+	pool, err := ants.NewPool(size, ants.WithOptions(ants.Options{
+		Logger:           zap.NewStdLog(logger.Extract(o.context)),
+		Nonblocking:      o.queueSize == 0,
+		MaxBlockingTasks: o.queueSize,
+	}))
+	if err != nil {
+		return errors.Wrap(err, "failed to construct ant pool")
+	}
+
+	// rate limits are applied last, so they can make use of the identity established by the other interceptors
+	admission := &admission{rateLimits: o.rateLimits}
+	interceptors := append(append([]ServerInterceptor{}, o.serverInterceptors...), admission.intercept)
+
+	cfg := &serveConfig{
+		intercept: ChainServerInterceptors(interceptors...),
+		pool:      pool,
+		listener:  listener,
+	}
+
+	// handlers run under a context that's canceled when GracefulStop abandons them
+	o.context, cfg.cancel = context.WithCancel(o.context)
+	cfg.options = o
 
-		s.options = o
-		s.listener = listener
-		s.pool = pool
+	s.mu.Lock()
+
+	if s.serves == nil {
+		s.serves = make(map[*serveConfig]struct{})
+		s.sessions = make(map[*yamux.Session]struct{})
+		s.conns = make(map[io.ReadWriteCloser]struct{})
+	}
+
+	s.serves[cfg] = struct{}{}
+	s.draining = false
 
-		return nil
+	s.mu.Unlock()
+
+	defer func() {
+		go s.release(cfg)
 	}()
-	if err != nil {
-		return err
+
+	yamuxcfg := o.yamuxConfig(o.context)
+
+	if err := yamux.VerifyConfig(yamuxcfg); err != nil {
+		return errors.Wrap(err, "invalid yamux configuration")
 	}
 
 	for {
@@ -175,22 +658,25 @@ func (s *Server) Serve(listener Listener, opts ...Option) error {
 			return errors.Wrap(err, "failed to accept connection")
 		}
 
-		yamuxcfg := *o.yamux
-		yamuxcfg.Logger = logger.HashiCorpStdLogger(logger.Extract(o.context))
-		yamuxcfg.LogOutput = nil
+		cfg.conns.Add(1)
 
-		session, err := yamux.Server(conn, o.yamux)
-		if err != nil {
-			return errors.Wrap(err, "failed to Wrap connection for yamux")
-		}
-
-		err = s.pool.Submit(s.handleSession(session))
-		if err != nil {
-			_ = session.Close()
-		}
+		// connections are not run on the pool, as each one would hold a handler for as long as it's open
+		go s.handleConn(cfg, conn, yamuxcfg)()
 	}
 }
 
+// release releases the pool of a call to Serve that has returned, once the connections it accepted no longer need it.
+func (s *Server) release(cfg *serveConfig) {
+	cfg.conns.Wait()
+
+	s.mu.Lock()
+	delete(s.serves, cfg)
+	s.mu.Unlock()
+
+	cfg.cancel()
+	cfg.pool.Release()
+}
+
 func (s *Server) ListenAndServe(network, address string, opts ...Option) error {
 	netListener, err := net.Listen(network, address)
 	if err != nil {
@@ -0,0 +1,528 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"go.pitz.tech/lib/logger"
+	"go.pitz.tech/lib/yarpc"
+)
+
+// blockingServer starts a server whose handler waits for release before replying with the servers address.
+func blockingServer(t *testing.T) (svr *yarpc.Server, address string, started chan struct{}, release chan struct{}) {
+	t.Helper()
+
+	address = path.Join(t.TempDir(), "yarpc.sock")
+	started = make(chan struct{}, 10)
+	release = make(chan struct{})
+
+	netListener, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		started <- struct{}{}
+
+		select {
+		case <-release:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+
+		return stream.WriteMsg(address)
+	}))
+
+	svr = &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener})
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	return svr, address, started, release
+}
+
+func TestGracefulStop(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	svr, address, started, release := blockingServer(t)
+	cc := yarpc.DialContext(ctx, "unix", address)
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+	<-started
+
+	type result struct {
+		abandoned int
+		err       error
+	}
+
+	stopped := make(chan result, 1)
+
+	go func() {
+		abandoned, err := svr.GracefulStop(ctx)
+		stopped <- result{abandoned, err}
+	}()
+
+	// new sessions are no longer accepted while draining
+	require.Eventually(t, func() bool {
+		dialContext, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err := yarpc.DialContext(dialContext, "unix", address).OpenStream(dialContext, method)
+
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case <-stopped:
+		require.Fail(t, "server stopped before the running handler finished")
+	default:
+	}
+
+	close(release)
+
+	reply := ""
+	require.NoError(t, stream.ReadMsg(&reply))
+	require.Equal(t, address, reply)
+
+	res := <-stopped
+	require.NoError(t, res.err)
+	require.Equal(t, 0, res.abandoned)
+}
+
+func TestGracefulStopAbandonsStreams(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	svr, address, started, _ := blockingServer(t)
+	cc := yarpc.DialContext(ctx, "unix", address)
+
+	for i := 0; i < 2; i++ {
+		_, err := cc.OpenStream(ctx, method)
+		require.NoError(t, err)
+		<-started
+	}
+
+	stopContext, stopCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stopCancel()
+
+	abandoned, err := svr.GracefulStop(stopContext)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 2, abandoned)
+}
+
+func TestGracefulStopWaitsForAbandonedHandlers(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	started := make(chan struct{}, 1)
+	returned := int32(0)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		defer atomic.AddInt32(&returned, 1)
+
+		started <- struct{}{}
+		<-stream.Context().Done()
+
+		// keep running for a while after the stream is abandoned
+		time.Sleep(100 * time.Millisecond)
+
+		return stream.Context().Err()
+	}))
+
+	svr := &yarpc.Server{Handler: mux}
+	network, address := "unix", path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener})
+	}()
+
+	_, err = yarpc.DialContext(ctx, network, address).OpenStream(ctx, method)
+	require.NoError(t, err)
+	<-started
+
+	stopContext, stopCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stopCancel()
+
+	abandoned, err := svr.GracefulStop(stopContext)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 1, abandoned)
+	require.Equal(t, int32(1), atomic.LoadInt32(&returned))
+}
+
+func TestGracefulStopLeavesUnresponsiveHandlers(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	started := make(chan struct{}, 1)
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		started <- struct{}{}
+
+		// the handler never checks whether its stream was abandoned
+		<-stuck
+
+		return nil
+	}))
+
+	svr := &yarpc.Server{Handler: mux}
+	network, address := "unix", path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen(network, address)
+	require.NoError(t, err)
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener})
+	}()
+
+	_, err = yarpc.DialContext(ctx, network, address).OpenStream(ctx, method)
+	require.NoError(t, err)
+	<-started
+
+	stopContext, stopCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stopCancel()
+
+	abandoned, err := svr.GracefulStop(stopContext)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 1, abandoned)
+}
+
+func TestGracefulStopClosesPendingConnections(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	svr, address, _, release := blockingServer(t)
+	close(release)
+
+	// the connection never sends its preamble, so the server is left waiting on the handshake
+	conn, err := net.Dial("unix", address)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	// connections are accepted in order, so once a later one is served the server has picked up the first
+	stream, err := yarpc.DialContext(ctx, "unix", address).OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	reply := ""
+	require.NoError(t, stream.ReadMsg(&reply))
+
+	_, err = svr.GracefulStop(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.False(t, os.IsTimeout(err), "connection was left open after stopping")
+}
+
+func TestGracefulStopMovesClients(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	draining, drainingAddress, drainingStarted, drainingRelease := blockingServer(t)
+	_, address, started, release := blockingServer(t)
+	close(release)
+
+	cc := yarpc.DialTargets(ctx, "unix", []string{drainingAddress, address})
+
+	// hold a stream open on the draining server so it cannot finish stopping
+	require.Eventually(t, func() bool {
+		if _, err := cc.OpenStream(ctx, method); err != nil {
+			return false
+		}
+
+		select {
+		case <-drainingStarted:
+			return true
+		case <-started:
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		_, _ = draining.GracefulStop(ctx)
+	}()
+
+	// once the notice reaches the client, every stream is sent to the remaining server
+	require.Eventually(t, func() bool {
+		stream, err := cc.OpenStream(ctx, method)
+		if err != nil {
+			return false
+		}
+
+		defer stream.Close()
+
+		reply := ""
+
+		return stream.ReadMsg(&reply) == nil && reply == address
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		stream, err := cc.OpenStream(ctx, method)
+		require.NoError(t, err)
+
+		reply := ""
+		require.NoError(t, stream.ReadMsg(&reply))
+		require.Equal(t, address, reply)
+	}
+
+	close(drainingRelease)
+	<-stopped
+}
+
+func TestInvokeFrameDisconnect(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zap.DebugLevel)
+	serverContext := logger.ToContext(context.Background(), zap.New(core))
+
+	network, address := startServer(t, &yarpc.ServeMux{}, yarpc.WithContext(serverContext))
+
+	conn, err := net.Dial(network, address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(append([]byte("yarpc\x01\x07"), "msgpack"...))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(conn, make([]byte, 8))
+	require.NoError(t, err)
+
+	session, err := yamux.Client(conn, nil)
+	require.NoError(t, err)
+	defer session.Close()
+
+	// closing the stream before sending the invoke frame is not an error on the server
+	stream, err := session.OpenStream()
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("failed to read invoke frame").Len() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, entry := range logs.FilterMessage("failed to read invoke frame").All() {
+		require.Equal(t, zap.DebugLevel, entry.Level)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	core, logs := observer.New(zap.DebugLevel)
+	serverContext := logger.ToContext(ctx, zap.New(core))
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		value := ""
+		if err := stream.ReadMsg(&value); err != nil {
+			return err
+		}
+
+		if value == "panic" {
+			panic("boom")
+		}
+
+		return stream.WriteMsg(value)
+	}))
+
+	network, address := startServer(t, mux, yarpc.WithContext(serverContext))
+	cc := yarpc.DialContext(ctx, network, address)
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+	require.NoError(t, stream.WriteMsg("panic"))
+
+	reply := ""
+	require.ErrorIs(t, stream.ReadMsg(&reply), &yarpc.Error{Code: yarpc.CodeInternal})
+
+	panicked := logs.FilterMessage("handler panicked").All()
+	require.Len(t, panicked, 1)
+	require.Equal(t, method, panicked[0].ContextMap()["method"])
+
+	// the server continues to handle streams after recovering
+	stream, err = cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+	require.NoError(t, stream.WriteMsg("hello"))
+	require.NoError(t, stream.ReadMsg(&reply))
+	require.Equal(t, "hello", reply)
+}
+
+func TestServeAgain(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		if err := stream.WriteMsg("started"); err != nil {
+			return err
+		}
+
+		<-stream.Context().Done()
+
+		return stream.Context().Err()
+	}))
+
+	svr := &yarpc.Server{Handler: mux}
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	serve := func(opts ...yarpc.Option) (*yarpc.MemoryListener, chan error) {
+		listener := yarpc.NewMemoryListener()
+		served := make(chan error, 1)
+
+		go func() {
+			served <- svr.Serve(listener, opts...)
+		}()
+
+		return listener, served
+	}
+
+	listener, served := serve(yarpc.WithPoolSize(1))
+
+	reply := ""
+
+	first, err := yarpc.DialMemory(ctx, listener).OpenStream(ctx, method)
+	require.NoError(t, err)
+	require.NoError(t, first.ReadMsg(&reply))
+
+	require.NoError(t, svr.Shutdown())
+	require.Error(t, <-served)
+
+	// the handlers of the second call are not limited by the pool of the first
+	listener, _ = serve(yarpc.WithPoolSize(2))
+	cc := yarpc.DialMemory(ctx, listener)
+
+	for i := 0; i < 2; i++ {
+		stream, err := cc.OpenStream(ctx, method)
+		require.NoError(t, err)
+		require.NoError(t, stream.ReadMsg(&reply))
+	}
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+	require.ErrorIs(t, stream.ReadMsg(&reply), &yarpc.Error{Code: yarpc.CodeResourceExhausted})
+}
+
+func TestServeConcurrently(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		value := ""
+		if err := stream.ReadMsg(&value); err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(value)
+	}))
+
+	svr := &yarpc.Server{Handler: mux}
+
+	serve := func(opts ...yarpc.Option) (*yarpc.MemoryListener, chan error) {
+		listener := yarpc.NewMemoryListener()
+		served := make(chan error, 1)
+
+		go func() {
+			served <- svr.Serve(listener, opts...)
+		}()
+
+		return listener, served
+	}
+
+	call := func(cc *yarpc.ClientConn) error {
+		reply := ""
+
+		return cc.Invoke(ctx, method, "hello", &reply)
+	}
+
+	first, firstServed := serve()
+	established := yarpc.DialMemory(ctx, first)
+	require.NoError(t, call(established))
+
+	intercepted := int32(0)
+	count := func(method string, stream yarpc.Stream, next yarpc.Handler) error {
+		atomic.AddInt32(&intercepted, 1)
+
+		return next.ServeYARPC(stream)
+	}
+
+	second, secondServed := serve(yarpc.WithServerInterceptors(count))
+	require.NoError(t, call(yarpc.DialMemory(ctx, second)))
+	require.Equal(t, int32(1), atomic.LoadInt32(&intercepted))
+
+	// serving the second listener leaves the sessions and the options of the first alone
+	require.NoError(t, call(established))
+	require.NoError(t, call(yarpc.DialMemory(ctx, first)))
+	require.Equal(t, int32(1), atomic.LoadInt32(&intercepted))
+
+	// both listeners are stopped
+	require.NoError(t, svr.Shutdown())
+	require.Error(t, <-firstServed)
+	require.Error(t, <-secondServed)
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+
+	"go.pitz.tech/lib/leaderless"
+)
+
+// Endpoint describes an endpoint that is ready to accept streams.
+type Endpoint struct {
+	Address string
+	// Outstanding is the number of streams currently open against the endpoint.
+	Outstanding int64
+}
+
+// Strategy chooses which endpoint a stream is opened against when a client connection balances streams across
+// multiple endpoints.
+type Strategy interface {
+	// Pick returns the address of the endpoint the stream for the named method should be opened against. Endpoints
+	// are sorted by their address. False is returned when none of the provided endpoints should be used, in which case
+	// the client waits for the set of ready endpoints to change.
+	Pick(ctx context.Context, method string, endpoints []Endpoint) (string, bool)
+}
+
+// StrategyFunc provides a functional implementation of a Strategy.
+type StrategyFunc func(ctx context.Context, method string, endpoints []Endpoint) (string, bool)
+
+func (fn StrategyFunc) Pick(ctx context.Context, method string, endpoints []Endpoint) (string, bool) {
+	return fn(ctx, method, endpoints)
+}
+
+// RoundRobin returns a Strategy that cycles through the ready endpoints.
+func RoundRobin() Strategy {
+	next := uint64(0)
+
+	return StrategyFunc(func(ctx context.Context, method string, endpoints []Endpoint) (string, bool) {
+		if len(endpoints) == 0 {
+			return "", false
+		}
+
+		i := atomic.AddUint64(&next, 1) - 1
+
+		return endpoints[i%uint64(len(endpoints))].Address, true
+	})
+}
+
+// LeastOutstanding returns a Strategy that picks the endpoint with the fewest open streams. Ties are broken by
+// cycling through the endpoints so idle connections share the load evenly.
+func LeastOutstanding() Strategy {
+	next := uint64(0)
+
+	return StrategyFunc(func(ctx context.Context, method string, endpoints []Endpoint) (string, bool) {
+		if len(endpoints) == 0 {
+			return "", false
+		}
+
+		offset := int((atomic.AddUint64(&next, 1) - 1) % uint64(len(endpoints)))
+		picked := endpoints[offset]
+
+		for i := 1; i < len(endpoints); i++ {
+			endpoint := endpoints[(offset+i)%len(endpoints)]
+			if endpoint.Outstanding < picked.Outstanding {
+				picked = endpoint
+			}
+		}
+
+		return picked.Address, true
+	})
+}
+
+// ConsistentHash returns a Strategy that uses the provided leaderless.Director to route streams with the same hash key
+// to the same endpoint. The key is obtained using HashKeyToContext, falling back to the name of the method. When the
+// endpoint that owns a key is not ready, the next replica on the hash ring is used. The director must be started using
+// the same membership the client connection was created with.
+func ConsistentHash(director *leaderless.Director) Strategy {
+	return StrategyFunc(func(ctx context.Context, method string, endpoints []Endpoint) (string, bool) {
+		key := ExtractHashKey(ctx)
+		if key == "" {
+			key = method
+		}
+
+		replicas, ok := director.GetReplicas(key, math.MaxInt32)
+		if !ok {
+			return "", false
+		}
+
+		ready := make(map[string]bool, len(endpoints))
+		for _, endpoint := range endpoints {
+			ready[endpoint.Address] = true
+		}
+
+		for _, replica := range replicas {
+			if ready[replica] {
+				return replica, true
+			}
+		}
+
+		return "", false
+	})
+}
@@ -16,10 +16,17 @@
 package yarpc
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
-	"fmt"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/yamux"
@@ -37,44 +44,284 @@ func nonce() string {
 	return hex.EncodeToString(nonce)
 }
 
-// Stream provides an interface for reading and writing message structures from a stream.
+// ErrSendClosed is returned when writing messages to a stream after CloseSend has been called.
+var ErrSendClosed = errors.New("yarpc: stream is closed for sending")
+
+// Stream provides an interface for reading and writing message structures from a stream. CloseSend half-closes the
+// stream, telling the remote end that no more messages will be sent while still allowing messages to be read. Close
+// tears down both directions of the stream.
 type Stream interface {
 	Context() context.Context
 	SetReadDeadline(deadline time.Time) error
 	ReadMsg(i interface{}) error
 	SetWriteDeadline(deadline time.Time) error
 	WriteMsg(i interface{}) error
+	CloseSend() error
 	Close() error
 }
 
-// Wrap converts the provided yamux stream into a yarpc Stream.
+// frameBacklog is the number of frames read ahead of the handler before reading from the underlying stream pauses.
+const frameBacklog = 16
+
+// Wrap converts the provided yamux stream into a yarpc Stream. Frames are read off the underlying stream in the
+// background so the context returned by the Stream is cancelled as soon as the remote end closes the stream.
 func Wrap(ys *yamux.Stream, opts ...Option) Stream {
 	o := options{
 		context:  context.Background(),
 		encoding: encoding.MsgPack,
+		metrics:  noopMetrics{},
 	}
 
 	for _, opt := range opts {
 		opt(&o)
 	}
 
+	rs := newStream(ys, o)
+	rs.setContext(o.context)
+	rs.start()
+
+	return rs
+}
+
+func newStream(ys *yamux.Stream, o options) *rpcStream {
 	rs := &rpcStream{
-		context: o.context,
-		stream:  ys,
+		stream:         ys,
+		reader:         bufio.NewReader(ys),
+		encoding:       o.encoding,
+		maxRecvMsgSize: o.maxRecvMsgSize,
+		maxSendMsgSize: o.maxSendMsgSize,
+		frames:         make(chan []byte, frameBacklog),
+		closed:         make(chan struct{}),
+		metrics:        noopMetrics{},
 	}
 
-	rs.encoder = o.encoding.Encoder(ys)
-	rs.decoder = o.encoding.Decoder(ys)
+	if rs.maxRecvMsgSize <= 0 {
+		rs.maxRecvMsgSize = DefaultMaxRecvMsgSize
+	}
 
 	return rs
 }
 
 type rpcStream struct {
+	parent  context.Context
 	context context.Context
-	stream  *yamux.Stream
+	cancel  context.CancelFunc
+	trailer *trailer
+
+	stream   *yamux.Stream
+	reader   *bufio.Reader
+	encoding *encoding.Encoding
+
+	maxRecvMsgSize int
+	maxSendMsgSize int
+
+	frames       chan []byte
+	readErr      error
+	readDeadline atomic.Value
+
+	writeMu    sync.Mutex
+	sendClosed bool
+	closeOnce  sync.Once
+	closed     chan struct{}
+
+	// set by instrument
+	metrics    Metrics
+	side       Side
+	method     string
+	started    time.Time
+	remoteCode atomic.Value
+	final      atomic.Value
+	sent       int64
+	received   int64
+
+	// set by trace
+	recorder SpanRecorder
+	span     *Span
+}
+
+// instrument records the stream as started for the method and reports the messages passed over it to the provided
+// Metrics. It must be called before the stream is started.
+func (j *rpcStream) instrument(metrics Metrics, side Side, method string) {
+	j.metrics = metrics
+	j.side = side
+	j.method = method
+	j.started = time.Now()
+
+	metrics.StreamStarted(side, method)
+}
+
+// trace reports the span to the recorder once the stream has finished. It must be called before the stream is started.
+func (j *rpcStream) trace(recorder SpanRecorder, span *Span) {
+	j.recorder = recorder
+	j.span = span
+}
 
-	encoder encoding.Encoder
-	decoder encoding.Decoder
+// finished records the stream as completed with the provided code.
+func (j *rpcStream) finished(code Code) {
+	j.metrics.StreamFinished(j.side, j.method, code, time.Since(j.started))
+
+	if j.span != nil {
+		j.span.End = time.Now()
+		j.span.Attributes[AttributeCode] = code.String()
+		j.span.Attributes[AttributeMessagesSent] = strconv.FormatInt(atomic.LoadInt64(&j.sent), 10)
+		j.span.Attributes[AttributeMessagesReceived] = strconv.FormatInt(atomic.LoadInt64(&j.received), 10)
+
+		j.recorder.RecordSpan(*j.span)
+	}
+}
+
+// result returns the code the call completed with from the client's point of view. The status sent by the server, or
+// the stream being closed by the caller, takes precedence over the state of the callers context.
+func (j *rpcStream) result() Code {
+	if code, ok := j.remoteCode.Load().(Code); ok {
+		return code
+	}
+
+	if err := j.parent.Err(); err != nil {
+		status, _ := StatusFromError(err)
+
+		return status.Code
+	}
+
+	return CodeOK
+}
+
+// setContext replaces the context of the stream. It must be called before the stream is started.
+func (j *rpcStream) setContext(ctx context.Context) {
+	ctx, j.trailer = withTrailer(ctx)
+
+	j.parent = ctx
+	j.context, j.cancel = context.WithCancel(ctx)
+}
+
+// start begins reading frames off of the underlying stream. Once the remote end closes the stream (or the stream
+// fails) the context of the stream is cancelled.
+func (j *rpcStream) start() {
+	go func() {
+		var last []byte
+
+		defer j.cancel()
+		defer close(j.frames)
+		defer func() {
+			ended := j.recordFinalFrame(last)
+
+			// clients that close the stream without sending the end-of-stream frame abandoned the call
+			if !ended && j.side == SideServer && errors.Is(j.readErr, io.EOF) {
+				j.readErr = Errorf(CodeCanceled, "stream closed before the client finished sending")
+			}
+		}()
+
+		for {
+			data, err := j.readFrame()
+			if err != nil {
+				j.readErr = j.connectionErr(err)
+
+				return
+			}
+
+			last = data
+			atomic.AddInt64(&j.received, 1)
+
+			select {
+			case j.frames <- data:
+			case <-j.closed:
+				j.readErr = io.EOF
+
+				return
+			}
+		}
+	}()
+}
+
+// recordFinalFrame inspects the last frame read off of the stream, reporting whether the remote end ended the stream
+// with a status or trailer. These frames are not counted as messages, and the code of the status sent by the remote end
+// is stored for clients to report.
+func (j *rpcStream) recordFinalFrame(data []byte) bool {
+	if data == nil {
+		return false
+	}
+
+	frame := &Frame{}
+	if err := j.encoding.Decoder(bytes.NewReader(data)).Decode(frame); err != nil {
+		return false
+	}
+
+	if frame.Status != nil || frame.Trailer != nil {
+		atomic.AddInt64(&j.received, -1)
+	}
+
+	if frame.Status != nil {
+		j.remoteCode.Store(frame.Status.Code)
+		j.final.Store(frame.Status)
+	}
+
+	return frame.Status != nil || frame.Trailer != nil
+}
+
+// readFrame reads a single length-prefixed frame off of the underlying stream. Frames larger than the receive limit are
+// rejected before they are read into memory. As the rest of the stream can no longer be trusted, nothing more is read.
+func (j *rpcStream) readFrame() ([]byte, error) {
+	length, err := binary.ReadUvarint(j.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > uint64(j.maxRecvMsgSize) {
+		return nil, Errorf(CodeResourceExhausted, "received message larger than max (%d vs. %d)", length, j.maxRecvMsgSize)
+	}
+
+	data := make([]byte, length)
+
+	_, err = io.ReadFull(j.reader, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// nextFrame returns the next frame that was read from the underlying stream. Frames that have already been read are
+// always returned before reporting why the stream ended.
+func (j *rpcStream) nextFrame() ([]byte, error) {
+	select {
+	case data, ok := <-j.frames:
+		return j.frameOrErr(data, ok)
+	default:
+	}
+
+	var timeout <-chan time.Time
+
+	if deadline, ok := j.readDeadline.Load().(time.Time); ok && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case data, ok := <-j.frames:
+		return j.frameOrErr(data, ok)
+	case <-timeout:
+		return nil, yamux.ErrTimeout
+	case <-j.context.Done():
+		select {
+		case data, ok := <-j.frames:
+			return j.frameOrErr(data, ok)
+		default:
+			return nil, j.context.Err()
+		}
+	}
+}
+
+func (j *rpcStream) frameOrErr(data []byte, ok bool) ([]byte, error) {
+	switch {
+	case ok:
+		return data, nil
+	case j.parent.Err() != nil:
+		return nil, j.parent.Err()
+	}
+
+	return nil, j.readErr
 }
 
 func (j *rpcStream) Context() context.Context {
@@ -82,20 +329,58 @@ func (j *rpcStream) Context() context.Context {
 }
 
 func (j *rpcStream) SetReadDeadline(deadline time.Time) error {
-	return j.stream.SetReadDeadline(deadline)
+	j.readDeadline.Store(deadline)
+
+	return nil
 }
 
 func (j *rpcStream) ReadMsg(i interface{}) error {
+	data, err := j.nextFrame()
+	if err != nil {
+		return err
+	}
+
+	if err = j.decode(data, i); err != nil {
+		return err
+	}
+
+	j.metrics.MessageReceived(j.side, j.method, len(data))
+
+	return nil
+}
+
+// decode unpacks the body of the frame into the provided message. Status frames are converted into errors, except for
+// OK statuses which mark the end of the stream and are reported as io.EOF.
+func (j *rpcStream) decode(data []byte, i interface{}) error {
 	frame := &Frame{
 		Body: i,
 	}
 
-	if err := j.decoder.Decode(frame); err != nil {
+	if err := j.encoding.Decoder(bytes.NewReader(data)).Decode(frame); err != nil {
 		return err
 	}
 
+	if frame.Trailer != nil && j.trailer != nil {
+		j.trailer.set(frame.Trailer)
+	}
+
 	if frame.Status != nil {
-		return fmt.Errorf("%d: %s", frame.Status.Code, frame.Status.Message)
+		j.remoteCode.Store(frame.Status.Code)
+	}
+
+	switch {
+	case frame.Status != nil && frame.Status.Code == CodeOK:
+		// an OK status marks the end of the messages sent by the remote end
+		return io.EOF
+	case frame.Status != nil:
+		return &Error{
+			Code:    frame.Status.Code,
+			Message: frame.Status.Message,
+			Details: frame.Status.Details,
+		}
+	case frame.Trailer != nil:
+		// trailers are only sent in the final frame of a stream
+		return io.EOF
 	}
 
 	return nil
@@ -111,16 +396,162 @@ func (j *rpcStream) WriteMsg(i interface{}) error {
 		Body:  i,
 	}
 
-	err, ok := i.(*Status)
-	if ok {
-		frame.Status = err
+	status, ok := i.(*Status)
+	switch {
+	case ok && status.Code == CodeOK:
+		return j.CloseSend()
+	case ok:
+		frame.Status = status
 		frame.Body = nil
 	}
 
-	return j.encoder.Encode(frame)
+	data, err := j.marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	if j.maxSendMsgSize > 0 && len(data) > j.maxSendMsgSize {
+		return Errorf(CodeResourceExhausted, "trying to send message larger than max (%d vs. %d)", len(data), j.maxSendMsgSize)
+	}
+
+	if err = j.writeFrame(data, frame.Status == nil); err != nil {
+		return err
+	}
+
+	if frame.Status == nil {
+		atomic.AddInt64(&j.sent, 1)
+		j.metrics.MessageSent(j.side, j.method, len(data))
+	}
+
+	return nil
+}
+
+// finish writes the final frame of the stream containing the status of the call and its trailer. Nothing is written
+// when the call succeeded without setting a trailer.
+func (j *rpcStream) finish(status *Status) error {
+	trailer := j.trailer.get()
+	if status == nil && len(trailer) == 0 {
+		return nil
+	}
+
+	frame := &Frame{
+		Nonce:  nonce(),
+		Status: status,
+	}
+
+	if len(trailer) > 0 {
+		frame.Trailer = trailer
+	}
+
+	return j.encode(frame)
+}
+
+func (j *rpcStream) encode(frame *Frame) error {
+	data, err := j.marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	return j.writeFrame(data, false)
+}
+
+func (j *rpcStream) marshal(frame *Frame) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if err := j.encoding.Encoder(buffer).Encode(frame); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// CloseSend writes the end-of-stream frame, telling the remote end that no more messages will be sent. Messages can
+// still be read until the remote end finishes. Calling CloseSend more than once has no effect.
+func (j *rpcStream) CloseSend() error {
+	data, err := j.marshal(&Frame{
+		Nonce:  nonce(),
+		Status: &Status{Code: CodeOK},
+	})
+	if err != nil {
+		return err
+	}
+
+	j.writeMu.Lock()
+	defer j.writeMu.Unlock()
+
+	if j.sendClosed {
+		return nil
+	}
+
+	j.sendClosed = true
+
+	return j.write(data)
+}
+
+// writeFrame writes the length-prefixed frame to the underlying stream. Messages are rejected once the end of the
+// stream has been sent, but status frames are not so servers can still report how the call completed.
+func (j *rpcStream) writeFrame(frame []byte, message bool) error {
+	j.writeMu.Lock()
+	defer j.writeMu.Unlock()
+
+	if message && j.sendClosed {
+		return ErrSendClosed
+	}
+
+	return j.write(frame)
+}
+
+// write sends the length-prefixed frame using a single write. Callers must hold the write lock.
+func (j *rpcStream) write(frame []byte) error {
+	data := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(frame))
+	n := binary.PutUvarint(data, uint64(len(frame)))
+	data = append(data[:n], frame...)
+
+	_, err := j.stream.Write(data)
+	if err != nil {
+		// the remote end may have failed the call before reading what was sent, in which case its status explains why
+		if status, ok := j.final.Load().(*Status); ok && status.Code != CodeOK {
+			return &Error{
+				Code:    status.Code,
+				Message: status.Message,
+				Details: status.Details,
+			}
+		}
+
+		return j.connectionErr(err)
+	}
+
+	return nil
+}
+
+// connectionErr reports streams that failed because their session was torn down as unavailable, letting callers know
+// the call can be retried on a new session.
+func (j *rpcStream) connectionErr(err error) error {
+	if _, ok := StatusFromError(err); ok {
+		return err
+	}
+
+	if j.stream.Session().IsClosed() || errors.Is(err, yamux.ErrConnectionReset) {
+		return Errorf(CodeUnavailable, "connection lost: %v", err)
+	}
+
+	return err
 }
 
 func (j *rpcStream) Close() error {
+	j.closeOnce.Do(func() {
+		close(j.closed)
+
+		// streams closed by the caller before their context ends completed successfully, unless told otherwise
+		if j.parent != nil && j.parent.Err() == nil {
+			j.remoteCode.CompareAndSwap(nil, CodeOK)
+		}
+
+		// streams that fail before they are started never had a context assigned
+		if j.cancel != nil {
+			j.cancel()
+		}
+	})
+
 	return j.stream.Close()
 }
 
@@ -0,0 +1,196 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.pitz.tech/lib/headers"
+)
+
+const (
+	// TraceParentHeader is the W3C Trace Context header that carries the trace and parent span of a stream.
+	TraceParentHeader = "traceparent"
+	// TraceStateHeader is the W3C Trace Context header that carries vendor specific trace state.
+	TraceStateHeader = "tracestate"
+)
+
+// Attributes recorded on every span.
+const (
+	AttributeMethod           = "rpc.method"
+	AttributePeer             = "net.peer"
+	AttributeCode             = "rpc.code"
+	AttributeMessagesSent     = "rpc.messages_sent"
+	AttributeMessagesReceived = "rpc.messages_received"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext identifies a span and carries the portion of the trace that is propagated between processes.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+// IsValid reports whether the span context has both a trace and span identifier.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent formats the span context as the value of a traceparent header.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceParent parses the value of a traceparent header. Future versions of the header are accepted as long as
+// they start with the fields defined by version 00.
+func ParseTraceParent(value string) (SpanContext, error) {
+	sc := SpanContext{}
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("malformed traceparent %q", value)
+	}
+
+	if err := decodeID(sc.TraceID[:], parts[1]); err != nil {
+		return sc, fmt.Errorf("malformed trace id in traceparent %q", value)
+	}
+
+	if err := decodeID(sc.SpanID[:], parts[2]); err != nil {
+		return sc, fmt.Errorf("malformed span id in traceparent %q", value)
+	}
+
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("malformed flags in traceparent %q", value)
+	}
+
+	sc.Sampled = flags&0x01 == 0x01
+
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+
+	return sc, nil
+}
+
+func decodeID(dst []byte, value string) error {
+	if len(value) != 2*len(dst) || strings.ToLower(value) != value {
+		return fmt.Errorf("invalid length")
+	}
+
+	_, err := hex.Decode(dst, []byte(value))
+
+	return err
+}
+
+// injectSpanContext writes the span context to the provided header.
+func injectSpanContext(header headers.Header, sc SpanContext) {
+	header.Set(TraceParentHeader, sc.TraceParent())
+
+	if sc.TraceState != "" {
+		header.Set(TraceStateHeader, sc.TraceState)
+	}
+}
+
+// extractSpanContext reads the span context from the provided header.
+func extractSpanContext(header headers.Header) (SpanContext, bool) {
+	sc, err := ParseTraceParent(header.Get(TraceParentHeader))
+	if err != nil {
+		return SpanContext{}, false
+	}
+
+	sc.TraceState = header.Get(TraceStateHeader)
+
+	return sc, true
+}
+
+// Span describes the work done on one end of a stream.
+type Span struct {
+	Name       string
+	Side       Side
+	Context    SpanContext
+	Parent     SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+}
+
+// SpanRecorder receives spans as they complete. Implementations must be safe for concurrent use. See the tracing
+// package for an in-memory implementation.
+type SpanRecorder interface {
+	RecordSpan(span Span)
+}
+
+// newSpan starts a span as a child of the provided parent. When the parent is invalid, a new trace is started.
+func newSpan(parent SpanContext, side Side, method, peer string) *Span {
+	span := &Span{
+		Name:   method,
+		Side:   side,
+		Parent: parent,
+		Start:  time.Now(),
+		Attributes: map[string]string{
+			AttributeMethod: method,
+			AttributePeer:   peer,
+		},
+	}
+
+	span.Context = SpanContext{
+		TraceID:    parent.TraceID,
+		Sampled:    true,
+		TraceState: parent.TraceState,
+	}
+
+	if parent.IsValid() {
+		span.Context.Sampled = parent.Sampled
+	} else {
+		randomID(span.Context.TraceID[:])
+	}
+
+	randomID(span.Context.SpanID[:])
+
+	return span
+}
+
+func randomID(id []byte) {
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package tracing provides an in-memory yarpc.SpanRecorder, useful for asserting how calls are traced in tests.
+//
+//	exporter := &tracing.InMemory{}
+//	svr.Serve(listener, yarpc.WithSpanRecorder(exporter))
+//
+//	spans := exporter.Spans()
+package tracing
+
+import (
+	"sync"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+// InMemory collects the spans it records in the order they complete. The zero value is ready for use.
+type InMemory struct {
+	mu    sync.Mutex
+	spans []yarpc.Span
+}
+
+func (m *InMemory) RecordSpan(span yarpc.Span) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.spans = append(m.spans, span)
+}
+
+// Spans returns a copy of the spans that have been recorded.
+func (m *InMemory) Spans() []yarpc.Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]yarpc.Span{}, m.spans...)
+}
+
+// Trace returns the recorded spans belonging to the provided trace.
+func (m *InMemory) Trace(traceID yarpc.TraceID) []yarpc.Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	spans := make([]yarpc.Span, 0)
+
+	for _, span := range m.spans {
+		if span.Context.TraceID == traceID {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+// Reset discards every recorded span.
+func (m *InMemory) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.spans = nil
+}
+
+var _ yarpc.SpanRecorder = &InMemory{}
@@ -0,0 +1,176 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tracing_test
+
+import (
+	"context"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+	"go.pitz.tech/lib/yarpc/tracing"
+)
+
+func serve(t *testing.T, mux *yarpc.ServeMux, opts ...yarpc.Option) string {
+	t.Helper()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	netListener, err := net.Listen("unix", address)
+	require.NoError(t, err)
+
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(&yarpc.NetListenerAdapter{Listener: netListener}, opts...)
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	return address
+}
+
+func call(ctx context.Context, cc *yarpc.ClientConn, method string) error {
+	stream, err := cc.OpenStream(ctx, method)
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	if err = stream.WriteMsg("ping"); err != nil {
+		return err
+	}
+
+	reply := ""
+
+	return stream.ReadMsg(&reply)
+}
+
+func TestPropagation(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exporter := &tracing.InMemory{}
+
+	// the backend answers every call
+	backendMux := &yarpc.ServeMux{}
+	backendMux.Handle("backend.Ping", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		msg := ""
+		if err := stream.ReadMsg(&msg); err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(msg)
+	}))
+
+	backendAddress := serve(t, backendMux, yarpc.WithSpanRecorder(exporter))
+	backend := yarpc.DialContext(ctx, "unix", backendAddress, yarpc.WithSpanRecorder(exporter))
+
+	// the frontend calls the backend using the context of its stream
+	frontendMux := &yarpc.ServeMux{}
+	frontendMux.Handle("frontend.Ping", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		msg := ""
+		if err := stream.ReadMsg(&msg); err != nil {
+			return err
+		}
+
+		if err := call(stream.Context(), backend, "backend.Ping"); err != nil {
+			return err
+		}
+
+		return stream.WriteMsg(msg)
+	}))
+
+	frontendAddress := serve(t, frontendMux, yarpc.WithSpanRecorder(exporter))
+	frontend := yarpc.DialContext(ctx, "unix", frontendAddress, yarpc.WithSpanRecorder(exporter))
+
+	root := yarpc.SpanContext{
+		TraceID:    yarpc.TraceID{1},
+		SpanID:     yarpc.SpanID{1},
+		Sampled:    true,
+		TraceState: "vendor=value",
+	}
+
+	require.NoError(t, call(yarpc.SpanContextToContext(ctx, root), frontend, "frontend.Ping"))
+
+	var spans []yarpc.Span
+
+	require.Eventually(t, func() bool {
+		spans = exporter.Trace(root.TraceID)
+
+		return len(spans) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	bySide := make(map[string]yarpc.Span)
+	for _, span := range spans {
+		bySide[string(span.Side)+" "+span.Name] = span
+
+		require.Equal(t, "vendor=value", span.Context.TraceState)
+		require.Equal(t, "OK", span.Attributes[yarpc.AttributeCode])
+		require.Equal(t, "1", span.Attributes[yarpc.AttributeMessagesSent])
+		require.Equal(t, "1", span.Attributes[yarpc.AttributeMessagesReceived])
+		require.NotEmpty(t, span.Attributes[yarpc.AttributePeer])
+		require.False(t, span.End.Before(span.Start))
+	}
+
+	frontendClient := bySide["client frontend.Ping"]
+	frontendServer := bySide["server frontend.Ping"]
+	backendClient := bySide["client backend.Ping"]
+	backendServer := bySide["server backend.Ping"]
+
+	require.Equal(t, root, frontendClient.Parent)
+	require.Equal(t, frontendClient.Context, frontendServer.Parent)
+	require.Equal(t, frontendServer.Context, backendClient.Parent)
+	require.Equal(t, backendClient.Context, backendServer.Parent)
+	require.Equal(t, "backend.Ping", backendServer.Attributes[yarpc.AttributeMethod])
+}
+
+func TestFailedCall(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	exporter := &tracing.InMemory{}
+
+	address := serve(t, &yarpc.ServeMux{}, yarpc.WithSpanRecorder(exporter))
+	cc := yarpc.DialContext(ctx, "unix", address, yarpc.WithSpanRecorder(exporter))
+
+	require.ErrorIs(t, call(ctx, cc, "missing"), &yarpc.Error{Code: yarpc.CodeNotFound})
+
+	require.Eventually(t, func() bool {
+		return len(exporter.Spans()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	spans := exporter.Spans()
+	require.Equal(t, spans[0].Context.TraceID, spans[1].Context.TraceID)
+
+	for _, span := range spans {
+		require.Equal(t, "NotFound", span.Attributes[yarpc.AttributeCode])
+	}
+
+	exporter.Reset()
+	require.Empty(t, exporter.Spans())
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"errors"
+	"io"
+	"reflect"
+)
+
+// ClientStream provides typed access to the client side of a stream that sends Req messages to the server and receives
+// Resp messages from it. Client streaming calls send their messages and then use CloseAndRecv to wait for the response.
+//
+//	stream := &yarpc.ClientStream[*Request, *Response]{Stream: stream}
+type ClientStream[Req, Resp any] struct {
+	Stream
+}
+
+// Send sends a message to the server.
+func (s *ClientStream[Req, Resp]) Send(msg Req) error {
+	return s.WriteMsg(msg)
+}
+
+// Recv receives the next message from the server. io.EOF is returned once the server has finished sending messages.
+func (s *ClientStream[Req, Resp]) Recv() (Resp, error) {
+	return recv[Resp](s.Stream)
+}
+
+// RecvAll receives messages until the server has finished sending them. The messages received before an error occurred
+// are returned along with it.
+func (s *ClientStream[Req, Resp]) RecvAll() ([]Resp, error) {
+	return recvAll[Resp](s.Stream)
+}
+
+// CloseAndRecv tells the server no more messages will be sent on the stream and waits for its response.
+func (s *ClientStream[Req, Resp]) CloseAndRecv() (Resp, error) {
+	if err := s.CloseSend(); err != nil {
+		var zero Resp
+
+		return zero, err
+	}
+
+	return s.Recv()
+}
+
+// ServerStream provides typed access to the server side of a stream that receives Req messages from the client and
+// sends Resp messages to it. Returning from the handler ends the stream.
+//
+//	stream := &yarpc.ServerStream[*Request, *Response]{Stream: stream}
+type ServerStream[Req, Resp any] struct {
+	Stream
+}
+
+// Send sends a message to the client.
+func (s *ServerStream[Req, Resp]) Send(msg Resp) error {
+	return s.WriteMsg(msg)
+}
+
+// Recv receives the next message from the client. io.EOF is returned once the client has called CloseSend.
+func (s *ServerStream[Req, Resp]) Recv() (Req, error) {
+	return recv[Req](s.Stream)
+}
+
+// RecvAll receives messages until the client has called CloseSend. The messages received before an error occurred are
+// returned along with it.
+func (s *ServerStream[Req, Resp]) RecvAll() ([]Req, error) {
+	return recvAll[Req](s.Stream)
+}
+
+// recv reads the next message off of the stream. Messages of pointer types are allocated before they are read, so the
+// message is never nil.
+func recv[T any](stream Stream) (T, error) {
+	var msg T
+
+	if typ := reflect.TypeOf(msg); typ != nil && typ.Kind() == reflect.Ptr {
+		msg = reflect.New(typ.Elem()).Interface().(T)
+
+		return msg, stream.ReadMsg(msg)
+	}
+
+	err := stream.ReadMsg(&msg)
+
+	return msg, err
+}
+
+func recvAll[T any](stream Stream) ([]T, error) {
+	var msgs []T
+
+	for {
+		msg, err := recv[T](stream)
+
+		switch {
+		case errors.Is(err, io.EOF):
+			return msgs, nil
+		case err != nil:
+			return msgs, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+type Count struct {
+	N int
+}
+
+func TestTypedStreams(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	mux := &yarpc.ServeMux{}
+
+	// Sum replies once the client has finished sending
+	mux.Handle("/count.Counter/Sum", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		call := &yarpc.ServerStream[*Count, *Count]{Stream: stream}
+
+		counts, err := call.RecvAll()
+		if err != nil {
+			return err
+		}
+
+		sum := &Count{}
+		for _, count := range counts {
+			sum.N += count.N
+		}
+
+		return call.Send(sum)
+	}))
+
+	// Double replies to each message until the client has finished sending
+	mux.Handle("/count.Counter/Double", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		call := &yarpc.ServerStream[Count, Count]{Stream: stream}
+
+		for {
+			count, err := call.Recv()
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if err = call.Send(Count{N: count.N * 2}); err != nil {
+				return err
+			}
+		}
+	}))
+
+	// Record reports how receiving the messages sent by the client ended
+	recorded := make(chan error, 1)
+
+	mux.Handle("/count.Counter/Record", yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		call := &yarpc.ServerStream[*Count, *Count]{Stream: stream}
+
+		_, err := call.RecvAll()
+		recorded <- err
+
+		return err
+	}))
+
+	listener := yarpc.NewMemoryListener()
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(listener)
+	}()
+
+	t.Cleanup(func() {
+		_ = svr.Shutdown()
+	})
+
+	cc := yarpc.DialMemory(ctx, listener)
+
+	t.Run("client streaming", func(t *testing.T) {
+		t.Parallel()
+
+		stream, err := cc.OpenStream(ctx, "/count.Counter/Sum")
+		require.NoError(t, err)
+		defer stream.Close()
+
+		call := &yarpc.ClientStream[*Count, *Count]{Stream: stream}
+
+		for i := 1; i <= 10; i++ {
+			require.NoError(t, call.Send(&Count{N: i}))
+		}
+
+		sum, err := call.CloseAndRecv()
+		require.NoError(t, err)
+		require.Equal(t, 55, sum.N)
+
+		// messages can no longer be sent, but closing the sending side again is fine
+		require.ErrorIs(t, call.Send(&Count{N: 1}), yarpc.ErrSendClosed)
+		require.NoError(t, call.CloseSend())
+	})
+
+	t.Run("bidirectional streaming", func(t *testing.T) {
+		t.Parallel()
+
+		stream, err := cc.OpenStream(ctx, "/count.Counter/Double")
+		require.NoError(t, err)
+		defer stream.Close()
+
+		call := &yarpc.ClientStream[Count, Count]{Stream: stream}
+
+		require.NoError(t, call.Send(Count{N: 1}))
+
+		count, err := call.Recv()
+		require.NoError(t, err)
+		require.Equal(t, 2, count.N)
+
+		require.NoError(t, call.Send(Count{N: 2}))
+		require.NoError(t, call.Send(Count{N: 3}))
+		require.NoError(t, call.CloseSend())
+
+		counts, err := call.RecvAll()
+		require.NoError(t, err)
+		require.Equal(t, []Count{{N: 4}, {N: 6}}, counts)
+	})
+
+	t.Run("abandoned stream", func(t *testing.T) {
+		t.Parallel()
+
+		stream, err := cc.OpenStream(ctx, "/count.Counter/Record")
+		require.NoError(t, err)
+
+		call := &yarpc.ClientStream[*Count, *Count]{Stream: stream}
+		require.NoError(t, call.Send(&Count{N: 1}))
+
+		// closing without CloseSend must not look like the client finished sending
+		require.NoError(t, call.Close())
+		require.ErrorIs(t, <-recorded, &yarpc.Error{Code: yarpc.CodeCanceled})
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrPeerCredUnsupported is returned when the credentials of a peer cannot be determined for a connection.
+var ErrPeerCredUnsupported = errors.New("peer credentials are not supported for this connection")
+
+// PeerCred identifies the process on the other end of a unix domain socket.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// ListenUnix listens on a unix domain socket at the provided path and restricts access to it using the provided file
+// mode. Any socket left behind at the path by a previous process is removed first. Handlers served from the returned
+// listener can identify the calling process using ExtractPeerCred.
+//
+//	listener, err := yarpc.ListenUnix("/var/run/app.sock", 0o600)
+//	go svr.Serve(listener)
+func ListenUnix(path string, mode os.FileMode) (*NetListenerAdapter, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// the socket is created in a private directory and only linked into place once its mode has been set, so no one
+	// can connect to it while it has the default permissions
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".yarpc")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "sock")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	// the private path is removed along with the directory, the socket is unlinked from its final path instead
+	listener.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(private, mode); err == nil {
+		err = os.Link(private, path)
+	}
+
+	if err != nil {
+		_ = listener.Close()
+
+		return nil, err
+	}
+
+	return &NetListenerAdapter{
+		Listener: &unixListener{
+			UnixListener: listener,
+			addr:         &net.UnixAddr{Name: path, Net: "unix"},
+		},
+	}, nil
+}
+
+// unixListener reports the path the socket was linked to as its address, and unlinks it once closed.
+type unixListener struct {
+	*net.UnixListener
+
+	addr      *net.UnixAddr
+	closeOnce sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+
+	l.closeOnce.Do(func() {
+		_ = os.Remove(l.addr.Name)
+	})
+
+	return err
+}
+
+// peerCred returns the credentials of the process on the other end of the connection.
+func peerCred(conn io.ReadWriteCloser) (PeerCred, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCred{}, ErrPeerCredUnsupported
+	}
+
+	return unixPeerCred(unixConn)
+}
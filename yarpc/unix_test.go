@@ -0,0 +1,129 @@
+// Copyright (C) 2021 Mya Pitzeruse
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package yarpc_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"go.pitz.tech/lib/yarpc"
+)
+
+func TestListenUnix(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	// a socket left behind by a previous process is replaced
+	stale, err := yarpc.ListenUnix(address, 0o600)
+	require.NoError(t, err)
+	require.NoError(t, stale.Listener.Close())
+
+	listener, err := yarpc.ListenUnix(address, 0o600)
+	require.NoError(t, err)
+
+	info, err := os.Stat(address)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	require.Equal(t, address, listener.Listener.Addr().String())
+
+	// the private directory the socket was created in is cleaned up
+	entries, err := os.ReadDir(path.Dir(address))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	mux := &yarpc.ServeMux{}
+	mux.Handle(method, yarpc.HandlerFunc(func(stream yarpc.Stream) error {
+		cred, ok := yarpc.ExtractPeerCred(stream.Context())
+
+		return stream.WriteMsg(map[string]interface{}{
+			"ok":  ok,
+			"pid": cred.PID,
+			"uid": cred.UID,
+		})
+	}))
+
+	svr := &yarpc.Server{Handler: mux}
+
+	go func() {
+		_ = svr.Serve(listener)
+	}()
+
+	t.Cleanup(func() { _ = svr.Shutdown() })
+
+	cc := yarpc.DialContext(ctx, "unix", address)
+
+	stream, err := cc.OpenStream(ctx, method)
+	require.NoError(t, err)
+
+	reply := struct {
+		OK  bool   `msgpack:"ok"`
+		PID int32  `msgpack:"pid"`
+		UID uint32 `msgpack:"uid"`
+	}{}
+	require.NoError(t, stream.ReadMsg(&reply))
+
+	if runtime.GOOS != "linux" {
+		require.False(t, reply.OK)
+
+		return
+	}
+
+	require.True(t, reply.OK)
+	require.Equal(t, int32(os.Getpid()), reply.PID)
+	require.Equal(t, uint32(os.Getuid()), reply.UID)
+}
+
+func TestListenUnixExistingFile(t *testing.T) {
+	t.Parallel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+	require.NoError(t, os.WriteFile(address, []byte("data"), 0o600))
+
+	// files that are not sockets are left alone
+	_, err := yarpc.ListenUnix(address, 0o600)
+	require.Error(t, err)
+
+	data, err := os.ReadFile(address)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+
+	entries, err := os.ReadDir(path.Dir(address))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestListenUnixClose(t *testing.T) {
+	t.Parallel()
+
+	address := path.Join(t.TempDir(), "yarpc.sock")
+
+	listener, err := yarpc.ListenUnix(address, 0o600)
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	_, err = os.Lstat(address)
+	require.True(t, os.IsNotExist(err))
+}